@@ -11,6 +11,40 @@ type CollectNetwork struct {
 	NetworkStats       map[string]NetworkStats `json:"networkStats"`
 	SocketStats        map[string]int          `json:"socketStats"`
 	NetfilterConnTrack int                     `json:"netfilterConnTrack"`
+	Seconds            int                     `json:"seconds,omitempty"`
+}
+
+// Samples returns quantity of per-second samples, rollup contains more than one
+func (cn *CollectNetwork) Samples() int {
+	if cn.Seconds == 0 {
+		return 1
+	}
+	return cn.Seconds
+}
+
+// Merge accumulates sample into rollup: sums deltas of network stats,
+// takes socket stats and conntrack from the latest sample, time stays at start
+func (cn *CollectNetwork) Merge(o *CollectNetwork) {
+	stats := make(map[string]NetworkStats, len(cn.NetworkStats))
+	for face, val := range cn.NetworkStats {
+		stats[face] = val
+	}
+	for face, val := range o.NetworkStats {
+		sum := stats[face]
+		sum.BytesRx += val.BytesRx
+		sum.PacketsRx += val.PacketsRx
+		sum.ErrsPksRx += val.ErrsPksRx
+		sum.DropPksRx += val.DropPksRx
+		sum.BytesTx += val.BytesTx
+		sum.PacketsTx += val.PacketsTx
+		sum.ErrsPksTx += val.ErrsPksTx
+		sum.DropPksTx += val.DropPksTx
+		stats[face] = sum
+	}
+	cn.NetworkStats = stats
+	cn.SocketStats = o.SocketStats
+	cn.NetfilterConnTrack = o.NetfilterConnTrack
+	cn.Seconds = cn.Samples() + o.Samples()
 }
 
 type NetworkStats struct {
@@ -25,8 +59,10 @@ type NetworkStats struct {
 }
 
 type BlackholeCounter struct {
-	QuantityRules int `json:"quantityRules"`
-	IPv4          struct {
+	QuantityRules int `json:"quantityRules"` // entries as sent
+	// QuantityEffective prefixes in sets after aggregation of entries
+	QuantityEffective int `json:"quantityEffective"`
+	IPv4              struct {
 		Packets int `json:"packets"`
 		Bytes   int `json:"bytes"`
 	}
@@ -34,6 +70,41 @@ type BlackholeCounter struct {
 		Packets int `json:"packets"`
 		Bytes   int `json:"bytes"`
 	}
+	Countries struct {
+		Packets int `json:"packets"`
+		Bytes   int `json:"bytes"`
+	} `json:"countries"`
+	// Queue of blackhole-add/del, counts since previous counter
+	Queue struct {
+		Depth        int `json:"depth"`
+		Batches      int `json:"batches"`
+		Applied      int `json:"applied"`
+		Coalesced    int `json:"coalesced"`
+		Failed       int `json:"failed"`
+		LatencyAvgMs int `json:"latencyAvgMs"`
+		LatencyMaxMs int `json:"latencyMaxMs"`
+	} `json:"queue"`
+	Feeds map[string]BlackholeFeedCounter `json:"feeds"`
+	// KilledFlows deleted from conntrack on additions since previous counter
+	KilledFlows int `json:"killedFlows"`
+}
+
+type BlackholeFeedCounter struct {
+	Prefixes int `json:"prefixes"`
+	Packets  int `json:"packets"`
+	Bytes    int `json:"bytes"`
+}
+
+type SynproxyCounter struct {
+	Ports  string `json:"ports"`
+	Passed struct {
+		Packets int `json:"packets"`
+		Bytes   int `json:"bytes"`
+	} `json:"passed"`
+	Dropped struct {
+		Packets int `json:"packets"`
+		Bytes   int `json:"bytes"`
+	} `json:"dropped"`
 }
 
 type WireguardStats struct {
@@ -58,12 +129,13 @@ type Collector struct {
 	data        CollectNetwork
 	ChanNetwork chan *CollectNetwork
 
-	ChanBHCounter chan *BlackholeCounter
-	prevWgStats   map[string]*WireguardStats
-	ChanWgStats   chan *WireguardStats
-	ChanNetSysctl chan map[string]string
-	sysCtlParams  map[string]string
-	ChanPingRTT   chan []PingStats
+	ChanBHCounter       chan *BlackholeCounter
+	ChanSynproxyCounter chan *SynproxyCounter
+	prevWgStats         map[string]*WireguardStats
+	ChanWgStats         chan *WireguardStats
+	ChanNetSysctl       chan map[string]string
+	sysCtlParams        map[string]string
+	ChanPingRTT         chan []PingStats
 }
 
 func New() *Collector {
@@ -72,11 +144,12 @@ func New() *Collector {
 		data:        CollectNetwork{},
 		ChanNetwork: make(chan *CollectNetwork, 1),
 
-		ChanBHCounter: make(chan *BlackholeCounter, 1),
-		prevWgStats:   map[string]*WireguardStats{},
-		ChanWgStats:   make(chan *WireguardStats, 1),
-		ChanNetSysctl: make(chan map[string]string, 1),
-		ChanPingRTT:   make(chan []PingStats, 1),
+		ChanBHCounter:       make(chan *BlackholeCounter, 1),
+		ChanSynproxyCounter: make(chan *SynproxyCounter, 1),
+		prevWgStats:         map[string]*WireguardStats{},
+		ChanWgStats:         make(chan *WireguardStats, 1),
+		ChanNetSysctl:       make(chan map[string]string, 1),
+		ChanPingRTT:         make(chan []PingStats, 1),
 	}
 
 	go c.senderNetwork()
@@ -13,6 +13,7 @@ func (c *Collector) collectSysctl() {
 		"net.netfilter.nf_conntrack_max":                     "",
 		"net.netfilter.nf_conntrack_tcp_timeout_established": "",
 		"net.netfilter.nf_conntrack_buckets":                 "",
+		"net.netfilter.nf_conntrack_tcp_loose":               "",
 
 		// anti-spoofing (only IPv4)
 		"net.ipv4.conf.all.rp_filter":     "",
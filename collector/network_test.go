@@ -45,3 +45,37 @@ vethe642356:       0       0    0    0    0     0          0         0   343736
 
 	t.Logf("%+v", c.data.NetworkStats)
 }
+
+func TestCollectNetworkMerge(t *testing.T) {
+	t.Parallel()
+
+	first := &CollectNetwork{
+		NetworkStats: map[string]NetworkStats{"eth0": {BytesRx: 100, PacketsTx: 2}},
+		SocketStats:  map[string]int{"tcp": 10},
+	}
+	shared := first.NetworkStats
+	rollup := *first
+
+	rollup.Merge(&CollectNetwork{
+		NetworkStats:       map[string]NetworkStats{"eth0": {BytesRx: 50, PacketsTx: 1}, "wg0": {BytesTx: 7}},
+		SocketStats:        map[string]int{"tcp": 12},
+		NetfilterConnTrack: 3,
+	})
+	rollup.Merge(&CollectNetwork{SocketStats: map[string]int{"tcp": 14}, NetfilterConnTrack: 5, Seconds: 3})
+
+	if rollup.Seconds != 5 {
+		t.Fatal("wrong seconds:", rollup.Seconds)
+	}
+	if e := rollup.NetworkStats["eth0"]; e.BytesRx != 150 || e.PacketsTx != 3 {
+		t.Fatalf("wrong sum eth0: %+v", e)
+	}
+	if rollup.NetworkStats["wg0"].BytesTx != 7 {
+		t.Fatal("wrong sum wg0")
+	}
+	if rollup.SocketStats["tcp"] != 14 || rollup.NetfilterConnTrack != 5 {
+		t.Fatal("gauges must be taken from the latest sample")
+	}
+	if shared["eth0"].BytesRx != 100 {
+		t.Fatal("source sample mutated")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type CommandResult struct {
+	Id       string   `json:"id"`
+	Command  string   `json:"command"`
+	Status   string   `json:"status"`
+	Duration int64    `json:"duration"`
+	Errors   []string `json:"errors"`
+	Result   any      `json:"result,omitempty"` // details of command, when it has some
+}
+
+func NewCommandResult(id, command string, start time.Time, errs []string) *CommandResult {
+	cr := &CommandResult{
+		Id:       id,
+		Command:  command,
+		Status:   "ok",
+		Duration: time.Since(start).Milliseconds(),
+		Errors:   errs,
+	}
+	if len(errs) > 0 {
+		cr.Status = "failed"
+	}
+	if cr.Errors == nil {
+		cr.Errors = []string{}
+	}
+	return cr
+}
+
+// stepErrors collects errors of steps executed by subsystems for the command result,
+// firewall gets it per command, nil of background steps drops errors, they are logged
+type stepErrors struct {
+	mu   sync.Mutex
+	errs []string
+}
+
+func (s *stepErrors) fail(format string, a ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, fmt.Sprintf(format, a...))
+}
+
+// Errors returns collected errors and resets them
+func (s *stepErrors) Errors() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := s.errs
+	s.errs = nil
+	return errs
+}
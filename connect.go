@@ -42,8 +42,9 @@ type Connection struct {
 	ws        *websocket.Conn
 	payload   *ConnectPayload
 	response  *ConnectResponse
-	chanSend  chan any
 	chanLive  chan []byte
+	outbox    *Outbox
+	handshake func()
 }
 
 func NewConnection(cp *ConnectPayload) *Connection {
@@ -66,8 +67,8 @@ func NewConnection(cp *ConnectPayload) *Connection {
 			Timeout: 8 * time.Second,
 		},
 		payload:  cp,
-		chanSend: make(chan any, 16),
 		chanLive: make(chan []byte, 16),
+		outbox:   NewOutbox(outboxLimit, os.Getenv("OUTBOX_SPOOL"), outboxSpoolMax),
 	}
 	log.Println("[connect] started")
 	for {
@@ -86,6 +87,16 @@ func (c *Connection) Response() *ConnectResponse {
 	return c.response
 }
 
+// OnHandshake sets handler called after each successful re-handshake
+func (c *Connection) OnHandshake(handler func()) {
+	c.handshake = handler
+}
+
+// Send queues event to the outbox, never blocks while connection is down
+func (c *Connection) Send(event any) {
+	c.outbox.Push(event)
+}
+
 func (c *Connection) maintain() {
 	log.Println("[connect] maintenance")
 	for range c.reconnect {
@@ -249,6 +260,12 @@ func (c *Connection) connect() error {
 	go c.writer(ctx)
 	go c.reader(cancel)
 
+	// replay events collected while offline
+	c.outbox.Online(true)
+	if c.handshake != nil {
+		go c.handshake()
+	}
+
 	return nil
 }
 
@@ -290,17 +307,23 @@ func (c *Connection) writer(ctx context.Context) {
 		case <-ctx.Done():
 			go c.degrade(fmt.Errorf("reader context done"), true)
 			return
-		case message, ok := <-c.chanSend:
-			_ = c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				go c.degrade(fmt.Errorf("write pump: hub closed the channel"), true)
-				return
-			}
-
-			wErr := c.ws.WriteJSON(message)
-			if wErr != nil {
-				go c.degrade(fmt.Errorf("write pump err: %w", wErr), true)
-				return
+		// events are taken one by one, so not delivered one keeps its place before newer
+		case <-c.outbox.Ready():
+			for i := 0; ; i++ {
+				if i == outboxBurst {
+					c.outbox.wake()
+					break
+				}
+				message, ok := c.outbox.Next()
+				if !ok {
+					break
+				}
+				_ = c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+				if wErr := c.ws.WriteJSON(message); wErr != nil {
+					c.outbox.Requeue(message)
+					go c.degrade(fmt.Errorf("write pump err: %w", wErr), true)
+					return
+				}
 			}
 		case <-ticker.C:
 			logger.Debug("[connect] write pump: send ping")
@@ -338,6 +361,7 @@ func (c *Connection) fatal(err error) {
 }
 
 func (c *Connection) degrade(err error, reconnect bool) {
+	c.outbox.Online(false)
 	log.Println("[connect] failure, err:", err)
 	if err != nil {
 		if strings.Contains(err.Error(), "number of nodes has been reached") {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// entries of blackhole are kept as sent by control plane, sets get their aggregation:
+// overlapping and adjacent entries are merged into minimal prefixes, address is blocked
+// until the latest expiry of entries covering it, so deletion of entry splits its prefix
+
+// bhBound start or end of entry in sweep, end is the address after entry
+type bhBound struct {
+	addr   netip.Addr
+	end    bool
+	expiry int64
+}
+
+// bhExpiryKey orders expiry times, permanent one is the latest
+func bhExpiryKey(expires time.Time) int64 {
+	if expires.IsZero() {
+		return math.MaxInt64
+	}
+	return expires.UnixNano()
+}
+
+func bhExpiryOf(key int64) time.Time {
+	if key == math.MaxInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, key)
+}
+
+// bhAggregate minimal prefixes with expiry of entries, zero expiry is permanent
+func bhAggregate(entries map[netip.Prefix]time.Time) map[netip.Prefix]time.Time {
+	effective := make(map[netip.Prefix]time.Time, len(entries))
+	for _, is4 := range []bool{true, false} {
+		var bounds []bhBound
+		for p, expires := range entries {
+			if p.Addr().Is4() != is4 {
+				continue
+			}
+			key := bhExpiryKey(expires)
+			bounds = append(bounds, bhBound{addr: p.Masked().Addr(), expiry: key})
+			// entry up to the last address has no end
+			if next := prefixLast(p).Next(); next.IsValid() {
+				bounds = append(bounds, bhBound{addr: next, end: true, expiry: key})
+			}
+		}
+		slices.SortFunc(bounds, func(a, b bhBound) int {
+			return a.addr.Compare(b.addr)
+		})
+
+		// segments between bounds get the latest expiry of active entries,
+		// adjacent ones with the same expiry are merged
+		var (
+			active = map[int64]int{}
+			start  netip.Addr
+			expiry int64
+		)
+		flush := func(last netip.Addr) {
+			if start.IsValid() {
+				for _, p := range rangePrefixes(start, last) {
+					effective[p] = bhExpiryOf(expiry)
+				}
+			}
+			start = netip.Addr{}
+		}
+		for i := 0; i < len(bounds); {
+			addr := bounds[i].addr
+			for ; i < len(bounds) && bounds[i].addr == addr; i++ {
+				if bounds[i].end {
+					if active[bounds[i].expiry]--; active[bounds[i].expiry] == 0 {
+						delete(active, bounds[i].expiry)
+					}
+				} else {
+					active[bounds[i].expiry]++
+				}
+			}
+			if len(active) == 0 {
+				flush(addr.Prev())
+				continue
+			}
+			latest := slices.Max(slices.Collect(maps.Keys(active)))
+			if start.IsValid() && latest == expiry {
+				continue
+			}
+			flush(addr.Prev())
+			start, expiry = addr, latest
+		}
+		if start.IsValid() {
+			flush(prefixLast(netip.PrefixFrom(start, 0)))
+		}
+	}
+	return effective
+}
+
+// bhElementsDiff elements to delete and to add per set, changed expiry replaces element
+func bhElementsDiff(from, to map[netip.Prefix]time.Time, now time.Time) (dels, adds map[string][]nftElement) {
+	dels, adds = map[string][]nftElement{}, map[string][]nftElement{}
+	setOf := func(p netip.Prefix) string {
+		if p.Addr().Is6() {
+			return "IPv6"
+		}
+		return "IPv4"
+	}
+	for p, expires := range from {
+		if next, ok := to[p]; !ok || !next.Equal(expires) {
+			dels[setOf(p)] = append(dels[setOf(p)], nftElement{Prefix: p})
+		}
+	}
+	for p, expires := range to {
+		if prev, ok := from[p]; ok && prev.Equal(expires) {
+			continue
+		}
+		var timeout time.Duration
+		if !expires.IsZero() {
+			// kernel counts timeouts in milliseconds
+			timeout = max(expires.Sub(now).Round(time.Millisecond), time.Millisecond)
+		}
+		adds[setOf(p)] = append(adds[setOf(p)], nftElement{Prefix: p, Timeout: timeout})
+	}
+	for _, list := range []map[string][]nftElement{dels, adds} {
+		for _, elements := range list {
+			slices.SortFunc(elements, func(a, b nftElement) int {
+				return a.Prefix.Addr().Compare(b.Prefix.Addr())
+			})
+		}
+	}
+	return dels, adds
+}
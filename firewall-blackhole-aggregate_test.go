@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBhAggregate(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	hour := now.Add(time.Hour)
+	entries := map[netip.Prefix]time.Time{
+		netip.MustParsePrefix("10.0.0.0/25"):   {},
+		netip.MustParsePrefix("10.0.0.128/25"): {},
+		// covered by permanent one
+		netip.MustParsePrefix("192.0.2.0/24"): {},
+		netip.MustParsePrefix("192.0.2.5/32"): hour,
+		// permanent inside timed one
+		netip.MustParsePrefix("203.0.113.0/24"):     hour,
+		netip.MustParsePrefix("203.0.113.7/32"):     {},
+		netip.MustParsePrefix("255.255.255.255/32"): {},
+		netip.MustParsePrefix("2001:db8::/33"):      hour,
+		netip.MustParsePrefix("2001:db8:8000::/33"): hour,
+	}
+	for i := range 256 {
+		entries[netip.MustParsePrefix(fmt.Sprintf("198.51.100.%d/32", i))] = hour
+	}
+	aggregated := func() []string {
+		var list []string
+		for p, expires := range bhAggregate(entries) {
+			s := prefixString(p)
+			if !expires.IsZero() {
+				s += " " + expires.Sub(now).String()
+			}
+			list = append(list, s)
+		}
+		slices.Sort(list)
+		return list
+	}
+
+	want := []string{"10.0.0.0/24", "192.0.2.0/24", "198.51.100.0/24 1h0m0s", "2001:db8::/32 1h0m0s",
+		"203.0.113.0/30 1h0m0s", "203.0.113.128/25 1h0m0s", "203.0.113.16/28 1h0m0s", "203.0.113.32/27 1h0m0s",
+		"203.0.113.4/31 1h0m0s", "203.0.113.6 1h0m0s", "203.0.113.64/26 1h0m0s", "203.0.113.7",
+		"203.0.113.8/29 1h0m0s", "255.255.255.255"}
+	if got := aggregated(); !slices.Equal(got, want) {
+		t.Fatal("wrong aggregation:", got)
+	}
+
+	// deletion of one entry splits prefix
+	delete(entries, netip.MustParsePrefix("198.51.100.0/32"))
+	delete(entries, netip.MustParsePrefix("192.0.2.0/24"))
+	got := aggregated()
+	for _, s := range []string{"192.0.2.5 1h0m0s", "198.51.100.1 1h0m0s", "198.51.100.128/25 1h0m0s"} {
+		if !slices.Contains(got, s) {
+			t.Fatalf("missing %q in split aggregation: %v", s, got)
+		}
+	}
+	if slices.Contains(got, "198.51.100.0/24 1h0m0s") || len(got) != 21 {
+		t.Fatal("prefix is not split:", got)
+	}
+}
+
+func TestBhElementsDiff(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	kept, renewed := netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")
+	from := map[netip.Prefix]time.Time{
+		kept:                                     {},
+		renewed:                                  now.Add(time.Minute),
+		netip.MustParsePrefix("198.51.100.0/24"): {},
+	}
+	to := map[netip.Prefix]time.Time{
+		kept:                                     {},
+		renewed:                                  now.Add(time.Hour),
+		netip.MustParsePrefix("198.51.100.0/25"): {},
+	}
+	dels, adds := bhElementsDiff(from, to, now)
+	if len(dels["IPv4"]) != 1 || dels["IPv4"][0].String() != "198.51.100.0/24" || len(dels["IPv6"]) != 1 {
+		t.Fatal("wrong deletions:", dels)
+	}
+	if len(adds["IPv4"]) != 1 || adds["IPv4"][0].String() != "198.51.100.0/25" ||
+		len(adds["IPv6"]) != 1 || adds["IPv6"][0].Timeout != time.Hour {
+		t.Fatal("wrong additions:", adds)
+	}
+}
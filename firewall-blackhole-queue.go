@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"netip-network/collector"
+	"sync"
+	"time"
+)
+
+// blackhole-add/del are queued and coalesced by address over short window,
+// then applied by worker as one transaction, so bursts of attack do not block command loop,
+// result of command is sent by worker when its change is applied
+
+const (
+	bhBatchWindow = 100 * time.Millisecond
+	// bhBatchMax changes in queue applied without waiting for window
+	bhBatchMax = 4096
+)
+
+type bhQueue struct {
+	mu      sync.Mutex
+	pending map[string]bhQueued
+	kick    chan struct{}
+	// stats since last counter
+	batches, applied, coalesced, failed, killed int
+	latencySum, latencyMax                      time.Duration
+}
+
+// bhQueued last change of address and time of its first queueing
+type bhQueued struct {
+	change bhChange
+	at     time.Time
+	// cmds coalesced into change, all of them get its result
+	cmds []bhCommand
+}
+
+// bhCommand live command waiting for result of its queued change
+type bhCommand struct {
+	id, command string
+	start       time.Time
+}
+
+func newBhQueue() *bhQueue {
+	return &bhQueue{pending: map[string]bhQueued{}, kick: make(chan struct{}, 1)}
+}
+
+func (q *bhQueue) push(c bhChange, cmd bhCommand, now time.Time) {
+	q.mu.Lock()
+	ip := prefixString(c.prefix)
+	e := bhQueued{change: c, at: now, cmds: []bhCommand{cmd}}
+	if prev, ok := q.pending[ip]; ok {
+		e.at, e.cmds = prev.at, append(prev.cmds, cmd)
+		q.coalesced++
+	}
+	q.pending[ip] = e
+	q.mu.Unlock()
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (q *bhQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// take up to limit changes, changes of different addresses are independent
+func (q *bhQueue) take(limit int) map[string]bhQueued {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) <= limit {
+		pending := q.pending
+		q.pending = map[string]bhQueued{}
+		return pending
+	}
+	batch := make(map[string]bhQueued, limit)
+	for ip, e := range q.pending {
+		if len(batch) == limit {
+			break
+		}
+		batch[ip] = e
+		delete(q.pending, ip)
+	}
+	return batch
+}
+
+// done records applied batch with latency from queueing of each change
+func (q *bhQueue) done(batch map[string]bhQueued, failed int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.batches++
+	q.applied += len(batch) - failed
+	q.failed += failed
+	for _, e := range batch {
+		latency := now.Sub(e.at)
+		q.latencySum += latency
+		q.latencyMax = max(q.latencyMax, latency)
+	}
+}
+
+// kill records flows deleted from conntrack
+func (q *bhQueue) kill(n int) {
+	q.mu.Lock()
+	q.killed += n
+	q.mu.Unlock()
+}
+
+// stats of queue since last call
+func (q *bhQueue) stats(bhc *collector.BlackholeCounter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	bhc.Queue.Depth = len(q.pending)
+	bhc.Queue.Batches = q.batches
+	bhc.Queue.Applied = q.applied
+	bhc.Queue.Coalesced = q.coalesced
+	bhc.Queue.Failed = q.failed
+	if n := q.applied + q.failed; n > 0 {
+		bhc.Queue.LatencyAvgMs = int((q.latencySum / time.Duration(n)).Milliseconds())
+	}
+	bhc.Queue.LatencyMaxMs = int(q.latencyMax.Milliseconds())
+	bhc.KilledFlows = q.killed
+	q.batches, q.applied, q.coalesced, q.failed, q.killed = 0, 0, 0, 0, 0
+	q.latencySum, q.latencyMax = 0, 0
+}
+
+func (f *Firewall) bhQueueWorker() {
+	for range f.bhQueue.kick {
+		if f.bhQueue.depth() < bhBatchMax {
+			time.Sleep(bhBatchWindow)
+		}
+		f.bhMu.Lock()
+		added, results := f.bhFlush()
+		f.bhMu.Unlock()
+		f.bhReport(results)
+		f.bhKill(added)
+	}
+}
+
+// bhFlush applies queued changes by batches, must be called with bhMu held,
+// returns added prefixes for killing of their flows and results of queued commands
+func (f *Firewall) bhFlush() (added []netip.Prefix, results []*CommandResult) {
+	for {
+		batch := f.bhQueue.take(bhBatchMax)
+		if len(batch) == 0 {
+			return added, results
+		}
+		if !f.blackHole.Load() {
+			results = append(results, bhResults(batch, nil, errors.New("blackhole is not enabled"))...)
+			continue
+		}
+		changes := make([]bhChange, 0, len(batch))
+		for _, e := range batch {
+			changes = append(changes, e.change)
+		}
+		failed := map[netip.Prefix]error{}
+		f.bhCommitSplit(changes, failed)
+		if len(failed) < len(changes) {
+			f.bhSaveLater()
+		}
+		f.bhQueue.done(batch, len(failed), time.Now())
+		added = append(added, f.bhAdded(changes)...)
+		results = append(results, bhResults(batch, failed, nil)...)
+	}
+}
+
+// bhResults of commands queued in batch, err fails all of them
+func bhResults(batch map[string]bhQueued, failed map[netip.Prefix]error, err error) []*CommandResult {
+	var results []*CommandResult
+	for _, e := range batch {
+		var errs []string
+		act := "add"
+		if e.change.del {
+			act = "delete"
+		}
+		if ferr, ok := failed[e.change.prefix]; ok {
+			errs = []string{fmt.Sprintf("blackhole %s element %s: %s", act, prefixString(e.change.prefix), ferr)}
+		} else if err != nil {
+			errs = []string{fmt.Sprintf("blackhole %s element %s: %s", act, prefixString(e.change.prefix), err)}
+		}
+		for _, cmd := range e.cmds {
+			results = append(results, NewCommandResult(cmd.id, cmd.command, cmd.start, errs))
+		}
+	}
+	return results
+}
+
+// bhReport sends results of queued commands, must be called without bhMu held,
+// as consumer of events may wait for it
+func (f *Firewall) bhReport(results []*CommandResult) {
+	for _, cr := range results {
+		f.event(commandResultEvent(cr))
+	}
+}
+
+// bhAdded prefixes of applied additions
+func (f *Firewall) bhAdded(changes []bhChange) []netip.Prefix {
+	var added []netip.Prefix
+	for _, c := range changes {
+		if _, ok := f.blackHoleExists[c.prefix]; ok && !c.del {
+			added = append(added, c.prefix)
+		}
+	}
+	return added
+}
+
+// bhCommitSplit commits changes, rejected batch is halved down to bad elements,
+// which are collected into failed with their errors
+func (f *Firewall) bhCommitSplit(changes []bhChange, failed map[netip.Prefix]error) {
+	err := f.bhCommit(changes, time.Now())
+	if err == nil {
+		return
+	}
+	if len(changes) == 1 {
+		log.Printf("[blackhole] %s: %s", prefixString(changes[0].prefix), err)
+		failed[changes[0].prefix] = err
+		return
+	}
+	half := len(changes) / 2
+	f.bhCommitSplit(changes[:half], failed)
+	f.bhCommitSplit(changes[half:], failed)
+}
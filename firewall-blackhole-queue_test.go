@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"netip-network/collector"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBhQueue(t *testing.T) {
+	t.Parallel()
+
+	q := newBhQueue()
+	start := time.Now()
+	prefix := netip.MustParsePrefix("192.0.2.1/32")
+	q.push(bhChange{prefix: prefix, timeout: time.Minute}, bhCommand{id: "1"}, start)
+	q.push(bhChange{prefix: netip.MustParsePrefix("2001:db8::/32")}, bhCommand{id: "2"}, start.Add(time.Millisecond))
+	q.push(bhChange{prefix: prefix, del: true}, bhCommand{id: "3"}, start.Add(2*time.Millisecond))
+	if q.depth() != 2 {
+		t.Fatal("changes of address are not coalesced:", q.pending)
+	}
+
+	batch := q.take(bhBatchMax)
+	if e := batch["192.0.2.1"]; !e.change.del || !e.at.Equal(start) || len(e.cmds) != 2 {
+		t.Fatal("coalesced change is not last or lost first time:", e)
+	}
+	q.done(batch, 1, start.Add(50*time.Millisecond))
+
+	bhc := &collector.BlackholeCounter{}
+	q.stats(bhc)
+	if bhc.Queue.Depth != 0 || bhc.Queue.Batches != 1 || bhc.Queue.Applied != 1 || bhc.Queue.Failed != 1 ||
+		bhc.Queue.Coalesced != 1 || bhc.Queue.LatencyMaxMs != 50 || bhc.Queue.LatencyAvgMs != 49 {
+		t.Fatalf("wrong queue stats: %+v", bhc.Queue)
+	}
+	if q.stats(bhc); bhc.Queue.Batches != 0 || bhc.Queue.LatencyMaxMs != 0 {
+		t.Fatalf("queue stats are not reset: %+v", bhc.Queue)
+	}
+
+	for _, ip := range []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"} {
+		q.push(bhChange{prefix: netip.MustParsePrefix(ip)}, bhCommand{}, start)
+	}
+	if batch = q.take(2); len(batch) != 2 || q.depth() != 1 {
+		t.Fatal("batch is not limited:", batch)
+	}
+}
+
+// rejectNft fails transactions with element of bad prefix, other methods are not used
+type rejectNft struct {
+	Nft
+	bad netip.Prefix
+}
+
+type rejectTx struct {
+	NftTx
+	bad   netip.Prefix
+	found bool
+}
+
+func (n *rejectNft) Begin() NftTx {
+	return &rejectTx{bad: n.bad}
+}
+
+func (tx *rejectTx) AddElements(t nftTable, set string, elements []nftElement) {
+	tx.found = tx.found || slices.ContainsFunc(elements, func(e nftElement) bool {
+		return e.Prefix == tx.bad
+	})
+}
+
+func (tx *rejectTx) DelElements(t nftTable, set string, elements []nftElement) {}
+
+func (tx *rejectTx) Commit() error {
+	if tx.found {
+		return errors.New("invalid argument")
+	}
+	return nil
+}
+
+func TestBhFlushResults(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	f.nft = &rejectNft{bad: netip.MustParsePrefix("198.51.100.0/24")}
+	f.bhStatePath = filepath.Join(t.TempDir(), "blackhole.json")
+	f.blackHole.Store(true)
+	now := time.Now()
+	f.bhQueue.push(bhChange{prefix: netip.MustParsePrefix("192.0.2.1/32")}, bhCommand{id: "ok", command: "blackhole-add", start: now}, now)
+	f.bhQueue.push(bhChange{prefix: netip.MustParsePrefix("198.51.100.0/24")}, bhCommand{id: "bad", command: "blackhole-add", start: now}, now)
+
+	added, results := f.bhFlush()
+	if len(added) != 1 || added[0] != netip.MustParsePrefix("192.0.2.1/32") || len(results) != 2 {
+		t.Fatal("wrong flush:", added, results)
+	}
+	for _, cr := range results {
+		if failed := cr.Status == "failed"; failed != (cr.Id == "bad") || cr.Command != "blackhole-add" {
+			t.Fatalf("wrong result: %+v", cr)
+		}
+	}
+
+	f.blackHole.Store(false)
+	f.bhQueue.push(bhChange{prefix: netip.MustParsePrefix("192.0.2.2/32")}, bhCommand{id: "late"}, now)
+	if _, results = f.bhFlush(); len(results) != 1 || results[0].Status != "failed" {
+		t.Fatal("change of disabled blackhole is not failed:", results)
+	}
+}
+
+func TestBhDisabled(t *testing.T) {
+	t.Parallel()
+
+	// commands of disabled blackhole fail instead of reporting ok
+	f := NewFirewall()
+	steps := &stepErrors{}
+	if f.BlackHoleExec(steps, bhCommand{id: "add"}, "add", "192.0.2.1", 0) || len(steps.Errors()) != 1 {
+		t.Fatal("blackhole-add of disabled blackhole passed")
+	}
+	if f.BlackHoleCountries(steps, "DE"); len(steps.Errors()) != 1 {
+		t.Fatal("blackhole countries of disabled blackhole passed")
+	}
+	if f.BlackHoleSync(steps, &BlackholeSync{Full: true}); len(steps.Errors()) != 1 {
+		t.Fatal("blackhole-sync of disabled blackhole passed")
+	}
+	if f.BlackHoleFeedEnable(steps, &BlackholeFeed{Name: "spamhaus", Source: "/dev/null"}); len(steps.Errors()) != 1 {
+		t.Fatal("blackhole feed of disabled blackhole passed")
+	}
+}
+
+// tableNft has blackhole table, its deletion is recorded
+type tableNft struct {
+	rejectNft
+	mu      sync.Mutex
+	deleted bool
+}
+
+type tableTx struct {
+	rejectTx
+	n *tableNft
+}
+
+func (n *tableNft) Begin() NftTx {
+	return &tableTx{n: n}
+}
+
+func (n *tableNft) TableExists(t nftTable) bool {
+	return true
+}
+
+func (tx *tableTx) DelTable(t nftTable) {
+	tx.n.mu.Lock()
+	tx.n.deleted = true
+	tx.n.mu.Unlock()
+}
+
+func (tx *tableTx) AddElements(t nftTable, set string, elements []nftElement) {
+	tx.n.mu.Lock()
+	defer tx.n.mu.Unlock()
+	if tx.n.deleted {
+		panic("elements are added after table is destroyed")
+	}
+}
+
+func TestBhFlushDisable(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	n := &tableNft{}
+	f.nft = n
+	f.bhStatePath = ""
+	f.blackHole.Store(true)
+
+	// worker flushes batches while blackhole is disabled by command loop
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}), 32)
+			f.bhQueue.push(bhChange{prefix: prefix}, bhCommand{id: prefix.String()}, time.Now())
+			f.bhMu.Lock()
+			f.bhFlush()
+			f.bhMu.Unlock()
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	f.BlackHoleDisable(nil)
+	wg.Wait()
+
+	f.bhQueue.push(bhChange{prefix: netip.MustParsePrefix("198.51.100.1/32")}, bhCommand{id: "late"}, time.Now())
+	f.bhMu.Lock()
+	_, results := f.bhFlush()
+	f.bhMu.Unlock()
+	if len(results) != 1 || results[0].Status != "failed" || !n.deleted {
+		t.Fatal("change after disabling is applied:", results)
+	}
+}
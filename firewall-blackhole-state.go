@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sets hold only aggregation of entries, so entries as sent by control plane are kept in state file,
+// restart restores them when their aggregation is still the one in sets
+
+const (
+	bhExpiryTolerance = 2 * time.Second
+	// bhSaveDelay of state after applied batches and syncs, bursts of attack rewrite it once
+	bhSaveDelay = 5 * time.Second
+)
+
+type bhState struct {
+	Version int64          `json:"version"`
+	Entries []bhStateEntry `json:"entries"`
+}
+
+type bhStateEntry struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// bhStatePath FIREWALL_BLACKHOLE_STATE file of entries, empty disables it
+func bhStatePath() string {
+	env, ok := os.LookupEnv("FIREWALL_BLACKHOLE_STATE")
+	if !ok {
+		return "/var/lib/netip-network/blackhole.json"
+	}
+	return strings.TrimSpace(env)
+}
+
+// bhSave writes entries and version of sync, must be called with bhMu held
+func (f *Firewall) bhSave() {
+	if f.bhStatePath == "" {
+		return
+	}
+	f.bhSaveCancel()
+	state := bhState{Version: f.bhVersion, Entries: make([]bhStateEntry, 0, len(f.blackHoleExists))}
+	for p, expires := range f.blackHoleExists {
+		state.Entries = append(state.Entries, bhStateEntry{IP: p.String(), Expires: expires})
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(f.bhStatePath), 0o755)
+	}
+	// renaming keeps previous state whole on failure
+	if err == nil {
+		err = bhWriteSync(f.bhStatePath+".tmp", data)
+	}
+	if err == nil {
+		err = os.Rename(f.bhStatePath+".tmp", f.bhStatePath)
+	}
+	if err != nil {
+		log.Println("[blackhole] state save err:", err)
+	}
+}
+
+// bhWriteSync writes file and syncs it, so crash after rename can't leave it empty
+func bhWriteSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// bhSaveLater saves state after bhSaveDelay, changes meanwhile join the pending save,
+// must be called with bhMu held
+func (f *Firewall) bhSaveLater() {
+	if f.bhStatePath == "" || f.bhSaveTimer != nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(bhSaveDelay, func() {
+		f.bhMu.Lock()
+		defer f.bhMu.Unlock()
+		// canceled or replaced while waiting for lock
+		if f.bhSaveTimer == timer {
+			f.bhSave()
+		}
+	})
+	f.bhSaveTimer = timer
+}
+
+// bhSaveCancel pending save, must be called with bhMu held
+func (f *Firewall) bhSaveCancel() {
+	if f.bhSaveTimer != nil {
+		f.bhSaveTimer.Stop()
+		f.bhSaveTimer = nil
+	}
+}
+
+// BlackHoleSaveState writes pending save of state, before exit
+func (f *Firewall) BlackHoleSaveState() {
+	f.bhMu.Lock()
+	defer f.bhMu.Unlock()
+	if f.bhSaveTimer != nil {
+		f.bhSave()
+	}
+}
+
+// bhLoad entries of state without expired ones
+func bhLoad(path string, now time.Time) (map[netip.Prefix]time.Time, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var state bhState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, 0, err
+	}
+	entries := make(map[netip.Prefix]time.Time, len(state.Entries))
+	for _, e := range state.Entries {
+		prefix, err := netip.ParsePrefix(e.IP)
+		if err != nil {
+			return nil, 0, err
+		}
+		if e.Expires.IsZero() || now.Before(e.Expires) {
+			entries[prefix] = e.Expires
+		}
+	}
+	return entries, state.Version, nil
+}
+
+// bhStateMatches checks aggregation of state entries against elements of sets,
+// expiry of element is known by kernel only roughly
+func bhStateMatches(effective, elements map[netip.Prefix]time.Time) bool {
+	if len(effective) != len(elements) {
+		return false
+	}
+	for p, expires := range effective {
+		live, ok := elements[p]
+		if !ok || !bhSameExpiry(expires, live) {
+			return false
+		}
+	}
+	return true
+}
+
+// bhSameExpiry permanence and expiry within tolerance of seconds
+func bhSameExpiry(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return a.IsZero() == b.IsZero()
+	}
+	d := a.Sub(b)
+	return d <= bhExpiryTolerance && d >= -bhExpiryTolerance
+}
+
+// bhRestoreEntries entries of previous run from state, when sets are changed without agent,
+// entries are known only by their aggregation, must be called with bhMu held
+func (f *Firewall) bhRestoreEntries(live map[netip.Prefix]time.Time, now time.Time) {
+	f.bhEffective = live
+	f.blackHoleExists = maps.Clone(live)
+	if f.bhStatePath == "" {
+		return
+	}
+	entries, version, err := bhLoad(f.bhStatePath, now)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("[blackhole] state load err:", err)
+		}
+		return
+	}
+	effective := bhAggregate(entries)
+	if !bhStateMatches(effective, live) {
+		log.Println("[blackhole] state mismatches sets, entries are restored by their aggregation")
+		return
+	}
+	f.blackHoleExists, f.bhEffective, f.bhVersion = entries, effective, version
+}
+
+// bhRemoveState forgets entries of destroyed blackhole, must be called with bhMu held
+func (f *Firewall) bhRemoveState() {
+	if f.bhStatePath == "" {
+		return
+	}
+	f.bhSaveCancel()
+	if err := os.Remove(f.bhStatePath); err != nil && !os.IsNotExist(err) {
+		log.Println("[blackhole] state remove err:", err)
+	}
+}
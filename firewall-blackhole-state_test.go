@@ -0,0 +1,96 @@
+package main
+
+import (
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBhState(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	f := NewFirewall()
+	f.bhStatePath = filepath.Join(t.TempDir(), "blackhole.json")
+	f.bhVersion = 7
+	f.blackHoleExists = map[netip.Prefix]time.Time{
+		netip.MustParsePrefix("192.0.2.0/25"):    {},
+		netip.MustParsePrefix("192.0.2.128/25"):  {},
+		netip.MustParsePrefix("192.0.2.7/32"):    now.Add(time.Hour),
+		netip.MustParsePrefix("2001:db8::/32"):   now.Add(time.Minute),
+		netip.MustParsePrefix("198.51.100.1/32"): now.Add(-time.Second),
+	}
+	f.bhSave()
+
+	// sets of kernel hold aggregation with slightly other expiry
+	live := map[netip.Prefix]time.Time{
+		netip.MustParsePrefix("192.0.2.0/24"):  {},
+		netip.MustParsePrefix("2001:db8::/32"): now.Add(time.Minute - 300*time.Millisecond),
+	}
+	r := NewFirewall()
+	r.bhStatePath = f.bhStatePath
+	r.bhRestoreEntries(maps.Clone(live), now)
+	if len(r.blackHoleExists) != 4 || r.bhVersion != 7 || len(r.bhEffective) != 2 {
+		t.Fatal("entries are not restored from state:", r.blackHoleExists, r.bhVersion)
+	}
+	if _, ok := r.blackHoleExists[netip.MustParsePrefix("192.0.2.7/32")]; !ok {
+		t.Fatal("entry inside aggregation is lost:", r.blackHoleExists)
+	}
+
+	// sets changed without agent
+	live[netip.MustParsePrefix("203.0.113.0/24")] = time.Time{}
+	r = NewFirewall()
+	r.bhStatePath = f.bhStatePath
+	r.bhRestoreEntries(maps.Clone(live), now)
+	if len(r.blackHoleExists) != 3 || r.bhVersion != 0 {
+		t.Fatal("mismatching state is used:", r.blackHoleExists, r.bhVersion)
+	}
+
+	f.bhRemoveState()
+	r.bhRestoreEntries(map[netip.Prefix]time.Time{}, now)
+	if len(r.blackHoleExists) != 0 {
+		t.Fatal("removed state is used:", r.blackHoleExists)
+	}
+}
+
+func TestBhSaveLater(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	f.bhStatePath = filepath.Join(t.TempDir(), "blackhole.json")
+	f.blackHoleExists = map[netip.Prefix]time.Time{netip.MustParsePrefix("192.0.2.1/32"): {}}
+
+	f.bhMu.Lock()
+	f.bhSaveLater()
+	timer := f.bhSaveTimer
+	f.bhSaveLater()
+	if timer == nil || f.bhSaveTimer != timer {
+		t.Fatal("batches are not joined into one pending save")
+	}
+	f.bhMu.Unlock()
+	if _, err := os.Stat(f.bhStatePath); !os.IsNotExist(err) {
+		t.Fatal("state is saved without delay:", err)
+	}
+
+	f.BlackHoleSaveState()
+	entries, _, err := bhLoad(f.bhStatePath, time.Now())
+	if err != nil || len(entries) != 1 || f.bhSaveTimer != nil {
+		t.Fatal("pending save is not written:", entries, err)
+	}
+	if _, err = os.Stat(f.bhStatePath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file is left:", err)
+	}
+
+	// destroy cancels pending save, state is not written back
+	f.bhMu.Lock()
+	f.bhSaveLater()
+	f.bhRemoveState()
+	f.bhMu.Unlock()
+	f.BlackHoleSaveState()
+	if _, err = os.Stat(f.bhStatePath); !os.IsNotExist(err) || f.bhSaveTimer != nil {
+		t.Fatal("canceled save is written:", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+)
+
+// blackhole-sync brings entries to the list of control plane in one transaction:
+// full list replaces entries by diff, delta of version applies only on top of its base version,
+// mismatch of base is answered by error and control plane falls back to full list.
+// Full list older than applied version is rejected, so replay after reconnect does not roll
+// entries back, full list of version 0 starts versions over
+
+type BlackholeSync struct {
+	Version int64            `json:"version"`
+	Base    int64            `json:"base"` // version delta is made from, ignored for full list
+	Full    bool             `json:"full"`
+	Add     []BlackholeEntry `json:"add"` // desired entries of full list
+	Del     []string         `json:"del"`
+}
+
+type BlackholeEntry struct {
+	IP      string `json:"ip"`
+	Timeout int    `json:"timeout"` // seconds, 0 is permanent
+}
+
+type BlackholeSyncResult struct {
+	Version int64 `json:"version"`
+	Added   int   `json:"added"`
+	Deleted int   `json:"deleted"`
+
+	changes []bhChange
+}
+
+// BlackHoleSync applies list or delta, result has version of node for the next delta
+func (f *Firewall) BlackHoleSync(errs *stepErrors, sync *BlackholeSync) *BlackholeSyncResult {
+	if !f.blackHole.Load() {
+		errs.fail("blackhole is not enabled")
+		return nil
+	}
+	if sync == nil {
+		errs.fail("blackhole sync is empty")
+		return nil
+	}
+
+	f.bhMu.Lock()
+	// queued changes come before sync
+	added, results := f.bhFlush()
+	res := f.bhSync(errs, sync)
+	if res.Added > 0 {
+		added = append(added, f.bhAdded(res.changes)...)
+	}
+	f.bhMu.Unlock()
+	f.bhReport(results)
+	f.bhKill(added)
+	return res
+}
+
+// bhSync diff of sync committed, must be called with bhMu held
+func (f *Firewall) bhSync(errs *stepErrors, sync *BlackholeSync) *BlackholeSyncResult {
+	if !sync.Full && sync.Base != f.bhVersion {
+		errs.fail("blackhole sync base %d mismatches version %d, full sync is required", sync.Base, f.bhVersion)
+		return &BlackholeSyncResult{Version: f.bhVersion}
+	}
+	if sync.Full && sync.Version != 0 && sync.Version < f.bhVersion {
+		errs.fail("blackhole sync version %d is older than version %d", sync.Version, f.bhVersion)
+		return &BlackholeSyncResult{Version: f.bhVersion}
+	}
+
+	now := time.Now()
+	f.bhPrune(now)
+	changes, err := f.bhDiff(sync, now)
+	if err != nil {
+		errs.fail("blackhole sync: %s", err)
+		return &BlackholeSyncResult{Version: f.bhVersion}
+	}
+	if err = f.bhCommit(changes, now); err != nil {
+		log.Println("[blackhole] sync err:", err)
+		errs.fail("blackhole sync: %s", err)
+		return &BlackholeSyncResult{Version: f.bhVersion}
+	}
+
+	res := &BlackholeSyncResult{Version: sync.Version, changes: changes}
+	for _, c := range changes {
+		if c.del {
+			res.Deleted++
+		} else {
+			res.Added++
+		}
+	}
+	f.bhVersion = sync.Version
+	f.bhSaveLater()
+	if res.Added+res.Deleted > 0 {
+		log.Printf("[blackhole] synced version %d, added %d, deleted %d", sync.Version, res.Added, res.Deleted)
+	}
+	return res
+}
+
+// bhDiff changes of sync against known entries, must be called with bhMu held,
+// entry of full list is kept as is only when its expiry is the same, other expiry is re-added
+func (f *Firewall) bhDiff(sync *BlackholeSync, now time.Time) ([]bhChange, error) {
+	var changes []bhChange
+	desired := map[netip.Prefix]struct{}{}
+	for _, e := range sync.Add {
+		prefix, err := parsePrefix(e.IP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %q: %w", e.IP, err)
+		}
+		timeout := time.Duration(e.Timeout) * time.Second
+		if timeout < 0 || timeout > bhTimeoutMax {
+			return nil, fmt.Errorf("timeout %s of %s is out of range", timeout, e.IP)
+		}
+		if _, ok := desired[prefix]; ok {
+			continue
+		}
+		desired[prefix] = struct{}{}
+		var expires time.Time
+		if timeout > 0 {
+			expires = now.Add(timeout)
+		}
+		if known, ok := f.blackHoleExists[prefix]; sync.Full && ok && bhSameExpiry(known, expires) {
+			continue
+		}
+		changes = append(changes, bhChange{prefix: prefix, timeout: timeout})
+	}
+
+	if sync.Full {
+		for prefix := range f.blackHoleExists {
+			if _, ok := desired[prefix]; !ok {
+				changes = append(changes, bhChange{prefix: prefix, del: true})
+			}
+		}
+		return changes, nil
+	}
+	for _, ip := range sync.Del {
+		prefix, err := parsePrefix(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %q: %w", ip, err)
+		}
+		if _, ok := desired[prefix]; ok {
+			return nil, fmt.Errorf("%s is both added and deleted", ip)
+		}
+		if _, ok := f.blackHoleExists[prefix]; ok {
+			desired[prefix] = struct{}{}
+			changes = append(changes, bhChange{prefix: prefix, del: true})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBlackHoleDiff(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	f := NewFirewall()
+	f.blackHoleExists = map[netip.Prefix]time.Time{
+		netip.MustParsePrefix("192.0.2.1/32"):  {},
+		netip.MustParsePrefix("192.0.2.2/32"):  now.Add(time.Hour),
+		netip.MustParsePrefix("192.0.2.3/32"):  now.Add(time.Hour),
+		netip.MustParsePrefix("192.0.2.4/32"):  now.Add(time.Hour),
+		netip.MustParsePrefix("2001:db8::/32"): {},
+	}
+	changesOf := func(sync *BlackholeSync) []string {
+		t.Helper()
+		changes, err := f.bhDiff(sync, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []string
+		for _, c := range changes {
+			act := "add "
+			if c.del {
+				act = "del "
+			}
+			list = append(list, act+prefixString(c.prefix))
+		}
+		slices.Sort(list)
+		return list
+	}
+
+	// kept ones, timed one becomes permanent, renewed and shortened timeouts, new and missing ones
+	got := changesOf(&BlackholeSync{Full: true, Add: []BlackholeEntry{
+		{IP: "192.0.2.1"}, {IP: "192.0.2.2/32"}, {IP: "192.0.2.3", Timeout: 7200}, {IP: "192.0.2.4", Timeout: 60},
+		{IP: "198.51.100.0/24", Timeout: 60}, {IP: "192.0.2.1"},
+	}})
+	if want := []string{"add 192.0.2.2", "add 192.0.2.3", "add 192.0.2.4", "add 198.51.100.0/24", "del 2001:db8::/32"}; !slices.Equal(got, want) {
+		t.Fatal("wrong full diff:", got)
+	}
+	got = changesOf(&BlackholeSync{Full: true, Add: []BlackholeEntry{
+		{IP: "192.0.2.1"}, {IP: "192.0.2.2", Timeout: 3600}, {IP: "192.0.2.3", Timeout: 3601}, {IP: "192.0.2.4", Timeout: 3600}, {IP: "2001:db8::/32"},
+	}})
+	if len(got) != 0 {
+		t.Fatal("wrong full diff:", got)
+	}
+
+	// delta renews timeout of known entry and skips unknown deletion
+	got = changesOf(&BlackholeSync{Add: []BlackholeEntry{{IP: "192.0.2.2", Timeout: 60}}, Del: []string{"2001:db8::/32", "203.0.113.1"}})
+	if want := []string{"add 192.0.2.2", "del 2001:db8::/32"}; !slices.Equal(got, want) {
+		t.Fatal("wrong delta diff:", got)
+	}
+
+	for _, sync := range []*BlackholeSync{
+		{Full: true, Add: []BlackholeEntry{{IP: "bad"}}},
+		{Add: []BlackholeEntry{{IP: "192.0.2.9", Timeout: -1}}},
+		{Add: []BlackholeEntry{{IP: "192.0.2.9"}}, Del: []string{"192.0.2.9/32"}},
+	} {
+		if _, err := f.bhDiff(sync, now); err == nil {
+			t.Fatalf("invalid sync passed: %+v", sync)
+		}
+	}
+
+	f.blackHole.Store(true)
+	steps := &stepErrors{}
+	if f.BlackHoleSync(steps, &BlackholeSync{Version: 2, Base: 1}); steps.Errors() == nil {
+		t.Fatal("delta of other base passed")
+	}
+
+	// replayed full list does not roll entries back, version 0 starts versions over
+	r := NewFirewall()
+	r.blackHole.Store(true)
+	r.bhStatePath = filepath.Join(t.TempDir(), "blackhole.json")
+	r.bhVersion = 5
+	if sr := r.BlackHoleSync(steps, &BlackholeSync{Version: 4, Full: true}); steps.Errors() == nil || sr.Version != 5 {
+		t.Fatal("older full list passed")
+	}
+	if sr := r.BlackHoleSync(steps, &BlackholeSync{Version: 0, Full: true}); steps.Errors() != nil || sr.Version != 0 {
+		t.Fatal("full list of version 0 is not applied")
+	}
+	if sr := r.BlackHoleSync(steps, &BlackholeSync{Version: 1, Base: 0}); steps.Errors() != nil || sr.Version != 1 {
+		t.Fatal("delta after reset is not applied")
+	}
+	// state of syncs is saved later as of batches
+	if _, version, err := bhLoad(r.bhStatePath, now); !os.IsNotExist(err) {
+		t.Fatal("state is saved by every sync:", version, err)
+	}
+	r.BlackHoleSaveState()
+	if _, version, err := bhLoad(r.bhStatePath, now); err != nil || version != 1 {
+		t.Fatal("pending state is not saved:", version, err)
+	}
+}
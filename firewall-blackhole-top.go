@@ -0,0 +1,93 @@
+package main
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// elements of blackhole sets have own counters, periodic report shows top offenders
+// by packets dropped in period and entries without any hit since they were added
+
+const (
+	bhTopInterval = 5 * time.Minute
+	bhTopN        = 20
+	// bhZeroMax zero hit entries listed in report, all are counted
+	bhZeroMax = 1000
+)
+
+type BlackholeTop struct {
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Entries  int             `json:"entries"`
+	Top      []BlackholeHits `json:"top"`
+	ZeroHits int             `json:"zeroHits"`
+	Zero     []string        `json:"zero"`
+}
+
+type BlackholeHits struct {
+	Prefix  string `json:"prefix"`
+	Packets uint64 `json:"packets"` // dropped in period
+	Bytes   uint64 `json:"bytes"`
+	Total   uint64 `json:"total"` // dropped since entry was added
+}
+
+// bhTopOf report of elements against counters of previous report, entry new to report
+// or with counter lower than previous one (re-added) counts since it was added
+func bhTopOf(elements []nftElement, prev map[netip.Prefix]nftElement) (*BlackholeTop, map[netip.Prefix]nftElement) {
+	bt := &BlackholeTop{Entries: len(elements), Top: []BlackholeHits{}, Zero: []string{}}
+	next := make(map[netip.Prefix]nftElement, len(elements))
+	for _, e := range elements {
+		next[e.Prefix] = e
+		if e.Packets == 0 {
+			bt.ZeroHits++
+			bt.Zero = append(bt.Zero, prefixString(e.Prefix))
+			continue
+		}
+		hits := BlackholeHits{Prefix: prefixString(e.Prefix), Packets: e.Packets, Bytes: e.Bytes, Total: e.Packets}
+		if p, ok := prev[e.Prefix]; ok && p.Packets <= e.Packets && p.Bytes <= e.Bytes {
+			hits.Packets -= p.Packets
+			hits.Bytes -= p.Bytes
+		}
+		if hits.Packets > 0 {
+			bt.Top = append(bt.Top, hits)
+		}
+	}
+
+	slices.SortFunc(bt.Top, func(a, b BlackholeHits) int {
+		if c := cmp.Compare(b.Packets, a.Packets); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Prefix, b.Prefix)
+	})
+	bt.Top = bt.Top[:min(len(bt.Top), bhTopN)]
+	slices.Sort(bt.Zero)
+	bt.Zero = bt.Zero[:min(len(bt.Zero), bhZeroMax)]
+	return bt, next
+}
+
+// bhTopReport sends report of blackhole sets, returns counters for next one
+func (f *Firewall) bhTopReport(prev map[netip.Prefix]nftElement, from, now time.Time) map[netip.Prefix]nftElement {
+	var elements []nftElement
+	for _, set := range []string{"IPv4", "IPv6"} {
+		list, err := f.nft.Elements(f.tableBH, set)
+		if err != nil {
+			return prev
+		}
+		elements = append(elements, list...)
+	}
+	bt, next := bhTopOf(elements, prev)
+	if bt.Entries == 0 {
+		return next
+	}
+	bt.From, bt.To = from.UTC(), now.UTC()
+	f.event(&struct {
+		Event        string        `json:"event"`
+		BlackholeTop *BlackholeTop `json:"blackholeTop"`
+	}{
+		Event:        "blackhole-top",
+		BlackholeTop: bt,
+	})
+	return next
+}
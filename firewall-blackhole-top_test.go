@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBhTopOf(t *testing.T) {
+	t.Parallel()
+
+	attacker := netip.MustParsePrefix("203.0.113.0/24")
+	readded := netip.MustParsePrefix("2001:db8::/32")
+	elements := []nftElement{
+		{Prefix: attacker, Packets: 900, Bytes: 54000},
+		{Prefix: readded, Packets: 5, Bytes: 300},
+		{Prefix: netip.MustParsePrefix("192.0.2.9/32"), Packets: 40, Bytes: 2400},
+		{Prefix: netip.MustParsePrefix("192.0.2.1/32")},
+		{Prefix: netip.MustParsePrefix("198.51.100.7/32"), Packets: 7, Bytes: 420},
+	}
+	prev := map[netip.Prefix]nftElement{
+		attacker:                                 {Prefix: attacker, Packets: 100, Bytes: 6000},
+		readded:                                  {Prefix: readded, Packets: 50, Bytes: 3000},
+		netip.MustParsePrefix("198.51.100.7/32"): {Packets: 7, Bytes: 420},
+	}
+
+	bt, next := bhTopOf(elements, prev)
+	if bt.Entries != 5 || bt.ZeroHits != 1 || len(bt.Zero) != 1 || bt.Zero[0] != "192.0.2.1" {
+		t.Fatalf("wrong zero hits: %+v", bt)
+	}
+	if len(bt.Top) != 3 || bt.Top[0] != (BlackholeHits{Prefix: "203.0.113.0/24", Packets: 800, Bytes: 48000, Total: 900}) ||
+		bt.Top[1].Prefix != "192.0.2.9" || bt.Top[1].Packets != 40 || bt.Top[2].Packets != 5 {
+		t.Fatalf("wrong top: %+v", bt.Top)
+	}
+	if len(next) != 5 || next[attacker].Packets != 900 {
+		t.Fatal("wrong counters for next report:", next)
+	}
+}
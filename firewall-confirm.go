@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type FirewallRollback struct {
+	Reason     string    `json:"reason"`
+	AppliedAt  time.Time `json:"appliedAt"`
+	RolledBack time.Time `json:"rolledBack"`
+	Error      string    `json:"error"`
+}
+
+// confirmPending previous ruleset waiting for confirmation of applied changes
+type confirmPending struct {
+	snapshot     []NftSnapshot
+	desired      []FirewallRules
+	schedule     []ruleWindow
+	trusted      []string
+	egressPolicy string
+	appliedAt    time.Time
+	timer        *time.Timer
+}
+
+// snapshot saves current netip ruleset: own table and chains in ip/ip6 nat
+func (f *Firewall) snapshot() ([]NftSnapshot, error) {
+	table, err := f.nft.Snapshot(f.tableInet)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := []NftSnapshot{table}
+
+	for _, t := range f.tablesNat {
+		if !f.nft.ChainExists(t, "PREROUTING") {
+			continue
+		}
+		// nat chains can't be removed while jumps exist, flush is enough
+		chains, err := f.nft.Snapshot(t, f.table, f.chainOutput)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, chains)
+	}
+	return snapshot, nil
+}
+
+// confirmWait keeps the last confirmed ruleset and schedules rollback to it
+func (f *Firewall) confirmWait(prev *confirmPending, window time.Duration) {
+	f.confirmMu.Lock()
+	defer f.confirmMu.Unlock()
+
+	if f.confirm != nil {
+		// keep snapshot of the last confirmed ruleset
+		f.confirm.timer.Reset(window)
+		log.Println("[firewall] waiting confirm again, window:", window)
+		return
+	}
+
+	prev.appliedAt = time.Now().UTC()
+	f.confirm = prev
+	f.confirm.timer = time.AfterFunc(window, func() {
+		f.rollback("changes not confirmed in time")
+	})
+	log.Println("[firewall] waiting confirm, window:", window)
+}
+
+// Confirm accepts applied ruleset by confirm command, nothing to confirm is an error
+func (f *Firewall) Confirm(errs *stepErrors) {
+	if !f.confirmStop() {
+		errs.fail("no firewall changes are waiting for confirm")
+		return
+	}
+	log.Println("[firewall] changes confirmed")
+}
+
+// ConfirmHandshake accepts applied ruleset on re-handshake, which mostly has nothing to confirm
+func (f *Firewall) ConfirmHandshake() {
+	if f.confirmStop() {
+		log.Println("[firewall] changes confirmed by handshake")
+	}
+}
+
+func (f *Firewall) confirmPending() bool {
+	f.confirmMu.Lock()
+	defer f.confirmMu.Unlock()
+	return f.confirm != nil
+}
+
+func (f *Firewall) confirmStop() bool {
+	f.confirmMu.Lock()
+	defer f.confirmMu.Unlock()
+	if f.confirm == nil {
+		return false
+	}
+	f.confirm.timer.Stop()
+	f.confirm = nil
+	return true
+}
+
+func (f *Firewall) rollback(reason string) {
+	f.confirmMu.Lock()
+	cp := f.confirm
+	f.confirm = nil
+	f.confirmMu.Unlock()
+	if cp == nil {
+		return
+	}
+
+	log.Println("[firewall] rollback, reason:", reason)
+	fr := &FirewallRollback{
+		Reason:    reason,
+		AppliedAt: cp.appliedAt,
+	}
+	f.applyMu.Lock()
+	tx := f.nft.Begin()
+	for _, s := range cp.snapshot {
+		tx.Restore(s)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("[firewall] rollback err:", err)
+		fr.Error = err.Error()
+	}
+	f.desired = cp.desired
+	f.scheduleState = cp.schedule
+	f.trusted, f.egressPolicy = cp.trusted, cp.egressPolicy
+	f.baseline = f.observe()
+	// restored country sets are of unknown version
+	for _, t := range append([]nftTable{f.tableInet}, f.tablesNat...) {
+		delete(f.geoApplied, t)
+	}
+	f.applyMu.Unlock()
+	fr.RolledBack = time.Now().UTC()
+
+	f.event(&struct {
+		Event            string            `json:"event"`
+		FirewallRollback *FirewallRollback `json:"firewallRollback"`
+	}{
+		Event:            "firewall-rollback",
+		FirewallRollback: fr,
+	})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// flows of blackholed addresses stay in conntrack and established ones keep being accepted,
+// so conntrack entries with address on either side of original direction are deleted by ctnetlink
+
+const (
+	// ctnetlink, not in x/sys
+	ctMsgGet      = 1
+	ctMsgDelete   = 2
+	ctaTupleOrig  = 1
+	ctaZone       = 18
+	ctaTupleIP    = 1
+	ctaIPv4Src    = 1
+	ctaIPv4Dst    = 2
+	ctaIPv6Src    = 3
+	ctaIPv6Dst    = 4
+	ctSubsysShift = 8
+	// ctDumpBuffer one read of dump, kernel sends up to 32k per message batch
+	ctDumpBuffer = 64 << 10
+	// ctFlowsMax deleted flows per dump
+	ctFlowsMax = 1 << 20
+	// ctKillInterval between dumps of conntrack
+	ctKillInterval = time.Second
+)
+
+var errCtFlowsMax = errors.New("too many flows to kill")
+
+// ctFlow conntrack entry, original tuple and zone are sent back as they are to delete it
+type ctFlow struct {
+	tuple    []byte
+	zone     []byte
+	src, dst netip.Addr
+}
+
+// ctParse flow of conntrack message
+func ctParse(data []byte) (ctFlow, error) {
+	var flow ctFlow
+	if len(data) < 4 {
+		return flow, errors.New("short conntrack message")
+	}
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return flow, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig:
+			flow.tuple = ad.Bytes()
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ctaTupleIP {
+						nad.Nested(func(ipd *netlink.AttributeDecoder) error {
+							for ipd.Next() {
+								a, _ := netip.AddrFromSlice(ipd.Bytes())
+								switch ipd.Type() {
+								case ctaIPv4Src, ctaIPv6Src:
+									flow.src = a
+								case ctaIPv4Dst, ctaIPv6Dst:
+									flow.dst = a
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		case ctaZone:
+			flow.zone = ad.Bytes()
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return flow, err
+	}
+	if flow.tuple == nil || !flow.src.IsValid() || !flow.dst.IsValid() {
+		return flow, errors.New("conntrack message without original tuple")
+	}
+	return flow, nil
+}
+
+// ctMatcher checks address by prefixes aggregated into sorted disjoint ones
+func ctMatcher(prefixes []netip.Prefix) func(netip.Addr) bool {
+	entries := make(map[netip.Prefix]time.Time, len(prefixes))
+	for _, p := range prefixes {
+		entries[p] = time.Time{}
+	}
+	var list []netip.Prefix
+	for p := range bhAggregate(entries) {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b netip.Prefix) int {
+		return a.Addr().Compare(b.Addr())
+	})
+	return func(a netip.Addr) bool {
+		i, found := slices.BinarySearchFunc(list, a, func(p netip.Prefix, a netip.Addr) int {
+			return p.Addr().Compare(a)
+		})
+		if found {
+			return true
+		}
+		return i > 0 && list[i-1].Contains(a)
+	}
+}
+
+// ctDump streams conntrack entries of family to fn, which stops dump by error,
+// only one buffer of messages is in memory while table can have millions of entries
+func ctDump(family byte, fn func(ctFlow) error) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	kernel := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	req := make([]byte, unix.NLMSG_HDRLEN+4)
+	binary.NativeEndian.PutUint32(req[0:], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:], unix.NFNL_SUBSYS_CTNETLINK<<ctSubsysShift|ctMsgGet)
+	binary.NativeEndian.PutUint16(req[6:], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(req[8:], 1)
+	copy(req[unix.NLMSG_HDRLEN:], []byte{family, unix.NFNETLINK_V0, 0, 0})
+	if err = unix.Sendto(fd, req, 0, kernel); err != nil {
+		return err
+	}
+
+	buf := make([]byte, ctDumpBuffer)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+						return unix.Errno(errno)
+					}
+				}
+				return nil
+			}
+			flow, err := ctParse(m.Data)
+			if err != nil {
+				continue
+			}
+			if err = fn(flow); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ctKill deletes conntrack entries of prefixes while dumping, returns number of deleted flows
+func ctKill(prefixes []netip.Prefix) (int, error) {
+	if len(prefixes) == 0 {
+		return 0, nil
+	}
+	// deletions go by own socket, dump one is busy
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	match := ctMatcher(prefixes)
+	killed := 0
+	for _, family := range []byte{unix.AF_INET, unix.AF_INET6} {
+		if !slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Addr().Is4() == (family == unix.AF_INET) }) {
+			continue
+		}
+		err := ctDump(family, func(flow ctFlow) error {
+			if !match(flow.src) && !match(flow.dst) {
+				return nil
+			}
+			if err := ctDelete(conn, family, flow); err != nil {
+				return err
+			}
+			if killed++; killed >= ctFlowsMax {
+				return errCtFlowsMax
+			}
+			return nil
+		})
+		if errors.Is(err, errCtFlowsMax) {
+			log.Println("[blackhole] conntrack kill stopped at flows:", killed)
+			return killed, nil
+		}
+		if err != nil {
+			return killed, err
+		}
+	}
+	return killed, nil
+}
+
+// ctDelete deletes flow by its original tuple, flow gone by itself meanwhile is not an error
+func ctDelete(conn *netlink.Conn, family byte, flow ctFlow) error {
+	attrs := []netlink.Attribute{{Type: netlink.Nested | ctaTupleOrig, Data: flow.tuple}}
+	if flow.zone != nil {
+		attrs = append(attrs, netlink.Attribute{Type: ctaZone, Data: flow.zone})
+	}
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<ctSubsysShift | ctMsgDelete),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+	})
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+// ctKiller collects added prefixes between dumps, dumps are rate limited,
+// so prefixes of many batches during attack are killed by one dump
+type ctKiller struct {
+	mu      sync.Mutex
+	pending []netip.Prefix
+	kick    chan struct{}
+	once    sync.Once
+}
+
+func newCtKiller() *ctKiller {
+	return &ctKiller{kick: make(chan struct{}, 1)}
+}
+
+func (k *ctKiller) push(prefixes []netip.Prefix) {
+	k.mu.Lock()
+	k.pending = append(k.pending, prefixes...)
+	k.mu.Unlock()
+	select {
+	case k.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (k *ctKiller) take() []netip.Prefix {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pending := k.pending
+	k.pending = nil
+	return pending
+}
+
+// bhKill queues added prefixes for deletion of their flows, number of them is reported by counter
+func (f *Firewall) bhKill(prefixes []netip.Prefix) {
+	if len(prefixes) == 0 {
+		return
+	}
+	f.ctKiller.once.Do(func() {
+		go f.ctKillWorker()
+	})
+	f.ctKiller.push(prefixes)
+}
+
+func (f *Firewall) ctKillWorker() {
+	for range f.ctKiller.kick {
+		killed, err := ctKill(f.ctKiller.take())
+		if err != nil {
+			log.Println("[blackhole] conntrack kill err:", err)
+		}
+		if killed > 0 {
+			logger.Debug("[blackhole] conntrack killed flows:", killed)
+		}
+		f.bhQueue.kill(killed)
+		time.Sleep(ctKillInterval)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"net/netip"
+	"testing"
+)
+
+func TestCtParse(t *testing.T) {
+	t.Parallel()
+
+	ip, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: ctaIPv4Src, Data: []byte{192, 0, 2, 1}},
+		{Type: ctaIPv4Dst, Data: []byte{198, 51, 100, 7}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: netlink.Nested | ctaTupleIP, Data: ip}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: netlink.Nested | ctaTupleOrig, Data: tuple},
+		{Type: ctaZone, Data: []byte{0, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow, err := ctParse(append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.src != netip.MustParseAddr("192.0.2.1") || flow.dst != netip.MustParseAddr("198.51.100.7") || len(flow.zone) != 2 {
+		t.Fatalf("wrong flow: %+v", flow)
+	}
+	if _, err = ctParse([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}); err == nil {
+		t.Fatal("message without tuple passed")
+	}
+}
+
+func TestCtMatcher(t *testing.T) {
+	t.Parallel()
+
+	match := ctMatcher([]netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/25"),
+		netip.MustParsePrefix("192.0.2.128/25"),
+		netip.MustParsePrefix("203.0.113.7/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+	for addr, want := range map[string]bool{
+		"192.0.2.0":     true,
+		"192.0.2.200":   true,
+		"192.0.3.0":     false,
+		"203.0.113.7":   true,
+		"203.0.113.8":   false,
+		"10.0.0.1":      false,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+		"255.255.255.0": false,
+	} {
+		if got := match(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("match of %s is %v", addr, got)
+		}
+	}
+}
+
+func TestCtKiller(t *testing.T) {
+	t.Parallel()
+
+	k := newCtKiller()
+	k.push([]netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")})
+	k.push([]netip.Prefix{netip.MustParsePrefix("2001:db8::/32")})
+	if len(k.kick) != 1 {
+		t.Fatal("pushes between dumps are not coalesced into one kick")
+	}
+	if pending := k.take(); len(pending) != 2 || len(k.take()) != 0 {
+		t.Fatal("wrong pending prefixes:", pending)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FirewallCounter counters of rules with the same id: input, egress and nat chains
+type FirewallCounter struct {
+	Id      string `json:"id"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	Limited uint64 `json:"limited"`
+}
+
+// countersInterval FIREWALL_COUNTERS seconds, 0 disables reporting
+func countersInterval() time.Duration {
+	env, ok := os.LookupEnv("FIREWALL_COUNTERS")
+	if !ok {
+		return time.Minute
+	}
+	sec, err := strconv.Atoi(env)
+	if err != nil || sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// countersStart runs reporting once, after the first applied ruleset
+func (f *Firewall) countersStart() {
+	if f.countersInterval <= 0 {
+		return
+	}
+	f.countersOnce.Do(func() {
+		go f.countersCollect()
+	})
+}
+
+func (f *Firewall) countersCollect() {
+	ticker := time.NewTicker(f.countersInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		counters := f.counters()
+		if len(counters) == 0 {
+			continue
+		}
+		f.event(&struct {
+			Event            string             `json:"event"`
+			FirewallCounters []*FirewallCounter `json:"firewallCounters"`
+		}{
+			Event:            "firewall-counters",
+			FirewallCounters: counters,
+		})
+	}
+}
+
+// counters reads counters of rules with id from input, egress and nat chains
+func (f *Firewall) counters() []*FirewallCounter {
+	type chain struct {
+		table nftTable
+		name  string
+	}
+	chains := []chain{{f.tableInet, "input"}, {f.tableInet, "egress"}}
+	for _, t := range f.tablesNat {
+		chains = append(chains, chain{t, f.table})
+	}
+
+	byId := map[string]*FirewallCounter{}
+	for _, c := range chains {
+		rules, err := f.nft.Rules(c.table, c.name)
+		if err != nil {
+			continue
+		}
+		for _, r := range rules {
+			if r.Comment == "" {
+				continue
+			}
+			id, limited := strings.CutSuffix(r.Comment, limitCommentSuffix)
+			fc, ok := byId[id]
+			if !ok {
+				fc = &FirewallCounter{Id: id}
+				byId[id] = fc
+			}
+			if limited {
+				fc.Limited += r.Packets
+				continue
+			}
+			fc.Packets += r.Packets
+			fc.Bytes += r.Bytes
+		}
+	}
+
+	counters := make([]*FirewallCounter, 0, len(byId))
+	for _, fc := range byId {
+		counters = append(counters, fc)
+	}
+	slices.SortFunc(counters, func(a, b *FirewallCounter) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	logger.Debugf("[firewall] counters of rules: %d", len(counters))
+	return counters
+}
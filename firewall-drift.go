@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type FirewallDrift struct {
+	Changes   []string  `json:"changes"`
+	Reapplied bool      `json:"reapplied"`
+	Error     string    `json:"error"`
+	At        time.Time `json:"at"`
+}
+
+// driftInterval FIREWALL_DRIFT seconds, 0 disables reconciling
+func driftInterval() time.Duration {
+	env, ok := os.LookupEnv("FIREWALL_DRIFT")
+	if !ok {
+		return 30 * time.Second
+	}
+	sec, err := strconv.Atoi(env)
+	if err != nil || sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// driftStart runs reconciling once, after the first applied ruleset
+func (f *Firewall) driftStart() {
+	if f.driftInterval <= 0 {
+		return
+	}
+	f.driftOnce.Do(func() {
+		go f.driftWatch()
+	})
+}
+
+func (f *Firewall) driftWatch() {
+	ticker := time.NewTicker(f.driftInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if fd := f.reconcile(); fd != nil {
+			f.event(&struct {
+				Event         string         `json:"event"`
+				FirewallDrift *FirewallDrift `json:"firewallDrift"`
+			}{
+				Event:         "firewall-drift",
+				FirewallDrift: fd,
+			})
+		}
+	}
+}
+
+// reconcile compares live ruleset with the one observed after apply,
+// on drift applies the desired rules again
+func (f *Firewall) reconcile() *FirewallDrift {
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+
+	// disabled or not applied yet, and pending confirm has its own rollback
+	if f.baseline == nil || f.confirmPending() {
+		return nil
+	}
+
+	changes := driftChanges(f.baseline, f.observe())
+	if len(changes) == 0 {
+		return nil
+	}
+	log.Println("[firewall] drift detected, re-applying, changes:", changes)
+
+	fd := &FirewallDrift{Changes: changes, At: time.Now().UTC()}
+	if err := f.apply(f.desired, f.trusted, f.egressPolicy, 0); err != nil {
+		fd.Error = err.Error()
+		return fd
+	}
+	fd.Reapplied = true
+	return fd
+}
+
+// observe shape of netip ruleset: existence of chains, rules quantity and jumps
+func (f *Firewall) observe() map[string]int {
+	state := map[string]int{}
+	count := func(t nftTable, chain string) {
+		if !f.nft.ChainExists(t, chain) {
+			state[fmt.Sprintf("chain %s %s", t, chain)] = 0
+			return
+		}
+		rules, _ := f.nft.Rules(t, chain)
+		state[fmt.Sprintf("chain %s %s", t, chain)] = 1
+		state[fmt.Sprintf("rules %s %s", t, chain)] = len(rules)
+	}
+
+	count(f.tableInet, "input")
+	count(f.tableInet, "output")
+	count(f.tableInet, "forward")
+	count(f.tableInet, "egress")
+	for _, t := range f.tablesNat {
+		if !f.nft.ChainExists(t, "PREROUTING") {
+			state[fmt.Sprintf("chain %s PREROUTING", t)] = 0
+			continue
+		}
+		state[fmt.Sprintf("chain %s PREROUTING", t)] = 1
+		state[fmt.Sprintf("jump %s PREROUTING %s", t, f.table)] = len(f.jumps(t, "PREROUTING", f.table))
+		state[fmt.Sprintf("jump %s OUTPUT %s", t, f.chainOutput)] = len(f.jumps(t, "OUTPUT", f.chainOutput))
+		count(t, f.table)
+		count(t, f.chainOutput)
+	}
+	return state
+}
+
+// driftChanges describes differences of observed states
+func driftChanges(expected, live map[string]int) []string {
+	var changes []string
+	for k, v := range expected {
+		if live[k] != v {
+			changes = append(changes, fmt.Sprintf("%s: %d, expected %d", k, live[k], v))
+		}
+	}
+	for k, v := range live {
+		if _, ok := expected[k]; !ok && v != 0 {
+			changes = append(changes, fmt.Sprintf("%s: %d, expected 0", k, v))
+		}
+	}
+	slices.Sort(changes)
+	return changes
+}
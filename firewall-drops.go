@@ -0,0 +1,349 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dropped packets of input policy and nat drop are sampled by nflog (FIREWALL_DROPLOG group),
+// kernel limits the rate of samples, agent aggregates them into bounded maps
+// and reports top talkers once per minute
+
+const (
+	dropInterval = time.Minute
+	dropSnaplen  = 64
+	dropKeysMax  = 4096
+	dropTop      = 10
+	dropRateMax  = 10_000
+	// dropReadBuffer receive buffer of nflog socket, samples over it are lost
+	dropReadBuffer = 256 << 10
+
+	// nfnetlink_log, not in x/sys
+	nfulnlMsgPacket      = 0
+	nfulnlMsgConfig      = 1
+	nfulaPayload         = 9
+	nfulaPrefix          = 10
+	nfulaCfgCmd          = 1
+	nfulaCfgMode         = 2
+	nfulnlCfgCmdBind     = 1
+	nfulnlCopyPacket     = 2
+	nfulnlSubsysMsgShift = 8
+)
+
+type FirewallDrops struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Rate    int       `json:"rate"`    // samples per second of each drop rule
+	Packets uint64    `json:"packets"` // sampled packets
+	// Overflow samples over memory cap, only in totals of packets and chains
+	Overflow  uint64     `json:"overflow"`
+	Overruns  uint64     `json:"overruns"` // overruns of socket buffer, each loses unknown number of samples
+	Sources   []DropsTop `json:"sources"`
+	Ports     []DropsTop `json:"ports"`
+	Protocols []DropsTop `json:"protocols"`
+	Chains    []DropsTop `json:"chains"`
+}
+
+type DropsTop struct {
+	Key     string `json:"key"`
+	Packets uint64 `json:"packets"`
+}
+
+// dropSample parsed packet of nflog
+type dropSample struct {
+	chain  string
+	source netip.Addr
+	proto  string
+	port   uint16
+}
+
+// dropStats aggregation of samples, number of keys is limited by dropKeysMax
+type dropStats struct {
+	mu        sync.Mutex
+	from      time.Time
+	packets   uint64
+	overflow  uint64
+	overruns  uint64
+	sources   map[netip.Addr]uint64
+	ports     map[string]uint64
+	protocols map[string]uint64
+	chains    map[string]uint64
+}
+
+func newDropStats(now time.Time) *dropStats {
+	s := &dropStats{}
+	s.reset(now)
+	return s
+}
+
+func (s *dropStats) reset(now time.Time) {
+	s.from = now
+	s.packets, s.overflow, s.overruns = 0, 0, 0
+	s.sources = map[netip.Addr]uint64{}
+	s.ports = map[string]uint64{}
+	s.protocols = map[string]uint64{}
+	s.chains = map[string]uint64{}
+}
+
+// dropLog FIREWALL_DROPLOG nflog group and FIREWALL_DROPLOG_RATE samples per second, group 0 disables
+func dropLog() (uint16, int) {
+	group, err := strconv.Atoi(os.Getenv("FIREWALL_DROPLOG"))
+	if err != nil || group <= 0 || group > 65535 {
+		return 0, 0
+	}
+	rate, err := strconv.Atoi(os.Getenv("FIREWALL_DROPLOG_RATE"))
+	if err != nil || rate <= 0 {
+		rate = 50
+	}
+	return uint16(group), min(rate, dropRateMax)
+}
+
+// dropRule sampling rule before drop of chain
+func (f *Firewall) dropRule(chain string) nftRule {
+	return ruleOf(stmtLimit{Rate: f.dropRate}, stmtLog{Group: f.dropGroup, Prefix: chain, Snaplen: dropSnaplen})
+}
+
+func (s *dropStats) add(sample dropSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets++
+	countCapped(s.chains, sample.chain, &s.overflow)
+	if !countCapped(s.sources, sample.source, &s.overflow) {
+		return
+	}
+	countCapped(s.protocols, sample.proto, &s.overflow)
+	if sample.port > 0 {
+		countCapped(s.ports, sample.proto+"/"+strconv.Itoa(int(sample.port)), &s.overflow)
+	}
+}
+
+// countCapped counts key while map is under the cap, new keys over it are overflow
+func countCapped[K comparable](m map[K]uint64, key K, overflow *uint64) bool {
+	if _, ok := m[key]; !ok && len(m) >= dropKeysMax {
+		*overflow++
+		return false
+	}
+	m[key]++
+	return true
+}
+
+func (s *dropStats) overrun() {
+	s.mu.Lock()
+	s.overruns++
+	s.mu.Unlock()
+}
+
+// report top talkers since last report and starts new period
+func (s *dropStats) report(now time.Time) *FirewallDrops {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fd := &FirewallDrops{
+		From:      s.from.UTC(),
+		To:        now.UTC(),
+		Packets:   s.packets,
+		Overflow:  s.overflow,
+		Overruns:  s.overruns,
+		Ports:     dropTopOf(s.ports, func(k string) string { return k }),
+		Protocols: dropTopOf(s.protocols, func(k string) string { return k }),
+		Chains:    dropTopOf(s.chains, func(k string) string { return k }),
+		Sources:   dropTopOf(s.sources, netip.Addr.String),
+	}
+	s.reset(now)
+	return fd
+}
+
+func dropTopOf[K comparable](m map[K]uint64, key func(K) string) []DropsTop {
+	top := make([]DropsTop, 0, len(m))
+	for k, v := range m {
+		top = append(top, DropsTop{Key: key(k), Packets: v})
+	}
+	slices.SortFunc(top, func(a, b DropsTop) int {
+		if c := cmp.Compare(b.Packets, a.Packets); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return top[:min(len(top), dropTop)]
+}
+
+// dropParse sample of nflog packet message: prefix of rule and ip header of payload
+func dropParse(data []byte) (dropSample, error) {
+	var sample dropSample
+	if len(data) < 4 {
+		return sample, errors.New("short nflog message")
+	}
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return sample, err
+	}
+	var payload []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPrefix:
+			sample.chain = ad.String()
+		case nfulaPayload:
+			payload = ad.Bytes()
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return sample, err
+	}
+	if len(payload) == 0 {
+		return sample, errors.New("nflog message without payload")
+	}
+
+	var (
+		proto     byte
+		transport []byte
+	)
+	switch payload[0] >> 4 {
+	case 4:
+		ihl := int(payload[0]&0x0f) * 4
+		if len(payload) < 20 || ihl < 20 {
+			return sample, errors.New("short ipv4 header")
+		}
+		sample.source = netip.AddrFrom4([4]byte(payload[12:16]))
+		proto = payload[9]
+		// fragments have no transport header
+		if binary.BigEndian.Uint16(payload[6:8])&0x1fff == 0 && len(payload) > ihl {
+			transport = payload[ihl:]
+		}
+	case 6:
+		if len(payload) < 40 {
+			return sample, errors.New("short ipv6 header")
+		}
+		sample.source = netip.AddrFrom16([16]byte(payload[8:24]))
+		proto = payload[6]
+		transport = payload[40:]
+	default:
+		return sample, fmt.Errorf("unknown ip version %d", payload[0]>>4)
+	}
+
+	switch proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP:
+		sample.proto = "tcp"
+		if proto == unix.IPPROTO_UDP {
+			sample.proto = "udp"
+		}
+		if len(transport) >= 4 {
+			sample.port = binary.BigEndian.Uint16(transport[2:4])
+		}
+	case unix.IPPROTO_ICMP:
+		sample.proto = "icmp"
+	case unix.IPPROTO_ICMPV6:
+		sample.proto = "ipv6-icmp"
+	default:
+		sample.proto = strconv.Itoa(int(proto))
+	}
+	return sample, nil
+}
+
+func (f *Firewall) dropsStart() {
+	if f.dropGroup == 0 {
+		return
+	}
+	f.dropsOnce.Do(func() {
+		go f.dropsListen()
+		go f.dropsReport()
+	})
+}
+
+func (f *Firewall) dropsReport() {
+	ticker := time.NewTicker(dropInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		fd := f.drops.report(now)
+		if fd.Packets+fd.Overruns == 0 {
+			continue
+		}
+		fd.Rate = f.dropRate
+		f.event(&struct {
+			Event         string         `json:"event"`
+			FirewallDrops *FirewallDrops `json:"firewallDrops"`
+		}{
+			Event:         "firewall-drops",
+			FirewallDrops: fd,
+		})
+	}
+}
+
+// dropsListen receives samples of nflog group, reconnects on errors
+func (f *Firewall) dropsListen() {
+	for {
+		if err := f.dropsReceive(); err != nil {
+			log.Println("[firewall] droplog err:", err)
+		}
+		time.Sleep(dropInterval)
+	}
+}
+
+func (f *Firewall) dropsReceive() error {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetReadBuffer(dropReadBuffer)
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, dropSnaplen)
+	mode[4] = nfulnlCopyPacket
+	for _, attr := range []netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}},
+		{Type: nfulaCfgMode, Data: mode},
+	} {
+		if err = f.dropsConfig(conn, attr); err != nil {
+			return fmt.Errorf("bind group %d: %w", f.dropGroup, err)
+		}
+	}
+	log.Printf("[firewall] droplog listening group %d, rate %d/s", f.dropGroup, f.dropRate)
+
+	packet := netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<nfulnlSubsysMsgShift | nfulnlMsgPacket)
+	for {
+		msgs, err := conn.Receive()
+		if errors.Is(err, unix.ENOBUFS) {
+			// flood overran socket buffer, kernel dropped samples
+			f.drops.overrun()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != packet {
+				continue
+			}
+			if sample, err := dropParse(m.Data); err == nil {
+				f.drops.add(sample)
+			}
+		}
+	}
+}
+
+func (f *Firewall) dropsConfig(conn *netlink.Conn, attr netlink.Attribute) error {
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{attr})
+	if err != nil {
+		return err
+	}
+	// nfgenmsg: family, version and group as resource id
+	data := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, byte(f.dropGroup >> 8), byte(f.dropGroup)}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<nfulnlSubsysMsgShift | nfulnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(data, attrs...),
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/mdlayher/netlink"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func dropTestMessage(t *testing.T, prefix string, payload []byte) []byte {
+	t.Helper()
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: 1, Data: []byte{0x08, 0x00, 1, 0}},
+		{Type: nfulaPrefix, Data: append([]byte(prefix), 0)},
+		{Type: nfulaPayload, Data: payload},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{2, 0, 0, 1}, attrs...)
+}
+
+func TestDropParse(t *testing.T) {
+	t.Parallel()
+
+	ip4 := make([]byte, 24)
+	ip4[0], ip4[9] = 0x45, 6
+	copy(ip4[12:], []byte{203, 0, 113, 9})
+	ip4[22], ip4[23] = 0x15, 0x38 // dport 5432
+	sample, err := dropParse(dropTestMessage(t, "input", ip4))
+	if err != nil || sample.chain != "input" || sample.source.String() != "203.0.113.9" ||
+		sample.proto != "tcp" || sample.port != 5432 {
+		t.Fatal("wrong ipv4 sample:", sample, err)
+	}
+
+	ip6 := make([]byte, 44)
+	ip6[0], ip6[6] = 0x60, 17
+	copy(ip6[8:], netip.MustParseAddr("2001:db8::7").AsSlice())
+	ip6[42], ip6[43] = 0, 53
+	sample, err = dropParse(dropTestMessage(t, "nat", ip6))
+	if err != nil || sample.chain != "nat" || sample.source.String() != "2001:db8::7" ||
+		sample.proto != "udp" || sample.port != 53 {
+		t.Fatal("wrong ipv6 sample:", sample, err)
+	}
+
+	// fragment without transport header
+	ip4[6] = 0x01
+	if sample, _ = dropParse(dropTestMessage(t, "input", ip4)); sample.port != 0 {
+		t.Fatal("port of fragment:", sample.port)
+	}
+
+	for _, payload := range [][]byte{nil, {0x45, 0}, {0x60}, {0x10, 0, 0, 0}} {
+		if _, err = dropParse(dropTestMessage(t, "input", payload)); err == nil {
+			t.Fatalf("invalid payload %x passed", payload)
+		}
+	}
+}
+
+func TestDropStats(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	s := newDropStats(start)
+	for i := range dropKeysMax + 10 {
+		a := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+		s.add(dropSample{chain: "input", source: a, proto: "tcp", port: 22})
+	}
+	for range 5 {
+		s.add(dropSample{chain: "nat", source: netip.MustParseAddr("10.0.0.1"), proto: "icmp"})
+	}
+	s.overrun()
+
+	fd := s.report(start.Add(time.Minute))
+	if fd.Packets != dropKeysMax+15 || fd.Overflow != 10 || fd.Overruns != 1 {
+		t.Fatal("wrong totals:", fd.Packets, fd.Overflow, fd.Overruns)
+	}
+	if len(fd.Sources) != dropTop || fd.Sources[0].Key != "10.0.0.1" || fd.Sources[0].Packets != 6 {
+		t.Fatal("wrong top sources:", fd.Sources)
+	}
+	if fd.Ports[0].Key != "tcp/22" || fd.Ports[0].Packets != dropKeysMax ||
+		fd.Chains[0].Key != "input" || fd.Chains[1].Packets != 5 || fd.Protocols[1].Key != "icmp" {
+		t.Fatal("wrong top:", fd.Ports, fd.Chains, fd.Protocols)
+	}
+	if fd = s.report(start.Add(2 * time.Minute)); fd.Packets != 0 || fd.Overruns != 0 || len(fd.Sources) != 0 {
+		t.Fatal("stats are not reset:", fd)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// external blocklists (spamhaus drop, firehol level1) are loaded from url or local file
+// into own interval sets of blackhole table per feed and family: feed4-spamhaus,
+// each feed is refreshed by its own interval and counted by its drop rules
+
+const (
+	feedSetPrefix      = "feed"
+	feedRefreshDefault = time.Hour
+	feedRefreshMin     = 5 * time.Minute
+	feedRefreshMax     = 7 * 24 * time.Hour
+	feedTick           = time.Minute
+	feedTimeout        = time.Minute
+	feedMaxBytes       = 32 << 20
+)
+
+var feedNameReg = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type BlackholeFeed struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`  // http(s) url or absolute path of local file
+	Refresh int    `json:"refresh"` // seconds, default 1h
+}
+
+// feedState loaded feed, validators of source skip loading of unchanged list
+type feedState struct {
+	BlackholeFeed
+	refresh  time.Duration
+	prefixes int
+	next     time.Time
+	etag     string
+	modified string
+	modTime  time.Time
+	size     int64
+}
+
+// feedSource validators of source from previous load
+type feedSource struct {
+	etag     string
+	modified string
+	modTime  time.Time
+	size     int64
+}
+
+func feedSet(name, family string) string {
+	if family == "ip6" {
+		return feedSetPrefix + "6-" + name
+	}
+	return feedSetPrefix + "4-" + name
+}
+
+// feedOfSet name of feed by its set
+func feedOfSet(set string) (string, bool) {
+	if name, ok := strings.CutPrefix(set, feedSetPrefix+"4-"); ok {
+		return name, true
+	}
+	return strings.CutPrefix(set, feedSetPrefix+"6-")
+}
+
+func (e *BlackholeFeed) validate() (time.Duration, error) {
+	e.Name = strings.ToLower(strings.TrimSpace(e.Name))
+	e.Source = strings.TrimSpace(e.Source)
+	if !feedNameReg.MatchString(e.Name) {
+		return 0, fmt.Errorf("feed name %q must be of a-z, 0-9, _ and -, up to 32", e.Name)
+	}
+	if strings.HasPrefix(e.Source, "http://") || strings.HasPrefix(e.Source, "https://") {
+		if u, err := url.Parse(e.Source); err != nil || u.Host == "" {
+			return 0, fmt.Errorf("feed source %q is not a valid url", e.Source)
+		}
+	} else if !filepath.IsAbs(e.Source) {
+		return 0, fmt.Errorf("feed source %q is not an url or absolute path", e.Source)
+	}
+	refresh := time.Duration(e.Refresh) * time.Second
+	if e.Refresh == 0 {
+		refresh = feedRefreshDefault
+	}
+	if refresh < feedRefreshMin || refresh > feedRefreshMax {
+		return 0, fmt.Errorf("feed refresh %s is out of range %s-%s", refresh, feedRefreshMin, feedRefreshMax)
+	}
+	return refresh, nil
+}
+
+// parseFeed prefixes of list, one ip or cidr per line with comments after # or ;
+// like "1.10.16.0/20 ; SBL256894", returns number of skipped invalid lines
+func parseFeed(r io.Reader) ([]netip.Prefix, int, error) {
+	var (
+		prefixes []netip.Prefix
+		skipped  int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		p, err := parsePrefix(fields[0])
+		if err != nil {
+			skipped++
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, err
+	}
+	if len(prefixes) == 0 {
+		return nil, skipped, errors.New("feed has no prefixes")
+	}
+	return feedCovered(prefixes), skipped, nil
+}
+
+// feedReader fails read of source over its limit, so cut feed is not loaded as whole
+type feedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64 // bytes left, one over limit
+}
+
+func feedLimit(r io.Reader, limit int64) io.Reader {
+	return &feedReader{r: r, limit: limit, n: limit + 1}
+}
+
+func (l *feedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n <= 0 {
+		return n, fmt.Errorf("feed is larger than %d bytes", l.limit)
+	}
+	return n, err
+}
+
+// feedCovered drops duplicates and prefixes inside of others, interval sets reject overlaps
+func feedCovered(prefixes []netip.Prefix) []netip.Prefix {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	list := prefixes[:0]
+	for _, p := range prefixes {
+		if n := len(list); n > 0 && list[n-1].Overlaps(p) {
+			continue
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+// feedFetch reads source with number of skipped lines, unchanged one since previous validators returns nil prefixes
+func feedFetch(ctx context.Context, source string, prev feedSource) ([]netip.Prefix, int, feedSource, error) {
+	if filepath.IsAbs(source) {
+		stat, err := os.Stat(source)
+		if err != nil {
+			return nil, 0, prev, err
+		}
+		next := feedSource{modTime: stat.ModTime(), size: stat.Size()}
+		if next.modTime.Equal(prev.modTime) && next.size == prev.size {
+			return nil, 0, prev, nil
+		}
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, 0, prev, err
+		}
+		defer file.Close()
+		prefixes, skipped, err := parseFeed(feedLimit(file, feedMaxBytes))
+		return prefixes, skipped, next, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, 0, prev, err
+	}
+	if prev.etag != "" {
+		req.Header.Set("If-None-Match", prev.etag)
+	}
+	if prev.modified != "" {
+		req.Header.Set("If-Modified-Since", prev.modified)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, prev, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, 0, prev, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, prev, fmt.Errorf("status %s", resp.Status)
+	}
+	prefixes, skipped, err := parseFeed(feedLimit(resp.Body, feedMaxBytes))
+	next := feedSource{etag: resp.Header.Get("ETag"), modified: resp.Header.Get("Last-Modified")}
+	return prefixes, skipped, next, err
+}
+
+// feedElements prefixes of family
+func feedElements(prefixes []netip.Prefix, family string) []nftElement {
+	var elements []nftElement
+	for _, p := range prefixes {
+		if p.Addr().Is4() == (family == "ip") {
+			elements = append(elements, nftElement{Prefix: p})
+		}
+	}
+	return elements
+}
+
+// BlackHoleFeedEnable loads feed into its sets and refreshes it, enabled one is replaced,
+// returns numbers of loaded prefixes and skipped invalid lines
+func (f *Firewall) BlackHoleFeedEnable(errs *stepErrors, feed *BlackholeFeed) (int, int) {
+	if !f.blackHole.Load() {
+		errs.fail("blackhole is not enabled")
+		return 0, 0
+	}
+	if feed == nil {
+		errs.fail("blackhole feed is empty")
+		return 0, 0
+	}
+	refresh, err := feed.validate()
+	if err != nil {
+		errs.fail("blackhole feed: %s", err)
+		return 0, 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), feedTimeout)
+	defer cancel()
+	prefixes, skipped, source, err := feedFetch(ctx, feed.Source, feedSource{})
+	if err != nil {
+		log.Printf("[blackhole] feed %s err: %s", feed.Name, err)
+		errs.fail("blackhole feed %s: %s", feed.Name, err)
+		return 0, 0
+	}
+
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+	tx := f.nft.Begin()
+	f.feedRender(tx, feed.Name, prefixes)
+	if err := tx.Commit(); err != nil {
+		log.Printf("[blackhole] feed %s err: %s", feed.Name, err)
+		errs.fail("blackhole feed %s: %s", feed.Name, err)
+		return 0, 0
+	}
+	log.Printf("[blackhole] feed %s enabled, prefixes %d, skipped lines %d", feed.Name, len(prefixes), skipped)
+
+	f.feedsMu.Lock()
+	f.feeds[feed.Name] = &feedState{BlackholeFeed: *feed, refresh: refresh, prefixes: len(prefixes),
+		next: time.Now().Add(refresh), etag: source.etag, modified: source.modified, modTime: source.modTime, size: source.size}
+	f.feedsMu.Unlock()
+	f.feedsOnce.Do(func() {
+		go f.feedsWatch()
+	})
+	return len(prefixes), skipped
+}
+
+// feedRender queues sets of feed with elements, drop rules are added once, must be called with applyMu held
+func (f *Firewall) feedRender(tx NftTx, name string, prefixes []netip.Prefix) {
+	sets, _ := f.nft.Sets(f.tableBH)
+	exists := slices.Contains(sets, feedSet(name, "ip"))
+	for _, family := range []string{"ip", "ip6"} {
+		addrType := "ipv4_addr"
+		if family == "ip6" {
+			addrType = "ipv6_addr"
+		}
+		set := feedSet(name, family)
+		tx.AddSet(f.tableBH, nftSet{Name: set, Type: addrType, Interval: true})
+		tx.FlushSet(f.tableBH, set)
+		tx.AddElements(f.tableBH, set, feedElements(prefixes, family))
+		if exists {
+			continue
+		}
+		for _, chain := range []string{"input", "forward"} {
+			tx.AddRule(f.tableBH, chain, ruleOf(matchAddr{Family: family, Set: set},
+				stmtCounter{}, stmtVerdict{Kind: "drop"}))
+		}
+	}
+}
+
+// BlackHoleFeedDisable removes sets and rules of feed
+func (f *Firewall) BlackHoleFeedDisable(errs *stepErrors, name string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	f.feedsMu.Lock()
+	delete(f.feeds, name)
+	f.feedsMu.Unlock()
+	if !f.blackHole.Load() {
+		return
+	}
+
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+	sets, _ := f.nft.Sets(f.tableBH)
+	if !slices.Contains(sets, feedSet(name, "ip")) {
+		return
+	}
+	tx := f.nft.Begin()
+	for _, chain := range []string{"input", "forward"} {
+		rules, _ := f.nft.Rules(f.tableBH, chain)
+		for _, r := range rules {
+			if feed, ok := feedOfSet(r.Set); ok && feed == name {
+				tx.DelRule(f.tableBH, chain, r.Handle)
+			}
+		}
+	}
+	for _, family := range []string{"ip", "ip6"} {
+		if slices.Contains(sets, feedSet(name, family)) {
+			tx.DelSet(f.tableBH, feedSet(name, family))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[blackhole] feed %s disable err: %s", name, err)
+		errs.fail("blackhole feed %s disable: %s", name, err)
+		return
+	}
+	log.Printf("[blackhole] feed %s disabled", name)
+}
+
+// feedsRestore picks up feeds of previous run by their sets, they are refreshed after next enable
+func (f *Firewall) feedsRestore(sets []string) {
+	f.feedsMu.Lock()
+	defer f.feedsMu.Unlock()
+	for _, set := range sets {
+		name, ok := strings.CutPrefix(set, feedSetPrefix+"4-")
+		if !ok {
+			continue
+		}
+		if _, ok := f.feeds[name]; !ok {
+			elements, _ := f.nft.Elements(f.tableBH, set)
+			elements6, _ := f.nft.Elements(f.tableBH, feedSet(name, "ip6"))
+			f.feeds[name] = &feedState{BlackholeFeed: BlackholeFeed{Name: name}, prefixes: len(elements) + len(elements6)}
+		}
+	}
+}
+
+func (f *Firewall) feedsWatch() {
+	ticker := time.NewTicker(feedTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		f.feedsUpdate(now)
+	}
+}
+
+// feedsUpdate refreshes feeds which are due, source is read without locks
+func (f *Firewall) feedsUpdate(now time.Time) {
+	f.feedsMu.Lock()
+	var due []feedState
+	for _, st := range f.feeds {
+		if st.Source != "" && !now.Before(st.next) {
+			st.next = now.Add(st.refresh)
+			due = append(due, *st)
+		}
+	}
+	f.feedsMu.Unlock()
+
+	for _, st := range due {
+		ctx, cancel := context.WithTimeout(context.Background(), feedTimeout)
+		prefixes, skipped, source, err := feedFetch(ctx, st.Source,
+			feedSource{etag: st.etag, modified: st.modified, modTime: st.modTime, size: st.size})
+		cancel()
+		if err != nil {
+			log.Printf("[blackhole] feed %s refresh err: %s", st.Name, err)
+			continue
+		}
+		if prefixes == nil {
+			continue
+		}
+		f.feedUpdate(st, prefixes, skipped, source)
+	}
+}
+
+// feedUpdate replaces elements of feed which is still enabled with the same source
+func (f *Firewall) feedUpdate(st feedState, prefixes []netip.Prefix, skipped int, source feedSource) {
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+	f.feedsMu.Lock()
+	current, ok := f.feeds[st.Name]
+	f.feedsMu.Unlock()
+	if !ok || current.Source != st.Source || !f.blackHole.Load() {
+		return
+	}
+
+	tx := f.nft.Begin()
+	f.feedRender(tx, st.Name, prefixes)
+	if err := tx.Commit(); err != nil {
+		log.Printf("[blackhole] feed %s refresh err: %s", st.Name, err)
+		return
+	}
+	log.Printf("[blackhole] feed %s refreshed, prefixes %d, skipped lines %d", st.Name, len(prefixes), skipped)
+
+	f.feedsMu.Lock()
+	current.prefixes = len(prefixes)
+	current.etag, current.modified = source.etag, source.modified
+	current.modTime, current.size = source.modTime, source.size
+	f.feedsMu.Unlock()
+}
+
+// feedsPrefixes number of prefixes per feed for counters
+func (f *Firewall) feedsPrefixes() map[string]int {
+	f.feedsMu.Lock()
+	defer f.feedsMu.Unlock()
+	prefixes := make(map[string]int, len(f.feeds))
+	for name, st := range f.feeds {
+		prefixes[name] = st.prefixes
+	}
+	return prefixes
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFeed(t *testing.T) {
+	t.Parallel()
+
+	prefixes, skipped, err := parseFeed(strings.NewReader(`; Spamhaus DROP List 2026/10/17
+1.10.16.0/20 ; SBL256894
+# firehol level1
+10.0.0.0/8
+10.20.0.0/16
+10.0.0.0/8
+203.0.113.7
+2001:db8::/32 ; v6
+bad line
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	for _, p := range prefixes {
+		list = append(list, prefixString(p))
+	}
+	if want := []string{"1.10.16.0/20", "10.0.0.0/8", "203.0.113.7", "2001:db8::/32"}; !slices.Equal(list, want) || skipped != 1 {
+		t.Fatal("wrong prefixes:", list, skipped)
+	}
+	if _, _, err = parseFeed(strings.NewReader("# empty\n")); err == nil {
+		t.Fatal("empty feed passed")
+	}
+	feed := "192.0.2.0/24\n198.51.100.0/24\n"
+	if _, _, err = parseFeed(feedLimit(strings.NewReader(feed), int64(len(feed)-1))); err == nil {
+		t.Fatal("feed over limit passed")
+	}
+	if prefixes, _, err = parseFeed(feedLimit(strings.NewReader(feed), int64(len(feed)))); err != nil || len(prefixes) != 2 {
+		t.Fatal("feed of limit is rejected:", prefixes, err)
+	}
+
+	for _, e := range []BlackholeFeed{
+		{Name: "Bad Name", Source: "https://example.com/drop.txt"},
+		{Name: "drop", Source: "drop.txt"},
+		{Name: "drop", Source: "https://"},
+		{Name: "drop", Source: "/etc/drop.txt", Refresh: 60},
+	} {
+		if _, err := e.validate(); err == nil {
+			t.Fatalf("invalid feed passed: %+v", e)
+		}
+	}
+	valid := BlackholeFeed{Name: " Spamhaus", Source: "https://www.spamhaus.org/drop/drop.txt"}
+	if refresh, err := valid.validate(); err != nil || refresh != feedRefreshDefault || valid.Name != "spamhaus" {
+		t.Fatal("valid feed is rejected:", valid, err)
+	}
+}
+
+func TestFeedFetch(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "drop.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.0/24\nbad line\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prefixes, skipped, source, err := feedFetch(context.Background(), path, feedSource{})
+	if err != nil || len(prefixes) != 1 || skipped != 1 {
+		t.Fatal("file feed:", prefixes, skipped, err)
+	}
+	if prefixes, _, _, err = feedFetch(context.Background(), path, source); err != nil || prefixes != nil {
+		t.Fatal("unchanged file is loaded again:", prefixes, err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("198.51.100.0/24 ; SBL1\n2001:db8::/32\n"))
+	}))
+	defer srv.Close()
+	prefixes, _, source, err = feedFetch(context.Background(), srv.URL, feedSource{})
+	if err != nil || len(prefixes) != 2 || source.etag != `"v1"` {
+		t.Fatal("url feed:", prefixes, source, err)
+	}
+	if prefixes, _, _, err = feedFetch(context.Background(), srv.URL, source); err != nil || prefixes != nil {
+		t.Fatal("not modified feed is loaded again:", prefixes, err)
+	}
+	if _, _, _, err = feedFetch(context.Background(), srv.URL+"/missing", feedSource{}); err == nil {
+		t.Fatal("missing feed passed")
+	}
+}
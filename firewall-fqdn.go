@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostname sources of rules are resolved into named sets per family: fqdn4-office.example.com,
+// rules reference the sets and only elements are updated when records change
+
+const (
+	fqdnSetPrefix = "fqdn"
+	fqdnMinTTL    = 30 * time.Second
+	fqdnMaxTTL    = time.Hour
+	fqdnTick      = 5 * time.Second
+	fqdnTimeout   = 3 * time.Second
+	// fqdnRefreshTimeout of all hosts of refresh, command loop is not blocked longer,
+	// hosts resolved later are updated by watcher
+	fqdnRefreshTimeout = 5 * time.Second
+	fqdnParallel       = 8
+)
+
+var hostnameReg = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z](?:[a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var (
+	errFqdnOtherQuery = errors.New("dns answer of other query")
+	errFqdnTruncated  = errors.New("dns answer is truncated")
+)
+
+// FirewallFqdn update of hostname sets by changed addresses
+type FirewallFqdn struct {
+	Hosts []string  `json:"hosts"`
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+}
+
+// fqdnEntry resolved addresses of host, expires by the lowest ttl of records,
+// stale addresses are not in sets yet
+type fqdnEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+	stale   bool
+}
+
+// parseHostname normalizes hostname of source, names of sets are limited by 255
+func parseHostname(s string) (string, error) {
+	host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	if len(host) > 240 || !hostnameReg.MatchString(host) {
+		return "", errors.New("not an ip, cidr or hostname")
+	}
+	return host, nil
+}
+
+func isHostname(s string) bool {
+	return s != "" && hostnameReg.MatchString(s)
+}
+
+func fqdnSet(host, family string) string {
+	if family == "ip6" {
+		return fqdnSetPrefix + "6-" + host
+	}
+	return fqdnSetPrefix + "4-" + host
+}
+
+// fqdnHosts hostnames of rule sources
+func fqdnHosts(rules []FirewallRules) []string {
+	var hosts []string
+	for _, e := range rules {
+		if isHostname(e.Source) && !slices.Contains(hosts, e.Source) {
+			hosts = append(hosts, e.Source)
+		}
+	}
+	return hosts
+}
+
+// fqdnElements cached addresses of host for set of family
+func (f *Firewall) fqdnElements(host, family string) []nftElement {
+	f.fqdnMu.Lock()
+	defer f.fqdnMu.Unlock()
+	var elements []nftElement
+	if entry, ok := f.fqdn[host]; ok {
+		for _, a := range entry.addrs {
+			if a.Is4() == (family == "ip") {
+				elements = append(elements, nftElement{Prefix: netip.PrefixFrom(a, a.BitLen())})
+			}
+		}
+	}
+	return elements
+}
+
+// renderFqdn queues sets of hostnames with cached addresses in table of given families
+func (f *Firewall) renderFqdn(tx NftTx, t nftTable, hosts []string, families []string, keep map[string]bool) {
+	for _, host := range hosts {
+		for _, family := range families {
+			addrType := "ipv4_addr"
+			if family == "ip6" {
+				addrType = "ipv6_addr"
+			}
+			name := fqdnSet(host, family)
+			tx.AddSet(t, nftSet{Name: name, Type: addrType, Interval: true})
+			tx.FlushSet(t, name)
+			if elements := f.fqdnElements(host, family); len(elements) > 0 {
+				tx.AddElements(t, name, elements)
+			}
+			keep[name] = true
+		}
+	}
+}
+
+// fqdnResolve resolves hosts which are not cached yet or expired in parallel till deadline of ctx,
+// returns hosts with changed addresses
+func (f *Firewall) fqdnResolve(ctx context.Context, hosts []string, now time.Time) []string {
+	changes := make([]bool, len(hosts))
+	sem := make(chan struct{}, fqdnParallel)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		f.fqdnMu.Lock()
+		entry := f.fqdn[host]
+		f.fqdnMu.Unlock()
+		if entry != nil && now.Before(entry.expires) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			changes[i] = f.fqdnResolveHost(ctx, host, entry, now)
+		}()
+	}
+	wg.Wait()
+
+	var changed []string
+	for i, host := range hosts {
+		if changes[i] {
+			changed = append(changed, host)
+		}
+	}
+	return changed
+}
+
+// fqdnResolveHost caches addresses of host, entry is the previous one or nil, returns true on change
+func (f *Firewall) fqdnResolveHost(ctx context.Context, host string, entry *fqdnEntry, now time.Time) bool {
+	lookupCtx, cancel := context.WithTimeout(ctx, fqdnTimeout)
+	addrs, ttl, err := f.resolve(lookupCtx, host)
+	cancel()
+	if err != nil {
+		log.Printf("[firewall] resolve %s err: %s", host, err)
+		// deadline of refresh, the next update resolves it
+		if entry == nil && ctx.Err() != nil {
+			return false
+		}
+		// keep addresses of last success, retry later
+		addrs = nil
+		if entry != nil {
+			addrs = entry.addrs
+		}
+		ttl = fqdnMinTTL
+	}
+	ttl = min(max(ttl, fqdnMinTTL), fqdnMaxTTL)
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	addrs = slices.Compact(addrs)
+
+	f.fqdnMu.Lock()
+	f.fqdn[host] = &fqdnEntry{addrs: addrs, expires: now.Add(ttl)}
+	f.fqdnMu.Unlock()
+	if entry == nil || entry.stale || !slices.Equal(entry.addrs, addrs) {
+		if entry != nil {
+			log.Printf("[firewall] %s resolved to %d addresses", host, len(addrs))
+		}
+		return true
+	}
+	return false
+}
+
+// fqdnPrune forgets hosts which are not in rules anymore
+func (f *Firewall) fqdnPrune(hosts []string) {
+	f.fqdnMu.Lock()
+	defer f.fqdnMu.Unlock()
+	for host := range f.fqdn {
+		if !slices.Contains(hosts, host) {
+			delete(f.fqdn, host)
+		}
+	}
+}
+
+func (f *Firewall) fqdnStart() {
+	f.fqdnOnce.Do(func() {
+		go f.fqdnWatch()
+	})
+}
+
+func (f *Firewall) fqdnWatch() {
+	ticker := time.NewTicker(fqdnTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if ff := f.fqdnUpdate(time.Now()); ff != nil {
+			f.event(&struct {
+				Event        string        `json:"event"`
+				FirewallFqdn *FirewallFqdn `json:"firewallFqdn"`
+			}{
+				Event:        "firewall-fqdn",
+				FirewallFqdn: ff,
+			})
+		}
+	}
+}
+
+// fqdnUpdate re-resolves expired hosts of desired rules,
+// changed addresses replace elements of sets without full refresh, returns update of sets
+func (f *Firewall) fqdnUpdate(now time.Time) *FirewallFqdn {
+	f.applyMu.Lock()
+	hosts := fqdnHosts(f.desired)
+	f.applyMu.Unlock()
+	f.fqdnPrune(hosts)
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	changed := f.fqdnResolve(context.Background(), hosts, now)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+	if f.desired == nil {
+		return nil
+	}
+
+	tx := f.nft.Begin()
+	updates := 0
+	tables := append([]nftTable{f.tableInet}, f.tablesNat...)
+	for _, t := range tables {
+		sets, err := f.nft.Sets(t)
+		if err != nil {
+			continue
+		}
+		for _, host := range changed {
+			for _, family := range []string{"ip", "ip6"} {
+				name := fqdnSet(host, family)
+				if !slices.Contains(sets, name) {
+					continue
+				}
+				tx.FlushSet(t, name)
+				if elements := f.fqdnElements(host, family); len(elements) > 0 {
+					tx.AddElements(t, name, elements)
+				}
+				updates++
+			}
+		}
+	}
+	if updates == 0 {
+		return nil
+	}
+	ff := &FirewallFqdn{Hosts: changed, At: now.UTC()}
+	if err := tx.Commit(); err != nil {
+		log.Println("[firewall] update hostname sets err:", err)
+		logger.Debug("[firewall] rejected ruleset:\n" + tx.String())
+		ff.Error = err.Error()
+		// sets keep old addresses, so hosts are updated again by the next resolve
+		f.fqdnMu.Lock()
+		for _, host := range changed {
+			if entry, ok := f.fqdn[host]; ok {
+				entry.stale, entry.expires = true, now
+			}
+		}
+		f.fqdnMu.Unlock()
+		return ff
+	}
+	log.Println("[firewall] updated hostname sets:", strings.Join(changed, ", "))
+	return ff
+}
+
+// fqdnLookup resolves host by /etc/hosts, then A and AAAA records by nameservers of resolv.conf,
+// returns addresses with the lowest ttl of records. Own exchange instead of net.Resolver,
+// which does not return ttl, sets are updated by it, messages are packed and parsed by dnsmessage.
+// Hostnames of rules are fully qualified, so search domains are not applied
+func fqdnLookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if addrs := fqdnHostsFile("/etc/hosts", host); len(addrs) > 0 {
+		return addrs, fqdnMaxTTL, nil
+	}
+	var lastErr error
+	for _, server := range fqdnNameservers() {
+		var (
+			addrs []netip.Addr
+			ttl   = fqdnMaxTTL
+			err   error
+		)
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			var (
+				a []netip.Addr
+				t time.Duration
+			)
+			a, t, err = fqdnQuery(ctx, server, host, qtype)
+			if err != nil {
+				break
+			}
+			addrs = append(addrs, a...)
+			ttl = min(ttl, t)
+		}
+		if err == nil {
+			return addrs, ttl, nil
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// fqdnHostsFile static addresses of host in hosts file
+func fqdnHostsFile(path, host string) []netip.Addr {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var addrs []netip.Addr
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		a, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if strings.TrimSuffix(strings.ToLower(name), ".") == host {
+				addrs = append(addrs, a.Unmap())
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+func fqdnNameservers() []string {
+	var servers []string
+	file, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				if a, err := netip.ParseAddr(fields[1]); err == nil {
+					servers = append(servers, netip.AddrPortFrom(a, 53).String())
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// fqdnQuery asks server by udp, truncated answer is asked again by tcp
+func fqdnQuery(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addrs, ttl, err := fqdnExchange(ctx, "udp", server, packed, id)
+	if errors.Is(err, errFqdnTruncated) {
+		return fqdnExchange(ctx, "tcp", server, packed, id)
+	}
+	return addrs, ttl, err
+}
+
+// fqdnExchange sends query and parses its answer, tcp messages are prefixed by length,
+// udp datagrams of other queries are skipped until deadline
+func fqdnExchange(ctx context.Context, network, server string, packed []byte, id uint16) ([]netip.Addr, time.Duration, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		if _, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...)); err != nil {
+			return nil, 0, err
+		}
+		var size [2]byte
+		if _, err = io.ReadFull(conn, size[:]); err != nil {
+			return nil, 0, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return nil, 0, err
+		}
+		return fqdnParse(buf, id)
+	}
+
+	if _, err = conn.Write(packed); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs, ttl, err := fqdnParse(buf[:n], id)
+		if errors.Is(err, errFqdnOtherQuery) {
+			continue
+		}
+		return addrs, ttl, err
+	}
+}
+
+// fqdnParse addresses of answer, cname chain is followed by resolver
+func fqdnParse(b []byte, id uint16) ([]netip.Addr, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errFqdnOtherQuery
+	}
+	if h.Truncated {
+		return nil, 0, errFqdnTruncated
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, fqdnMinTTL, nil
+	default:
+		return nil, 0, fmt.Errorf("dns %s", h.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []netip.Addr
+	ttl := fqdnMaxTTL
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		// parser reads addresses by their size, not by length of record
+		if (rh.Type == dnsmessage.TypeA && rh.Length != 4) || (rh.Type == dnsmessage.TypeAAAA && rh.Length != 16) {
+			return nil, 0, fmt.Errorf("dns %s record of length %d", rh.Type, rh.Length)
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+		ttl = min(ttl, time.Duration(rh.TTL)*time.Second)
+	}
+	return addrs, ttl, nil
+}
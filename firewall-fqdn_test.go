@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFirewallFqdnResolve(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	f.resolve = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.10")}, time.Second, nil
+	}
+	now := time.Now()
+	if changed := f.fqdnResolve(context.Background(), []string{"office.example.com"}, now); len(changed) != 1 {
+		t.Fatal("not resolved:", changed)
+	}
+	if changed := f.fqdnResolve(context.Background(), []string{"office.example.com"}, now.Add(fqdnMinTTL/2)); len(changed) != 0 {
+		t.Fatal("resolved before ttl:", changed)
+	}
+}
+
+func TestFirewallFqdnDeadline(t *testing.T) {
+	t.Parallel()
+
+	// dead resolver of one host does not hold the others over deadline of refresh
+	f := NewFirewall()
+	f.resolve = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+		if host == "dead.example.com" {
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		}
+		return []netip.Addr{netip.MustParseAddr("192.0.2.10")}, time.Minute, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	changed := f.fqdnResolve(ctx, []string{"dead.example.com", "office.example.com"}, start)
+	if time.Since(start) >= fqdnTimeout || !slices.Equal(changed, []string{"office.example.com"}) {
+		t.Fatal("wrong resolve till deadline:", changed, time.Since(start))
+	}
+	// not cached, so resolved again by the next update
+	if _, ok := f.fqdn["dead.example.com"]; ok {
+		t.Fatal("host of expired deadline is cached")
+	}
+}
+
+func TestFqdnHostsFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	hosts := "127.0.0.1 localhost\n" +
+		"# 192.0.2.1 office.example.com\n" +
+		"192.0.2.10 gw office.example.com. # office\n" +
+		"2001:db8::10 Office.Example.com\n"
+	if err := os.WriteFile(path, []byte(hosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	addrs := fqdnHostsFile(path, "office.example.com")
+	if !slices.Equal(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")}) {
+		t.Fatal("wrong addresses:", addrs)
+	}
+	if addrs = fqdnHostsFile(path, "example.com"); addrs != nil {
+		t.Fatal("addresses of other host:", addrs)
+	}
+}
+
+func TestFqdnParse(t *testing.T) {
+	t.Parallel()
+
+	name := dnsmessage.MustNewName("office.example.com.")
+	target := dnsmessage.MustNewName("edge.example.net.")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, Response: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	_ = b.StartAnswers()
+	_ = b.CNAMEResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 300},
+		dnsmessage.CNAMEResource{CNAME: target})
+	_ = b.AResource(dnsmessage.ResourceHeader{Name: target, Class: dnsmessage.ClassINET, TTL: 60},
+		dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}})
+	_ = b.AResource(dnsmessage.ResourceHeader{Name: target, Class: dnsmessage.ClassINET, TTL: 120},
+		dnsmessage.AResource{A: [4]byte{192, 0, 2, 20}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, ttl, err := fqdnParse(msg, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("192.0.2.20")}) {
+		t.Fatal("wrong addresses:", addrs)
+	}
+	if ttl != time.Minute {
+		t.Fatal("wrong ttl:", ttl)
+	}
+	if _, _, err = fqdnParse(msg, 8); !errors.Is(err, errFqdnOtherQuery) {
+		t.Fatal("answer of other query is accepted")
+	}
+	msg[2] |= 0x02 // TC bit
+	if _, _, err = fqdnParse(msg, 7); !errors.Is(err, errFqdnTruncated) {
+		t.Fatal("truncated answer is accepted:", err)
+	}
+}
+
+func TestFqdnParseMalformed(t *testing.T) {
+	t.Parallel()
+
+	name := dnsmessage.MustNewName("office.example.com.")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, Response: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	_ = b.StartAnswers()
+	_ = b.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 60},
+		dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one answer without questions, its name is a pointer
+	header := []byte{0, 7, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0}
+	record := []byte{0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 10}
+
+	for reason, packet := range map[string][]byte{
+		"short header":           msg[:5],
+		"compression loop":       slices.Concat(header, []byte{0xc0, 12}, record),
+		"pointer out of message": slices.Concat(header, []byte{0xc0, 0xff}, record),
+		"truncated record":       msg[:len(msg)-2],
+		"missing record":         slices.Concat(msg[:7], []byte{2}, msg[8:]),
+		"short address":          slices.Concat(msg[:len(msg)-6], []byte{0, 3, 192, 0, 2}),
+		"record over message":    slices.Concat(msg[:len(msg)-6], []byte{0, 40}, msg[len(msg)-4:]),
+	} {
+		if addrs, _, err := fqdnParse(packet, 7); err == nil {
+			t.Fatalf("%s is parsed: %v", reason, addrs)
+		}
+	}
+}
+
+// fqdnAnswer answer of query with address of its name
+func fqdnAnswer(t *testing.T, query []byte, id uint16, truncated bool) []byte {
+	t.Helper()
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Truncated: truncated})
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	if !truncated {
+		_ = b.StartAnswers()
+		_ = b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(h.ID)}})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestFqdnQuery(t *testing.T) {
+	t.Parallel()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Skip("tcp port of udp server is busy:", err)
+	}
+	defer tcp.Close()
+
+	// stray datagram goes first, then truncated answer
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint16(buf)
+		_, _ = udp.WriteTo(fqdnAnswer(t, buf[:n], id+1, false), addr)
+		_, _ = udp.WriteTo(fqdnAnswer(t, buf[:n], id, true), addr)
+	}()
+	go func() {
+		conn, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var size [2]byte
+		if _, err = io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err = io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer := fqdnAnswer(t, query, binary.BigEndian.Uint16(query), false)
+		_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), fqdnTimeout)
+	defer cancel()
+	addrs, ttl, err := fqdnQuery(ctx, udp.LocalAddr().String(), "office.example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || ttl != time.Minute {
+		t.Fatal("wrong answer:", addrs, ttl)
+	}
+}
+
+// fqdnNft has hostname sets in every table and fails commits
+type fqdnNft struct {
+	Nft
+}
+
+type fqdnTx struct {
+	NftTx
+}
+
+func (n *fqdnNft) Sets(t nftTable) ([]string, error) {
+	return []string{"fqdn4-office.example.com"}, nil
+}
+
+func (n *fqdnNft) Begin() NftTx {
+	return &fqdnTx{}
+}
+
+func (tx *fqdnTx) FlushSet(t nftTable, set string) {}
+
+func (tx *fqdnTx) AddElements(t nftTable, set string, elements []nftElement) {}
+
+func (tx *fqdnTx) Commit() error {
+	return errors.New("invalid argument")
+}
+
+func (tx *fqdnTx) String() string {
+	return ""
+}
+
+func TestFirewallFqdnUpdate(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	f.nft = &fqdnNft{}
+	f.resolve = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.10")}, time.Hour, nil
+	}
+	f.desired = []FirewallRules{{Protocol: "tcp", Source: "office.example.com", Ports: "22", Target: "accept"}}
+
+	now := time.Now()
+	ff := f.fqdnUpdate(now)
+	if ff == nil || ff.Error == "" || !slices.Equal(ff.Hosts, []string{"office.example.com"}) {
+		t.Fatalf("failed update is not reported: %+v", ff)
+	}
+	// same addresses are not in sets yet
+	if ff = f.fqdnUpdate(now.Add(fqdnTick)); ff == nil {
+		t.Fatal("failed update is not retried")
+	}
+}
+
+// refreshNft has no docker tables, transactions are compiled but not committed
+type refreshNft struct {
+	Nft
+	tx *refreshTx
+}
+
+type refreshTx struct {
+	NftTx
+}
+
+func (n *refreshNft) TableExists(t nftTable) bool {
+	return false
+}
+
+func (n *refreshNft) ChainExists(t nftTable, chain string) bool {
+	return false
+}
+
+func (n *refreshNft) Rules(t nftTable, chain string) ([]nftRuleInfo, error) {
+	return nil, nil
+}
+
+func (n *refreshNft) Sets(t nftTable) ([]string, error) {
+	return nil, nil
+}
+
+func (n *refreshNft) Begin() NftTx {
+	n.tx = &refreshTx{NewNftNetlink().Begin()}
+	return n.tx
+}
+
+func (tx *refreshTx) Commit() error {
+	return tx.NftTx.(*nftNetlinkTx).err
+}
+
+func TestFirewallRefreshUnresolved(t *testing.T) {
+	t.Parallel()
+
+	// host without addresses does not fail applied refresh, its sets are filled by watcher
+	n := &refreshNft{}
+	f := NewFirewall()
+	f.nft = n
+	f.countersInterval, f.driftInterval, f.dropGroup = 0, 0, 0
+	f.fqdnOnce.Do(func() {})
+	f.resolve = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+		return nil, 0, errors.New("server misbehaving")
+	}
+	steps := &stepErrors{}
+	unresolved := f.Refresh(steps, []FirewallRules{
+		{Id: "ssh", Protocol: "tcp", Source: "office.example.com", Ports: "22", Target: "accept"},
+	}, nil, "", 0)
+	if errs := steps.Errors(); errs != nil || !slices.Equal(unresolved, []string{"office.example.com"}) {
+		t.Fatal("wrong refresh of unresolved host:", errs, unresolved)
+	}
+	checkScript(t, n.tx.NftTx, "add set inet netip fqdn4-office.example.com { type ipv4_addr; flags interval; }")
+}
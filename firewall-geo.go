@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"log"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// country sources of rules are expanded by local MaxMind database (FIREWALL_GEOIP)
+// into interval sets per list of countries and family: geo4-DE-NL,
+// elements of the sets are replaced in tables rendered by previous version of database file
+
+const (
+	geoSetPrefix     = "geo"
+	geoWatchInterval = time.Minute
+	// geoCountriesMax of list, names of sets are limited by 255
+	geoCountriesMax = 64
+)
+
+var countryReg = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// geoCache prefixes of loaded countries, bound to version of database file
+type geoCache struct {
+	modTime   time.Time
+	size      int64
+	version   int
+	countries map[string][]netip.Prefix
+}
+
+// parseCountries normalizes list of country codes: "nl, de" to "DE,NL"
+func parseCountries(s string) (string, error) {
+	var list []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		if !countryReg.MatchString(c) {
+			return "", fmt.Errorf("country %q is not an iso code", c)
+		}
+		if !slices.Contains(list, c) {
+			list = append(list, c)
+		}
+	}
+	if len(list) == 0 {
+		return "", errors.New("empty list of countries")
+	}
+	if len(list) > geoCountriesMax {
+		return "", fmt.Errorf("more than %d countries", geoCountriesMax)
+	}
+	slices.Sort(list)
+	return strings.Join(list, ","), nil
+}
+
+func geoSet(countries, family string) string {
+	suffix := "4-"
+	if family == "ip6" {
+		suffix = "6-"
+	}
+	return geoSetPrefix + suffix + strings.ReplaceAll(countries, ",", "-")
+}
+
+// geoKeys lists of countries of rules
+func geoKeys(rules []FirewallRules) []string {
+	var keys []string
+	for _, e := range rules {
+		if e.Countries != "" && !slices.Contains(keys, e.Countries) {
+			keys = append(keys, e.Countries)
+		}
+	}
+	return keys
+}
+
+// geoCountries distinct countries of lists
+func geoCountries(keys []string) []string {
+	var countries []string
+	for _, key := range keys {
+		for _, c := range strings.Split(key, ",") {
+			if !slices.Contains(countries, c) {
+				countries = append(countries, c)
+			}
+		}
+	}
+	return countries
+}
+
+// geoLoad makes sure that prefixes of countries are loaded from current database file,
+// changed file gets next version
+func (f *Firewall) geoLoad(countries []string) error {
+	if f.geoPath == "" {
+		return errors.New("geoip database is not configured, set FIREWALL_GEOIP")
+	}
+	stat, err := os.Stat(f.geoPath)
+	if err != nil {
+		return fmt.Errorf("geoip database: %w", err)
+	}
+
+	f.geoMu.Lock()
+	defer f.geoMu.Unlock()
+	changed := f.geo == nil || !stat.ModTime().Equal(f.geo.modTime) || stat.Size() != f.geo.size
+	want := map[string]bool{}
+	for _, c := range countries {
+		want[c] = true
+	}
+	missing := changed
+	if f.geo != nil {
+		for c := range f.geo.countries {
+			want[c] = true
+		}
+		for _, c := range countries {
+			if _, ok := f.geo.countries[c]; !ok {
+				missing = true
+			}
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	start := time.Now()
+	loaded, err := geoRead(f.geoPath, want)
+	if err != nil {
+		return fmt.Errorf("geoip database: %w", err)
+	}
+	version := 1
+	if f.geo != nil {
+		version = f.geo.version
+		if changed {
+			version++
+		}
+	}
+	f.geo = &geoCache{modTime: stat.ModTime(), size: stat.Size(), version: version, countries: loaded}
+	log.Printf("[firewall] geoip loaded %d countries in %s", len(loaded), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// geoVersion of loaded database, read before rendering of sets
+func (f *Firewall) geoVersion() int {
+	f.geoMu.Lock()
+	defer f.geoMu.Unlock()
+	if f.geo == nil {
+		return 0
+	}
+	return f.geo.version
+}
+
+// geoRendered marks sets of tables as rendered by version of database, must be called with applyMu held
+func (f *Firewall) geoRendered(version int, tables ...nftTable) {
+	for _, t := range tables {
+		f.geoApplied[t] = version
+	}
+}
+
+// geoRead walks all networks of database and keeps ones of wanted countries
+func geoRead(path string, want map[string]bool) (map[string][]netip.Prefix, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var record struct {
+		Country struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	countries := map[string][]netip.Prefix{}
+	for c := range want {
+		countries[c] = nil
+	}
+	networks := db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		record.Country.IsoCode, record.RegisteredCountry.IsoCode = "", ""
+		network, err := networks.Network(&record)
+		if err != nil {
+			return nil, err
+		}
+		country := record.Country.IsoCode
+		if country == "" {
+			country = record.RegisteredCountry.IsoCode
+		}
+		if !want[country] {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(network.IP)
+		if !ok {
+			continue
+		}
+		bits, _ := network.Mask.Size()
+		addr = addr.Unmap()
+		if addr.Is4() && bits > 32 {
+			bits -= 96
+		}
+		countries[country] = append(countries[country], netip.PrefixFrom(addr, bits).Masked())
+	}
+	return countries, networks.Err()
+}
+
+// geoElements prefixes of countries for set of family
+func (f *Firewall) geoElements(countries, family string) []nftElement {
+	f.geoMu.Lock()
+	defer f.geoMu.Unlock()
+	if f.geo == nil {
+		return nil
+	}
+	var elements []nftElement
+	for _, c := range strings.Split(countries, ",") {
+		for _, p := range f.geo.countries[c] {
+			if p.Addr().Is4() == (family == "ip") {
+				elements = append(elements, nftElement{Prefix: p})
+			}
+		}
+	}
+	slices.SortFunc(elements, func(a, b nftElement) int {
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	return elements
+}
+
+// geoPrefixes number of prefixes per country
+func (f *Firewall) geoPrefixes(countries []string) map[string]int {
+	f.geoMu.Lock()
+	defer f.geoMu.Unlock()
+	counts := map[string]int{}
+	for _, c := range countries {
+		if f.geo != nil {
+			counts[c] = len(f.geo.countries[c])
+		}
+	}
+	return counts
+}
+
+// GeoPrefixes number of prefixes per country of applied rules and blackhole, for command result
+func (f *Firewall) GeoPrefixes() map[string]int {
+	f.applyMu.Lock()
+	keys := geoKeys(f.desired)
+	if f.bhCountries != "" {
+		keys = append(keys, f.bhCountries)
+	}
+	f.applyMu.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+	return f.geoPrefixes(geoCountries(keys))
+}
+
+// renderGeo queues sets of countries in table of given families
+func (f *Firewall) renderGeo(tx NftTx, t nftTable, keys []string, families []string, keep map[string]bool) {
+	for _, key := range keys {
+		for _, family := range families {
+			addrType := "ipv4_addr"
+			if family == "ip6" {
+				addrType = "ipv6_addr"
+			}
+			name := geoSet(key, family)
+			tx.AddSet(t, nftSet{Name: name, Type: addrType, Interval: true})
+			tx.FlushSet(t, name)
+			tx.AddElements(t, name, f.geoElements(key, family))
+			keep[name] = true
+		}
+	}
+}
+
+func (f *Firewall) geoStart() {
+	f.geoOnce.Do(func() {
+		go f.geoWatch()
+	})
+}
+
+func (f *Firewall) geoWatch() {
+	ticker := time.NewTicker(geoWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.geoUpdate()
+	}
+}
+
+// geoUpdate reloads changed database and replaces elements of country sets
+// in netip and blackhole tables rendered by other version, without full refresh
+func (f *Firewall) geoUpdate() {
+	f.applyMu.Lock()
+	keys := geoKeys(f.desired)
+	if f.bhCountries != "" && !slices.Contains(keys, f.bhCountries) {
+		keys = append(keys, f.bhCountries)
+	}
+	f.applyMu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	if err := f.geoLoad(geoCountries(keys)); err != nil {
+		log.Println("[firewall] geoip update err:", err)
+		return
+	}
+	version := f.geoVersion()
+
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+	tx := f.nft.Begin()
+	updates := 0
+	var tables []nftTable
+	for _, t := range append([]nftTable{f.tableInet, f.tableBH}, f.tablesNat...) {
+		if f.geoApplied[t] != version {
+			tables = append(tables, t)
+		}
+	}
+	for _, t := range tables {
+		sets, err := f.nft.Sets(t)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			for _, family := range []string{"ip", "ip6"} {
+				name := geoSet(key, family)
+				if !slices.Contains(sets, name) {
+					continue
+				}
+				tx.FlushSet(t, name)
+				tx.AddElements(t, name, f.geoElements(key, family))
+				updates++
+			}
+		}
+	}
+	if updates > 0 {
+		if err := tx.Commit(); err != nil {
+			log.Println("[firewall] geoip update sets err:", err)
+			logger.Debug("[firewall] rejected ruleset:\n" + tx.String())
+			return
+		}
+		log.Println("[firewall] geoip updated sets of countries:", strings.Join(keys, " "))
+	}
+	f.geoRendered(version, tables...)
+}
+
+// BlackHoleCountries drops traffic of countries in blackhole table, empty list removes them
+func (f *Firewall) BlackHoleCountries(errs *stepErrors, countries string) {
+	if !f.blackHole.Load() {
+		errs.fail("blackhole is not enabled")
+		return
+	}
+	key := ""
+	if strings.TrimSpace(countries) != "" {
+		var err error
+		if key, err = parseCountries(countries); err != nil {
+			errs.fail("blackhole countries: %s", err)
+			return
+		}
+		if err = f.geoLoad(strings.Split(key, ",")); err != nil {
+			log.Println("[blackhole] countries err:", err)
+			errs.fail("blackhole countries: %s", err)
+			return
+		}
+	}
+
+	version := f.geoVersion()
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+	tx := f.nft.Begin()
+	for _, chain := range []string{"input", "forward"} {
+		rules, _ := f.nft.Rules(f.tableBH, chain)
+		for _, r := range rules {
+			if strings.HasPrefix(r.Set, geoSetPrefix) {
+				tx.DelRule(f.tableBH, chain, r.Handle)
+			}
+		}
+	}
+	keep := map[string]bool{}
+	if key != "" {
+		f.renderGeo(tx, f.tableBH, []string{key}, []string{"ip", "ip6"}, keep)
+		for _, chain := range []string{"input", "forward"} {
+			for _, family := range []string{"ip", "ip6"} {
+				tx.AddRule(f.tableBH, chain, ruleOf(matchAddr{Family: family, Set: geoSet(key, family)},
+					stmtCounter{}, stmtVerdict{Kind: "drop"}))
+			}
+		}
+	}
+	sets, _ := f.nft.Sets(f.tableBH)
+	for _, set := range sets {
+		if strings.HasPrefix(set, geoSetPrefix) && !keep[set] {
+			tx.DelSet(f.tableBH, set)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("[blackhole] countries err:", err)
+		errs.fail("blackhole countries: %s", err)
+		return
+	}
+	log.Printf("[blackhole] countries %q", key)
+	f.bhCountries = key
+	f.geoRendered(version, f.tableBH)
+	if key != "" {
+		f.geoStart()
+	}
+}
+
+// bhCountriesOf restores countries of blackhole by names of its sets
+func bhCountriesOf(sets []string) string {
+	for _, set := range sets {
+		if key, ok := strings.CutPrefix(set, geoSetPrefix+"4-"); ok {
+			return strings.ReplaceAll(key, "-", ",")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// geoTestDB writes minimal ipv4 MaxMind database with countries of networks
+func geoTestDB(t *testing.T, path string, networks map[string]string) {
+	t.Helper()
+
+	var data []byte
+	offsets := map[string]int{}
+	for _, c := range networks {
+		if _, ok := offsets[c]; ok {
+			continue
+		}
+		offsets[c] = len(data)
+		data = append(data, 0xe1, 0x47)
+		data = append(data, "country"...)
+		data = append(data, 0xe1, 0x48)
+		data = append(data, "iso_code"...)
+		data = append(data, 0x42)
+		data = append(data, c...)
+	}
+
+	// records: node index, -1 empty, -2-offset data
+	nodes := [][2]int{{-1, -1}}
+	for cidr, c := range networks {
+		p := netip.MustParsePrefix(cidr)
+		b := p.Addr().As4()
+		node := 0
+		for i := 0; i < p.Bits(); i++ {
+			bit := (b[i/8] >> (7 - i%8)) & 1
+			if i == p.Bits()-1 {
+				nodes[node][bit] = -2 - offsets[c]
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	count := len(nodes)
+	var buf []byte
+	for _, n := range nodes {
+		for _, r := range n {
+			v := r
+			if r == -1 {
+				v = count
+			} else if r < -1 {
+				v = count + 16 + (-2 - r)
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, 0xe3, 0x4a)
+	buf = append(buf, "node_count"...)
+	buf = append(buf, 0xc2, byte(count>>8), byte(count), 0x4b)
+	buf = append(buf, "record_size"...)
+	buf = append(buf, 0xa1, 24, 0x4a)
+	buf = append(buf, "ip_version"...)
+	buf = append(buf, 0xa1, 4)
+
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirewallGeo(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	geoTestDB(t, path, map[string]string{
+		"192.0.2.0/24":    "DE",
+		"198.51.100.0/25": "NL",
+		"203.0.113.0/24":  "US",
+	})
+
+	f := NewFirewall()
+	f.geoPath = path
+	if err := f.geoLoad([]string{"DE", "NL"}); err != nil {
+		t.Fatal(err)
+	}
+	if counts := f.geoPrefixes([]string{"DE", "NL", "US"}); counts["DE"] != 1 || counts["NL"] != 1 || counts["US"] != 0 {
+		t.Fatal("wrong prefixes of countries:", counts)
+	}
+
+	// new version of database reloads loaded countries
+	geoTestDB(t, path, map[string]string{"192.0.2.0/25": "DE", "203.0.113.0/24": "US"})
+	_ = os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err := f.geoLoad([]string{"DE"}); err != nil || f.geoVersion() != 2 {
+		t.Fatal("database is not reloaded:", err, f.geoVersion())
+	}
+	if elements := f.geoElements("DE,NL", "ip"); len(elements) != 1 || elements[0].String() != "192.0.2.0/25" {
+		t.Fatal("wrong elements after reload:", elements)
+	}
+	if err := f.geoLoad([]string{"US"}); err != nil || f.geoVersion() != 2 {
+		t.Fatal("new country changes version:", err, f.geoVersion())
+	}
+}
+
+// geoNft has country sets in every table and records tables of flushed sets
+type geoNft struct {
+	Nft
+	flushed []string
+}
+
+type geoTx struct {
+	NftTx
+	n *geoNft
+}
+
+func (n *geoNft) Sets(t nftTable) ([]string, error) {
+	return []string{"geo4-DE", "geo6-DE"}, nil
+}
+
+func (n *geoNft) Begin() NftTx {
+	return &geoTx{n: n}
+}
+
+func (tx *geoTx) FlushSet(t nftTable, set string) {
+	tx.n.flushed = append(tx.n.flushed, t.String())
+}
+
+func (tx *geoTx) AddElements(t nftTable, set string, elements []nftElement) {}
+
+func (tx *geoTx) Commit() error {
+	return nil
+}
+
+func TestFirewallGeoUpdate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	geoTestDB(t, path, map[string]string{"192.0.2.0/24": "DE"})
+	f := NewFirewall()
+	f.geoPath = path
+	f.desired = []FirewallRules{{Countries: "DE", Target: "accept"}}
+	f.bhCountries = "DE"
+	if err := f.geoLoad([]string{"DE"}); err != nil {
+		t.Fatal(err)
+	}
+	f.geoRendered(f.geoVersion(), append([]nftTable{f.tableInet, f.tableBH}, f.tablesNat...)...)
+
+	// refresh reloads new database and renders own tables only
+	geoTestDB(t, path, map[string]string{"192.0.2.0/25": "DE"})
+	_ = os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err := f.geoLoad([]string{"DE"}); err != nil {
+		t.Fatal(err)
+	}
+	f.geoRendered(f.geoVersion(), append([]nftTable{f.tableInet}, f.tablesNat...)...)
+
+	n := &geoNft{}
+	f.nft = n
+	f.geoUpdate()
+	if !slices.Equal(n.flushed, []string{f.tableBH.String(), f.tableBH.String()}) {
+		t.Fatal("sets of blackhole are not updated:", n.flushed)
+	}
+	n.flushed = nil
+	if f.geoUpdate(); len(n.flushed) != 0 {
+		t.Fatal("updated sets are replaced again:", n.flushed)
+	}
+}
+
+func TestParseCountries(t *testing.T) {
+	t.Parallel()
+
+	if countries, err := parseCountries(" nl, de,NL,"); err != nil || countries != "DE,NL" {
+		t.Fatal("wrong countries:", countries, err)
+	}
+	for _, s := range []string{"", " , ", "DEU", "D1", "DE;NL"} {
+		if _, err := parseCountries(s); err == nil {
+			t.Fatalf("invalid countries %q passed", s)
+		}
+	}
+
+	var codes []string
+	for i := range geoCountriesMax + 1 {
+		codes = append(codes, string([]byte{'A' + byte(i/26), 'A' + byte(i%26)}))
+	}
+	if _, err := parseCountries(strings.Join(codes, ",")); err == nil {
+		t.Fatal("too many countries passed")
+	}
+	countries, err := parseCountries(strings.Join(codes[:geoCountriesMax], ","))
+	if err != nil || len(geoSet(countries, "ip6")) > 255 {
+		t.Fatal("name of set is over limit:", err, geoSet(countries, "ip6"))
+	}
+
+	if key := bhCountriesOf([]string{"IPv4", "geo6-DE-NL", "geo4-DE-NL"}); key != "DE,NL" {
+		t.Fatal("wrong countries of sets:", key)
+	}
+	if !slices.Equal(geoCountries([]string{"DE,NL", "NL,US"}), []string{"DE", "NL", "US"}) {
+		t.Fatal("wrong distinct countries")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rules with expiresAt or cron schedule are active only in their time window,
+// source of such rule is matched by set element with timeout, set is named by index
+// of rule: expire4-0, so the kernel closes access in time even without agent,
+// scheduler re-applies the ruleset on transitions, expired rule stays inactive
+// till the control plane removes it
+
+const (
+	expireSetPrefix = "expire"
+	scheduleTick    = 5 * time.Second
+	scheduleForMax  = 7 * 24 * time.Hour
+)
+
+type FirewallSchedule struct {
+	Id     string    `json:"id"`
+	Rule   int       `json:"rule"`
+	Active bool      `json:"active"`
+	Reason string    `json:"reason"` // expired, schedule
+	Error  string    `json:"error"`
+	At     time.Time `json:"at"`
+}
+
+// ruleWindow state of rule at the moment, until is zero for rule without time limits
+type ruleWindow struct {
+	active bool
+	until  time.Time
+}
+
+// cronSpec 5 fields cron expression: minute hour day-of-month month day-of-week,
+// in local time of the node
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses "*/15 22-23,0-5 * * 1-5", lists, ranges and steps
+func parseCron(s string) (*cronSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return nil, errors.New("cron needs 5 fields: minute hour day month weekday")
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		if bits[i], err = cronField(field, cronFields[i].min, cronFields[i].max); err != nil {
+			return nil, fmt.Errorf("%s %q: %w", cronFields[i].name, field, err)
+		}
+	}
+	spec := &cronSpec{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	// sunday is 0 or 7
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	return spec, nil
+}
+
+func cronField(s string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 || step > hi {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		from, to := lo, hi
+		if expr != "*" {
+			fromStr, toStr, isRange := strings.Cut(expr, "-")
+			var err error
+			if from, err = cronValue(fromStr, lo, hi); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = cronValue(toStr, lo, hi); err != nil {
+					return 0, err
+				}
+				if from > to {
+					return 0, fmt.Errorf("invalid range %s", expr)
+				}
+			} else if hasStep {
+				to = hi
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, lo, hi int) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < lo || v > hi || strings.HasPrefix(s, "+") {
+		return 0, fmt.Errorf("value %q is out of %d-%d", s, lo, hi)
+	}
+	return v, nil
+}
+
+// match minute of time
+func (c *cronSpec) match(t time.Time) bool {
+	return c.minute&(1<<t.Minute()) != 0 && c.hour&(1<<t.Hour()) != 0 && c.matchDay(t)
+}
+
+// matchDay month and day of time, day matches by any of day fields when both are restricted
+func (c *cronSpec) matchDay(t time.Time) bool {
+	if c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// activeUntil end of the latest window started within duration before now, zero when inactive,
+// days and hours without match are skipped at once
+func (c *cronSpec) activeUntil(now time.Time, duration time.Duration) time.Time {
+	for t := now.Truncate(time.Minute); now.Sub(t) < duration; {
+		switch {
+		case !c.matchDay(t):
+			t = t.Add(-time.Duration(t.Hour()*60+t.Minute()+1) * time.Minute)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Add(-time.Duration(t.Minute()+1) * time.Minute)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(-time.Minute)
+		default:
+			return t.Add(duration)
+		}
+	}
+	return time.Time{}
+}
+
+// window of rule at the moment, schedule and expiration are validated before
+func (r *FirewallRules) window(now time.Time) ruleWindow {
+	w := ruleWindow{active: true}
+	if r.Schedule != "" {
+		// parsed by validation, parsed here only for rules not passed through it
+		spec, duration := r.cron, r.scheduleFor
+		if spec == nil {
+			spec, _ = parseCron(r.Schedule)
+			duration, _ = time.ParseDuration(r.ScheduleFor)
+		}
+		if w.until = spec.activeUntil(now, duration); w.until.IsZero() {
+			return ruleWindow{}
+		}
+	}
+	if !r.ExpiresAt.IsZero() {
+		if !now.Before(r.ExpiresAt) {
+			return ruleWindow{}
+		}
+		if w.until.IsZero() || r.ExpiresAt.Before(w.until) {
+			w.until = r.ExpiresAt
+		}
+	}
+	// comparable between ticks, without monotonic clock and zone
+	w.until = w.until.UTC()
+	return w
+}
+
+// scheduleRules active rules at the moment, ones with plain source get expire set,
+// states of all rules are kept to find transitions
+func (f *Firewall) scheduleRules(rules []FirewallRules, now time.Time) ([]FirewallRules, []ruleWindow) {
+	active := make([]FirewallRules, 0, len(rules))
+	states := make([]ruleWindow, len(rules))
+	for i, e := range rules {
+		states[i] = e.window(now)
+		if !states[i].active {
+			continue
+		}
+		e.index = i
+		if !states[i].until.IsZero() && e.Source != "" && !isHostname(e.Source) {
+			e.until = states[i].until
+			suffix := "4"
+			if f.verIp(e.Source) == "ip6" {
+				suffix = "6"
+			}
+			e.expireSet = fmt.Sprintf("%s%s-%d", expireSetPrefix, suffix, e.index)
+		}
+		active = append(active, e)
+	}
+	return active, states
+}
+
+// renderExpire queues sets of expiring sources of given family, element lives till the end of window
+func (f *Firewall) renderExpire(tx NftTx, t nftTable, rules []FirewallRules, families []string,
+	now time.Time, keep map[string]bool) {
+	for _, e := range rules {
+		family := f.verIp(e.Source)
+		if e.expireSet == "" || !slices.Contains(families, family) {
+			continue
+		}
+		addrType := "ipv4_addr"
+		if family == "ip6" {
+			addrType = "ipv6_addr"
+		}
+		tx.AddSet(t, nftSet{Name: e.expireSet, Type: addrType, Interval: true, Timeouts: true})
+		tx.FlushSet(t, e.expireSet)
+		tx.AddElements(t, e.expireSet, expireElements(e, now))
+		keep[e.expireSet] = true
+	}
+}
+
+// expireElements source of rule living till the end of its window
+func expireElements(e FirewallRules, now time.Time) []nftElement {
+	prefix, _ := parsePrefix(e.Source)
+	return []nftElement{{Prefix: prefix, Timeout: max(e.until.Sub(now), time.Second)}}
+}
+
+// scheduleExtend replaces elements of expire sets by moved windows, rules themselves are the same
+func (f *Firewall) scheduleExtend(now time.Time) error {
+	active, _ := f.scheduleRules(f.desired, now)
+	tx := f.nft.Begin()
+	updates := 0
+	for _, t := range append([]nftTable{f.tableInet}, f.tablesNat...) {
+		sets, err := f.nft.Sets(t)
+		if err != nil {
+			continue
+		}
+		for _, e := range active {
+			if e.expireSet == "" || !slices.Contains(sets, e.expireSet) {
+				continue
+			}
+			if t != f.tableInet && f.verIp(e.Source) != t.Family {
+				continue
+			}
+			tx.FlushSet(t, e.expireSet)
+			tx.AddElements(t, e.expireSet, expireElements(e, now))
+			updates++
+		}
+	}
+	if updates == 0 {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Debug("[firewall] rejected ruleset:\n" + tx.String())
+		return err
+	}
+	return nil
+}
+
+func (f *Firewall) scheduleStart() {
+	f.scheduleOnce.Do(func() {
+		go f.scheduleWatch()
+	})
+}
+
+func (f *Firewall) scheduleWatch() {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, fs := range f.scheduleUpdate(time.Now()) {
+			f.scheduleEvent(fs)
+		}
+	}
+}
+
+// scheduleUpdate re-applies desired rules when some of them are switched on or off,
+// moved window of active one only extends its expire set, returns transitions of rules
+func (f *Firewall) scheduleUpdate(now time.Time) []*FirewallSchedule {
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+
+	// disabled or not applied yet, and pending confirm has its own rollback
+	if f.baseline == nil || f.confirmPending() {
+		return nil
+	}
+	_, states := f.scheduleRules(f.desired, now)
+	if slices.Equal(states, f.scheduleState) {
+		return nil
+	}
+
+	var transitions []*FirewallSchedule
+	for i, e := range f.desired {
+		if i >= len(f.scheduleState) || states[i].active == f.scheduleState[i].active {
+			continue
+		}
+		reason := "schedule"
+		if !states[i].active && !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt) {
+			reason = "expired"
+		}
+		transitions = append(transitions, &FirewallSchedule{
+			Id:     e.Id,
+			Rule:   i,
+			Active: states[i].active,
+			Reason: reason,
+			At:     now.UTC(),
+		})
+		log.Printf("[firewall] rule #%d %q %s, active: %t", i, e.Id, reason, states[i].active)
+	}
+
+	if len(transitions) == 0 {
+		err := f.scheduleExtend(now)
+		if err == nil {
+			f.scheduleState = states
+			return nil
+		}
+		log.Println("[firewall] extend expire sets err:", err)
+	}
+	if err := f.apply(f.desired, f.trusted, f.egressPolicy, 0); err != nil {
+		for _, fs := range transitions {
+			fs.Error = err.Error()
+		}
+	}
+	return transitions
+}
+
+// scheduled rules with time limits
+func scheduled(rules []FirewallRules) bool {
+	return slices.ContainsFunc(rules, func(e FirewallRules) bool {
+		return e.Schedule != "" || !e.ExpiresAt.IsZero()
+	})
+}
+
+// validateSchedule checks schedule window of rule and keeps its parsed cron,
+// expired rule is valid, it is just inactive
+func (r *FirewallRules) validateSchedule() error {
+	r.cron, r.scheduleFor = nil, 0
+	r.Schedule = strings.Join(strings.Fields(r.Schedule), " ")
+	r.ScheduleFor = strings.TrimSpace(r.ScheduleFor)
+	if r.Schedule == "" {
+		if r.ScheduleFor != "" {
+			return errors.New("scheduleFor without schedule")
+		}
+		return nil
+	}
+	spec, err := parseCron(r.Schedule)
+	if err != nil {
+		return fmt.Errorf("schedule %q: %w", r.Schedule, err)
+	}
+	duration, err := time.ParseDuration(r.ScheduleFor)
+	if err != nil || duration < time.Minute || duration > scheduleForMax {
+		return fmt.Errorf("scheduleFor %q must be a duration from 1m to %s", r.ScheduleFor, scheduleForMax)
+	}
+	r.cron, r.scheduleFor = spec, duration
+	return nil
+}
+
+// scheduleExpired rules which are already expired at refresh, they are not rendered
+func scheduleExpired(rules []FirewallRules, now time.Time) []*FirewallSchedule {
+	var expired []*FirewallSchedule
+	for i, e := range rules {
+		if !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt) {
+			log.Printf("[firewall] rule #%d %q is expired, skipped", i, e.Id)
+			expired = append(expired, &FirewallSchedule{Id: e.Id, Rule: i, Reason: "expired", At: now.UTC()})
+		}
+	}
+	return expired
+}
+
+func (f *Firewall) scheduleEvent(fs *FirewallSchedule) {
+	f.event(&struct {
+		Event            string            `json:"event"`
+		FirewallSchedule *FirewallSchedule `json:"firewallSchedule"`
+	}{
+		Event:            "firewall-schedule",
+		FirewallSchedule: fs,
+	})
+}
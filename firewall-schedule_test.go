@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	t.Parallel()
+
+	spec, err := parseCron("*/15 22-23,0-5 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for at, want := range map[string]bool{
+		"2026-10-16T22:30:00Z": true,  // friday
+		"2026-10-16T22:31:00Z": false, // not a step
+		"2026-10-17T01:00:00Z": false, // saturday
+		"2026-10-19T05:45:00Z": true,  // monday
+		"2026-10-19T06:00:00Z": false,
+	} {
+		tm, _ := time.Parse(time.RFC3339, at)
+		if spec.match(tm) != want {
+			t.Fatalf("match %s is not %t", at, want)
+		}
+	}
+
+	// both days restricted match by any of them, sunday as 7
+	spec, _ = parseCron("0 0 1 * 7")
+	if !spec.match(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)) || !spec.match(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("day of month or week is not matched")
+	}
+
+	for _, s := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *",
+		"*/0 * * * *", "a * * * *", "* * * * * *", "+1 * * * *"} {
+		if _, err := parseCron(s); err == nil {
+			t.Fatalf("invalid cron %q passed", s)
+		}
+	}
+}
+
+func TestCronActiveUntil(t *testing.T) {
+	t.Parallel()
+
+	// skipping of days and hours finds the same window as walking every minute back
+	naive := func(c *cronSpec, now time.Time, duration time.Duration) time.Time {
+		for m := now.Truncate(time.Minute); now.Sub(m) < duration; m = m.Add(-time.Minute) {
+			if c.match(m) {
+				return m.Add(duration)
+			}
+		}
+		return time.Time{}
+	}
+	now := time.Date(2026, 10, 17, 23, 10, 20, 0, time.UTC)
+	for _, cron := range []string{"0 22 * * *", "*/15 8-17 * * 1-5", "30 6 1 * 0", "0 0 1 1 *", "59 * * * *"} {
+		spec, _ := parseCron(cron)
+		for _, duration := range []time.Duration{time.Minute, 90 * time.Minute, 8 * time.Hour, scheduleForMax} {
+			for _, at := range []time.Time{now, now.Add(-11 * time.Hour), now.Add(50 * time.Hour)} {
+				if got, want := spec.activeUntil(at, duration), naive(spec, at, duration); !got.Equal(want) {
+					t.Fatalf("%q for %s at %s: %s, not %s", cron, duration, at, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFirewallSchedule(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 17, 23, 10, 20, 0, time.UTC)
+	rules := []FirewallRules{
+		{Id: "contractor", Protocol: "tcp", Source: "203.0.113.7", Ports: "5432", Target: "accept",
+			ExpiresAt: now.Add(4 * time.Hour)},
+		{Id: "night", Source: "2001:db8::/32", Target: "accept", Schedule: "0 22 * * *", ScheduleFor: "8h"},
+		{Id: "day", Source: "198.51.100.0/24", Target: "accept", Schedule: "0 8 * * 1-5", ScheduleFor: "10h"},
+		{Id: "gone", Source: "192.0.2.1", Target: "accept", ExpiresAt: now.Add(-time.Second)},
+		{Id: "any", Protocol: "tcp", Ports: "80", Target: "accept", ExpiresAt: now.Add(time.Hour)},
+	}
+
+	f := NewFirewall()
+	active, states := f.scheduleRules(rules, now)
+	if len(active) != 3 || active[0].Id != "contractor" || active[1].Id != "night" || active[2].Id != "any" {
+		t.Fatal("wrong active rules:", active)
+	}
+	if !states[1].until.Equal(time.Date(2026, 10, 18, 6, 0, 0, 0, time.UTC)) || states[2].active || states[3].active {
+		t.Fatal("wrong states:", states)
+	}
+	if active[2].expireSet != "" {
+		t.Fatal("rule without source got expire set")
+	}
+
+	// sets are named by rules, switch of other rule does not rename them
+	active, _ = f.scheduleRules(rules, now.Add(5*time.Hour))
+	if len(active) != 1 || active[0].Id != "night" || active[0].expireSet != "expire6-1" {
+		t.Fatal("wrong active rules after expiration:", active)
+	}
+
+	// meters of other rules keep their sets when scheduled rule is switched
+	limited := []FirewallRules{rules[2], {Id: "web", Protocol: "tcp", Ports: "443", Target: "accept", RateLimit: 10}}
+	for n, at := range []time.Time{now, now.Add(34 * time.Hour)} {
+		if active, _ = f.scheduleRules(limited, at); len(active) != n+1 {
+			t.Fatal("scheduled rule is not switched:", active)
+		}
+		tx := f.nft.Begin()
+		f.render(tx, active, liveState{}, at)
+		checkScript(t, tx, "add set inet netip limit-rate4-1 { type ipv4_addr; size 65535; flags dynamic,timeout; timeout 1m; }")
+	}
+
+	for _, e := range []FirewallRules{
+		{Target: "accept", Schedule: "0 22 * * *"},
+		{Target: "accept", Schedule: "0 22 * * *", ScheduleFor: "30s"},
+		{Target: "accept", Schedule: "0 22 * * *", ScheduleFor: "200h"},
+		{Target: "accept", Schedule: "0 25 * * *", ScheduleFor: "1h"},
+		{Target: "accept", ScheduleFor: "1h"},
+	} {
+		if err := e.validate(); err == nil {
+			t.Fatalf("invalid schedule passed: %+v", e)
+		}
+	}
+}
+
+func TestFirewallRefreshExpired(t *testing.T) {
+	t.Parallel()
+
+	// expired rule stays in ruleset of control plane and does not reject others
+	n := &refreshNft{}
+	f := NewFirewall()
+	f.nft = n
+	f.countersInterval, f.driftInterval, f.dropGroup = 0, 0, 0
+	f.scheduleOnce.Do(func() {})
+	events := make(chan any, 1)
+	f.SetChanEvent(events)
+	rules := []FirewallRules{
+		{Id: "contractor", Protocol: "tcp", Source: "203.0.113.7", Ports: "5432", Target: "accept",
+			ExpiresAt: time.Now().Add(-time.Minute)},
+		{Id: "ssh", Protocol: "tcp", Ports: "22", Target: "accept"},
+	}
+	steps := &stepErrors{}
+	f.Refresh(steps, rules, nil, "", 0)
+	if errs := steps.Errors(); errs != nil {
+		t.Fatal("refresh failed:", errs)
+	}
+	script := checkScript(t, n.tx.NftTx, "add rule inet netip input meta l4proto tcp tcp dport 22 counter accept comment \"ssh\"")
+	if strings.Contains(script, "contractor") || len(f.desired) != 2 {
+		t.Fatalf("expired rule is rendered or not kept:\n%s", script)
+	}
+	select {
+	case ev := <-events:
+		if fs := ev.(*struct {
+			Event            string            `json:"event"`
+			FirewallSchedule *FirewallSchedule `json:"firewallSchedule"`
+		}).FirewallSchedule; fs.Id != "contractor" || fs.Reason != "expired" || fs.Active {
+			t.Fatal("wrong event:", fs)
+		}
+	default:
+		t.Fatal("no event of expired rule")
+	}
+}
+
+// scheduleNft has expire set in every table and records its elements, full apply is not expected
+type scheduleNft struct {
+	Nft
+	elements []string
+}
+
+type scheduleTx struct {
+	NftTx
+	n *scheduleNft
+}
+
+func (n *scheduleNft) Sets(t nftTable) ([]string, error) {
+	return []string{"expire4-0"}, nil
+}
+
+func (n *scheduleNft) Begin() NftTx {
+	return &scheduleTx{n: n}
+}
+
+func (tx *scheduleTx) FlushSet(t nftTable, set string) {}
+
+func (tx *scheduleTx) AddElements(t nftTable, set string, elements []nftElement) {
+	for _, e := range elements {
+		tx.n.elements = append(tx.n.elements, fmt.Sprintf("%s %s %s", t, e.Prefix, e.Timeout))
+	}
+}
+
+func (tx *scheduleTx) Commit() error {
+	return nil
+}
+
+func TestFirewallScheduleExtend(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 17, 10, 0, 0, 0, time.Local)
+	n := &scheduleNft{}
+	f := NewFirewall()
+	f.nft = n
+	f.desired = []FirewallRules{{Id: "office", Source: "203.0.113.7", Target: "accept", Schedule: "* 8-17 * * *", ScheduleFor: "1h"}}
+	_, f.scheduleState = f.scheduleRules(f.desired, now)
+	f.baseline = map[string]int{}
+
+	// window moves every minute while rule stays active
+	if transitions := f.scheduleUpdate(now.Add(time.Minute)); len(transitions) != 0 {
+		t.Fatal("transition without switch:", transitions)
+	}
+	want := []string{"inet netip 203.0.113.7/32 1h0m0s", "ip nat 203.0.113.7/32 1h0m0s"}
+	if !slices.Equal(n.elements, want) {
+		t.Fatal("wrong extended elements:", n.elements)
+	}
+	if !f.scheduleState[0].until.Equal(now.Add(time.Hour + time.Minute)) {
+		t.Fatal("window is not kept:", f.scheduleState)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"netip-network/collector"
+	"os"
+	"strings"
+	"time"
+)
+
+// syn flood protection of chosen ports in own table netip-synproxy:
+// syn is not tracked in raw prerouting, synproxy answers it by cookie
+// and opens connection to socket only after valid ack
+
+const (
+	synproxyCommentPass = "synproxy"
+	synproxyCommentDrop = "synproxy/invalid"
+)
+
+// synproxyOptions announced to clients per family: mss by mtu 1500
+var synproxyOptions = map[string]stmtSynproxy{
+	"ip":  {Mss: 1460, Wscale: 7},
+	"ip6": {Mss: 1440, Wscale: 7},
+}
+
+func (f *Firewall) SetChanSynproxyCounter(counter chan<- *collector.SynproxyCounter) {
+	f.synproxyCounter = counter
+}
+
+// SynproxyEnable protects ports, already enabled table with other ports is replaced
+func (f *Firewall) SynproxyEnable(errs *stepErrors, ports string) {
+	if strings.TrimSpace(ports) == "" {
+		errs.fail("synproxy: ports are required")
+		return
+	}
+	ports, err := parsePorts(ports)
+	if err != nil {
+		errs.fail("synproxy ports: %s", err)
+		return
+	}
+
+	f.synproxyMu.Lock()
+	defer f.synproxyMu.Unlock()
+	if f.synproxy && f.synproxyPorts == ports {
+		return
+	}
+
+	log.Println("[synproxy] enabling, ports:", ports)
+	tx := f.nft.Begin()
+	if f.nft.TableExists(f.tableSynproxy) {
+		tx.DelTable(f.tableSynproxy)
+	}
+	f.renderSynproxy(tx, ports)
+	if err := tx.Commit(); err != nil {
+		log.Println("[synproxy] init err:", err)
+		logger.Debug("[synproxy] rejected ruleset:\n" + tx.String())
+		errs.fail("synproxy init: %s", err)
+		return
+	}
+	f.synproxyPorts = ports
+	synproxyNotice()
+
+	if !f.synproxy {
+		f.synproxy = true
+		f.synproxyStopper = make(chan bool, 1)
+		go f.synproxyStatsCollect(f.synproxyStopper)
+	}
+}
+
+func (f *Firewall) renderSynproxy(tx NftTx, ports string) {
+	t := f.tableSynproxy
+	dports, _ := portRanges(ports)
+	dport := matchPort{Proto: "tcp", Dst: true, Ports: dports}
+	tcp := matchL4proto{Protos: []string{"tcp"}}
+
+	tx.AddTable(t)
+	tx.AddChain(t, nftChain{Name: "prerouting", Type: "filter", Hook: "prerouting", Priority: -300, Policy: "accept"})
+	tx.AddRule(t, "prerouting", ruleOf(tcp, dport, matchTcpSyn{}, stmtNotrack{}))
+
+	// after blackhole, before netip input
+	tx.AddChain(t, nftChain{Name: "input", Type: "filter", Hook: "input", Priority: -100, Policy: "accept"})
+	untracked := matchCtState{States: []string{"invalid", "untracked"}}
+	for _, family := range []string{"ip", "ip6"} {
+		tx.AddRule(t, "input", ruleOf(matchNfproto{Family: family}, tcp, dport, untracked, stmtCounter{},
+			synproxyOptions[family]).commented(synproxyCommentPass))
+	}
+	tx.AddRule(t, "input", ruleOf(tcp, dport, matchCtState{States: []string{"invalid"}}, stmtCounter{},
+		stmtVerdict{Kind: "drop"}).commented(synproxyCommentDrop))
+}
+
+// synproxyNotice conntrack picks up connections by ack in loose mode, synproxy is bypassed then
+func synproxyNotice() {
+	loose, err := os.ReadFile("/proc/sys/net/netfilter/nf_conntrack_tcp_loose")
+	if err == nil && strings.TrimSpace(string(loose)) != "0" {
+		log.Println("[synproxy] notice: net.netfilter.nf_conntrack_tcp_loose should be 0")
+	}
+}
+
+// SynproxyRestore picks up table left by previous run, ports are set by next enable
+func (f *Firewall) SynproxyRestore() {
+	if !f.nft.TableExists(f.tableSynproxy) {
+		return
+	}
+	f.synproxyMu.Lock()
+	defer f.synproxyMu.Unlock()
+	if f.synproxy {
+		return
+	}
+	log.Println("[synproxy] restoring from nft")
+	f.synproxy = true
+	f.synproxyStopper = make(chan bool, 1)
+	go f.synproxyStatsCollect(f.synproxyStopper)
+}
+
+func (f *Firewall) SynproxyDisable(errs *stepErrors) {
+	f.synproxyMu.Lock()
+	defer f.synproxyMu.Unlock()
+	if f.synproxy {
+		f.synproxyStopper <- true
+		f.synproxy = false
+		f.synproxyPorts = ""
+	}
+
+	if f.nft.TableExists(f.tableSynproxy) {
+		log.Println("[synproxy] destroying")
+		tx := f.nft.Begin()
+		tx.DelTable(f.tableSynproxy)
+		if err := tx.Commit(); err != nil {
+			log.Println("[synproxy] destroy err:", err)
+			errs.fail("synproxy destroy: %s", err)
+		}
+	}
+}
+
+func (f *Firewall) synproxyStatsCollect(stopper chan bool) {
+	ticker := time.NewTicker(time.Second / 100)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(30 * time.Second)
+			spc, err := f.synproxyStats()
+			if err != nil || f.synproxyCounter == nil {
+				continue
+			}
+			f.synproxyCounter <- spc
+		case <-stopper:
+			return
+		}
+	}
+}
+
+// synproxyStats counters of proxied and dropped packets of protected ports
+func (f *Firewall) synproxyStats() (*collector.SynproxyCounter, error) {
+	rules, err := f.nft.Rules(f.tableSynproxy, "input")
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("synproxy rules not exist")
+	}
+	f.synproxyMu.Lock()
+	spc := &collector.SynproxyCounter{Ports: f.synproxyPorts}
+	f.synproxyMu.Unlock()
+	for _, r := range rules {
+		switch r.Comment {
+		case synproxyCommentPass:
+			spc.Passed.Packets += int(r.Packets)
+			spc.Passed.Bytes += int(r.Bytes)
+		case synproxyCommentDrop:
+			spc.Dropped.Packets += int(r.Packets)
+			spc.Dropped.Bytes += int(r.Bytes)
+		}
+	}
+	return spc, nil
+}
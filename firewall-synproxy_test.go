@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"strings"
+	"testing"
+)
+
+func TestFirewallRenderSynproxy(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	tx := f.nft.Begin()
+	f.renderSynproxy(tx, "80, 443")
+	checkScript(t, tx,
+		"add chain inet netip-synproxy prerouting { type filter hook prerouting priority -300; policy accept; }",
+		"add rule inet netip-synproxy prerouting meta l4proto tcp tcp dport { 80, 443 } tcp flags & (syn | ack) == syn notrack",
+		"add rule inet netip-synproxy input meta nfproto ipv4 meta l4proto tcp tcp dport { 80, 443 } ct state invalid,untracked "+
+			"counter synproxy mss 1460 wscale 7 timestamp sack-perm comment \"synproxy\"",
+		"add rule inet netip-synproxy input meta nfproto ipv6 meta l4proto tcp tcp dport { 80, 443 } ct state invalid,untracked "+
+			"counter synproxy mss 1440 wscale 7 timestamp sack-perm comment \"synproxy\"",
+		"add rule inet netip-synproxy input meta l4proto tcp tcp dport { 80, 443 } ct state invalid "+
+			"counter drop comment \"synproxy/invalid\"",
+	)
+
+	// family is matched at the front, so each packet is counted by one rule only
+	for line, proto := range map[string]byte{
+		"add rule inet netip-synproxy input meta nfproto ipv4 meta l4proto tcp tcp dport { 80, 443 } ct state invalid,untracked " +
+			"counter synproxy mss 1460 wscale 7 timestamp sack-perm comment \"synproxy\"": unix.NFPROTO_IPV4,
+		"add rule inet netip-synproxy input meta nfproto ipv6 meta l4proto tcp tcp dport { 80, 443 } ct state invalid,untracked " +
+			"counter synproxy mss 1440 wscale 7 timestamp sack-perm comment \"synproxy\"": unix.NFPROTO_IPV6,
+	} {
+		exprs := ruleExprs(t, tx, line)
+		meta, _ := exprs[0].(*expr.Meta)
+		cmp, _ := exprs[1].(*expr.Cmp)
+		if meta == nil || meta.Key != expr.MetaKeyNFPROTO || cmp == nil || !bytes.Equal(cmp.Data, []byte{proto}) {
+			t.Fatalf("rule does not start with family match: %s", line)
+		}
+		for _, e := range exprs[2:] {
+			if m, ok := e.(*expr.Meta); ok && m.Key == expr.MetaKeyNFPROTO {
+				t.Fatalf("family is matched again: %s", line)
+			}
+		}
+		if !hasExpr(exprs, func(e *expr.SynProxy) bool { return e.Mss > 0 && e.Wscale == 7 }) {
+			t.Fatalf("rule has no synproxy: %s", line)
+		}
+	}
+
+	steps := &stepErrors{}
+	f.SynproxyEnable(steps, "80, http")
+	if errs := steps.Errors(); len(errs) != 1 || !strings.Contains(errs[0], "synproxy ports") {
+		t.Fatal("invalid ports passed:", errs)
+	}
+}
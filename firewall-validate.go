@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	fwProtocols = map[string]struct{}{"": {}, "tcp": {}, "udp": {}, "icmp": {}}
+	fwTargets   = map[string]struct{}{"accept": {}, "drop": {}, "reject": {}}
+	fwLimitMax  = 1_000_000
+	ruleIdReg   = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,64}$`)
+	ifnameReg   = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,15}$|^[a-zA-Z0-9_.@-]{1,14}\*$`)
+)
+
+// validate checks fields of the rule against allowlists and normalizes them,
+// nothing from the rule reaches nft without passing here
+func (r *FirewallRules) validate() error {
+	r.Id = strings.TrimSpace(r.Id)
+	if r.Id != "" && !ruleIdReg.MatchString(r.Id) {
+		return fmt.Errorf("id %q is not allowed", r.Id)
+	}
+
+	r.Protocol = strings.ToLower(strings.TrimSpace(r.Protocol))
+	if _, ok := fwProtocols[r.Protocol]; !ok {
+		return fmt.Errorf("protocol %q is not allowed", r.Protocol)
+	}
+
+	r.Target = strings.ToLower(strings.TrimSpace(r.Target))
+	if _, ok := fwTargets[r.Target]; !ok {
+		return fmt.Errorf("target %q is not allowed", r.Target)
+	}
+
+	r.Direction = strings.ToLower(strings.TrimSpace(r.Direction))
+	if r.Direction == "" {
+		r.Direction = "in"
+	}
+	if r.Direction != "in" && r.Direction != "out" {
+		return fmt.Errorf("direction %q is not allowed", r.Direction)
+	}
+
+	if strings.TrimSpace(r.Source) != "" {
+		source, err := parsePrefix(r.Source)
+		if err == nil {
+			r.Source = prefixString(source)
+		} else if host, errHost := parseHostname(r.Source); errHost == nil {
+			r.Source = host
+		} else {
+			return fmt.Errorf("source %q: %w", r.Source, errHost)
+		}
+	} else {
+		r.Source = ""
+	}
+
+	if strings.TrimSpace(r.Destination) != "" {
+		destination, err := parsePrefix(r.Destination)
+		if err != nil {
+			return fmt.Errorf("destination %q: %w", r.Destination, err)
+		}
+		r.Destination = prefixString(destination)
+		if source, err := parsePrefix(r.Source); err == nil && source.Addr().Is4() != destination.Addr().Is4() {
+			return errors.New("source and destination of different ip versions")
+		}
+	} else {
+		r.Destination = ""
+	}
+
+	if r.Direction == "out" && strings.TrimSpace(r.Ports) != "" {
+		return errors.New("ports of outbound rule, use destinationPorts")
+	}
+	if r.Direction == "in" && strings.TrimSpace(r.DestinationPorts) != "" {
+		return errors.New("destinationPorts of inbound rule, use ports")
+	}
+	if strings.TrimSpace(r.DestinationPorts) != "" {
+		if r.Protocol == "icmp" {
+			return errors.New("ports are not allowed for icmp")
+		}
+		ports, err := parsePorts(r.DestinationPorts)
+		if err != nil {
+			return fmt.Errorf("destinationPorts %q: %w", r.DestinationPorts, err)
+		}
+		r.DestinationPorts = ports
+	} else {
+		r.DestinationPorts = ""
+	}
+	if strings.TrimSpace(r.Countries) != "" {
+		if r.Source != "" {
+			return errors.New("countries and source together")
+		}
+		countries, err := parseCountries(r.Countries)
+		if err != nil {
+			return fmt.Errorf("countries %q: %w", r.Countries, err)
+		}
+		r.Countries = countries
+		if r.NatOutput {
+			return errors.New("natOutput is not allowed for countries")
+		}
+	} else {
+		r.Countries = ""
+	}
+	if r.NatOutput && isHostname(r.Source) {
+		return errors.New("natOutput is not allowed for hostname source")
+	}
+	if r.Direction == "out" && r.NatOutput {
+		return errors.New("natOutput is not allowed for outbound rule")
+	}
+
+	if strings.TrimSpace(r.Ports) != "" {
+		if r.Protocol == "icmp" {
+			return errors.New("ports are not allowed for icmp")
+		}
+		ports, err := parsePorts(r.Ports)
+		if err != nil {
+			return fmt.Errorf("ports %q: %w", r.Ports, err)
+		}
+		r.Ports = ports
+	} else {
+		r.Ports = ""
+	}
+
+	if err := r.validateSchedule(); err != nil {
+		return err
+	}
+	return r.validateLimits()
+}
+
+// validateLimits limits make sense only for accepted traffic
+func (r *FirewallRules) validateLimits() error {
+	if r.RateLimit < 0 || r.RateBurst < 0 || r.ConnLimit < 0 || r.SynLimit < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if r.RateLimit > fwLimitMax || r.RateBurst > fwLimitMax || r.ConnLimit > fwLimitMax || r.SynLimit > fwLimitMax {
+		return fmt.Errorf("limits can't be over %d", fwLimitMax)
+	}
+	if r.RateLimit+r.ConnLimit+r.SynLimit > 0 && r.Direction == "out" {
+		return errors.New("limits are not allowed for outbound rule")
+	}
+	if r.RateBurst > 0 && r.RateLimit == 0 {
+		return errors.New("rate burst without rate limit")
+	}
+	if r.RateLimit+r.ConnLimit+r.SynLimit > 0 && r.Target != "accept" {
+		return errors.New("limits are allowed only for accept target")
+	}
+	if r.SynLimit > 0 && r.Protocol != "tcp" {
+		return errors.New("syn limit is allowed only for tcp")
+	}
+	return nil
+}
+
+// parsePrefix parses ip or cidr v4/v6 into masked prefix
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, errors.New("not an ip or cidr")
+		}
+		if p.Addr().Is4In6() {
+			return netip.Prefix{}, errors.New("ipv4-mapped cidr is not allowed")
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil || a.Zone() != "" {
+		return netip.Prefix{}, errors.New("not an ip or cidr")
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// prefixString formats prefix as nft shows set elements, single ip without length
+func prefixString(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+// parsePorts parses list of ports and ranges: "22, 80, 8000-8080"
+func parsePorts(s string) (string, error) {
+	ranges, err := portRanges(s)
+	if err != nil {
+		return "", err
+	}
+	ports := make([]string, len(ranges))
+	for i, r := range ranges {
+		ports[i] = r.String()
+	}
+	return strings.Join(ports, ", "), nil
+}
+
+// portRanges sorted ranges of list, overlapping and adjacent ones are merged,
+// interval sets reject overlaps
+func portRanges(s string) ([]nftPortRange, error) {
+	parts := strings.Split(s, ",")
+	ranges := make([]nftPortRange, 0, len(parts))
+	for _, p := range parts {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(p), "-")
+		from, err := parsePort(lo)
+		if err != nil {
+			return nil, err
+		}
+		if !isRange {
+			ranges = append(ranges, nftPortRange{From: uint16(from), To: uint16(from)})
+			continue
+		}
+		to, err := parsePort(hi)
+		if err != nil {
+			return nil, err
+		}
+		if from >= to {
+			return nil, fmt.Errorf("invalid range %d-%d", from, to)
+		}
+		ranges = append(ranges, nftPortRange{From: uint16(from), To: uint16(to)})
+	}
+	slices.SortFunc(ranges, func(a, b nftPortRange) int {
+		return int(a.From) - int(b.From)
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && int(r.From) <= int(merged[n-1].To)+1 {
+			merged[n-1].To = max(merged[n-1].To, r.To)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+func parsePort(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 || strings.HasPrefix(s, "+") {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// parseEgressPolicy default policy of outbound traffic, empty for none
+func parseEgressPolicy(policy string) (string, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	if policy != "" && policy != "accept" && policy != "drop" {
+		return "", fmt.Errorf("policy %q is not allowed", policy)
+	}
+	return policy, nil
+}
+
+// parseIfnames parses interface names, wildcard only as the last char: "br-*"
+func parseIfnames(list []string) ([]string, error) {
+	names := make([]string, 0, len(list))
+	seen := map[string]struct{}{}
+	for _, name := range list {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !ifnameReg.MatchString(name) {
+			return nil, fmt.Errorf("invalid interface %q", name)
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -2,72 +2,167 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"math"
 	"net"
+	"net/netip"
 	"netip-network/collector"
-	"os/exec"
-	"regexp"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type FirewallRules struct {
+	Id        string `json:"id"`
 	Protocol  string `json:"protocol"`
 	Source    string `json:"source"`
+	Countries string `json:"countries"` // iso codes instead of source: "DE,NL"
 	Ports     string `json:"ports"`
 	Target    string `json:"target"`
 	NatOutput bool   `json:"natOutput"`
+	// direction in (default) for input chain or out for egress chain
+	Direction        string `json:"direction"`
+	Destination      string `json:"destination"`
+	DestinationPorts string `json:"destinationPorts"` // ports of outbound rules
+	// limits per source address, packets over limit are dropped
+	RateLimit int `json:"rateLimit"` // packets per second
+	RateBurst int `json:"rateBurst"`
+	ConnLimit int `json:"connLimit"` // concurrent connections
+	SynLimit  int `json:"synLimit"`  // new tcp connections per second
+	// rule is removed at expiresAt, schedule "0 22 * * *" activates it for scheduleFor "8h"
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Schedule    string    `json:"schedule"`
+	ScheduleFor string    `json:"scheduleFor"`
+	// parsed schedule, filled by validation
+	cron        *cronSpec
+	scheduleFor time.Duration
+	// index of rule in configured list, names its sets, filled by scheduleRules
+	index int
+	// set of source with timeout till the end of window, filled by scheduleRules
+	expireSet string
+	until     time.Time
 }
 
 type Firewall struct {
-	table             string
-	chainOutput       string
-	tableBlackhole    string
-	blackHole         bool
-	blackHoleQuantity int
-	blackHoleCounter  chan<- *collector.BlackholeCounter
-	blackHoleExists   map[string]struct{}
-	bhStatsStopper    chan bool
-	bhStatsTicker     *time.Ticker
-	bhStatsReg        *regexp.Regexp
+	nft              Nft
+	table            string
+	chainOutput      string
+	tableBlackhole   string
+	tableInet        nftTable
+	tablesNat        []nftTable
+	trusted          []string
+	egressPolicy     string
+	tableBH          nftTable
+	blackHole        atomic.Bool // read by queue worker and feeds, batch taken after disabling fails
+	blackHoleCounter chan<- *collector.BlackholeCounter
+	// blackHoleExists entries with expiry time, zero for permanent,
+	// bhEffective their aggregation in sets
+	blackHoleExists map[netip.Prefix]time.Time
+	bhEffective     map[netip.Prefix]time.Time
+	bhMu            sync.Mutex
+	// bhVersion of last blackhole-sync, base for next delta
+	bhVersion   int64
+	bhStatePath string
+	// bhSaveTimer of pending save of state, guarded by bhMu
+	bhSaveTimer      *time.Timer
+	bhQueue          *bhQueue
+	bhQueueOnce      sync.Once
+	ctKiller         *ctKiller
+	bhStatsStopper   chan bool
+	bhStatsTicker    *time.Ticker
+	chanEvent        chan<- any
+	applyMu          sync.Mutex
+	confirmMu        sync.Mutex
+	confirm          *confirmPending
+	confirmWindow    time.Duration
+	countersInterval time.Duration
+	desired          []FirewallRules
+	baseline         map[string]int
+	driftInterval    time.Duration
+	driftOnce        sync.Once
+	countersOnce     sync.Once
+	fqdnMu           sync.Mutex
+	fqdn             map[string]*fqdnEntry
+	fqdnOnce         sync.Once
+	resolve          func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+	geoPath          string
+	geoMu            sync.Mutex
+	geo              *geoCache
+	// geoApplied version of database in country sets per table
+	geoApplied      map[nftTable]int
+	geoOnce         sync.Once
+	bhCountries     string
+	feedsMu         sync.Mutex
+	feeds           map[string]*feedState
+	feedsOnce       sync.Once
+	scheduleOnce    sync.Once
+	scheduleState   []ruleWindow
+	dropGroup       uint16
+	dropRate        int
+	dropsOnce       sync.Once
+	drops           *dropStats
+	tableSynproxy   nftTable
+	synproxyMu      sync.Mutex
+	synproxy        bool
+	synproxyPorts   string
+	synproxyCounter chan<- *collector.SynproxyCounter
+	synproxyStopper chan bool
 }
 
 func NewFirewall() *Firewall {
-	return &Firewall{
-		table:           "netip",
-		chainOutput:     "netip-output",
-		tableBlackhole:  "netip-blackhole",
-		blackHoleExists: map[string]struct{}{},
-		bhStatsStopper:  make(chan bool, 1),
-		bhStatsReg:      regexp.MustCompile(`@(.+?) counter packets (\d+) bytes (\d+) drop`),
+	confirmWindow, _ := strconv.Atoi(os.Getenv("FIREWALL_CONFIRM"))
+	trusted := []string{"docker0"}
+	if env, ok := os.LookupEnv("FIREWALL_TRUSTED"); ok {
+		var err error
+		if trusted, err = parseIfnames(strings.Split(env, ",")); err != nil {
+			log.Println("[firewall] invalid FIREWALL_TRUSTED, using docker0:", err)
+			trusted = []string{"docker0"}
+		}
 	}
-}
-
-func (f *Firewall) shell(command string) string {
-	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
-	defer cancel()
-	out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
-	if err != nil {
-		log.Println("[firewall] shell err:", err, "command:", command)
+	dropGroup, dropRate := dropLog()
+	egressPolicy, err := parseEgressPolicy(os.Getenv("FIREWALL_EGRESS"))
+	if err != nil || egressPolicy == "" {
+		egressPolicy = "accept"
 	}
-	return strings.TrimSpace(string(out))
-}
-
-func (f *Firewall) shellOk(command string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
-	defer cancel()
-	command += " >/dev/null 2>&1 && echo yes"
-	out, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
-	if err != nil {
-		return false
+	return &Firewall{
+		nft:              NewNftNetlink(),
+		table:            "netip",
+		chainOutput:      "netip-output",
+		tableBlackhole:   "netip-blackhole",
+		tableInet:        nftTable{Family: "inet", Name: "netip"},
+		tablesNat:        []nftTable{{Family: "ip", Name: "nat"}, {Family: "ip6", Name: "nat"}},
+		tableBH:          nftTable{Family: "inet", Name: "netip-blackhole"},
+		tableSynproxy:    nftTable{Family: "inet", Name: "netip-synproxy"},
+		trusted:          trusted,
+		egressPolicy:     egressPolicy,
+		blackHoleExists:  map[netip.Prefix]time.Time{},
+		bhEffective:      map[netip.Prefix]time.Time{},
+		bhQueue:          newBhQueue(),
+		ctKiller:         newCtKiller(),
+		bhStatePath:      bhStatePath(),
+		feeds:            map[string]*feedState{},
+		bhStatsStopper:   make(chan bool, 1),
+		confirmWindow:    time.Duration(confirmWindow) * time.Second,
+		countersInterval: countersInterval(),
+		driftInterval:    driftInterval(),
+		fqdn:             map[string]*fqdnEntry{},
+		resolve:          fqdnLookup,
+		geoPath:          os.Getenv("FIREWALL_GEOIP"),
+		geoApplied:       map[nftTable]int{},
+		dropGroup:        dropGroup,
+		dropRate:         dropRate,
+		drops:            newDropStats(time.Now()),
 	}
-	return strings.TrimSpace(string(out)) == "yes"
 }
 
 func (f *Firewall) verIp(ip string) string {
+	ip, _, _ = strings.Cut(ip, "/")
 	pip := net.ParseIP(ip)
 	if pip != nil && strings.Count(ip, ":") >= 2 {
 		return "ip6"
@@ -75,189 +170,714 @@ func (f *Firewall) verIp(ip string) string {
 	return "ip"
 }
 
-func (f *Firewall) Refresh(rules []FirewallRules) {
+// ruleFamily family of addresses in rule, empty for rule without addresses or with hostname only
+func (f *Firewall) ruleFamily(e FirewallRules) string {
+	if e.Source != "" && !isHostname(e.Source) {
+		return f.verIp(e.Source)
+	}
+	if e.Destination != "" {
+		return f.verIp(e.Destination)
+	}
+	return ""
+}
+
+const (
+	// bhTimeoutMax timeout of blackhole entry
+	bhTimeoutMax = 365 * 24 * time.Hour
+
+	limitSetPrefix  = "limit-"
+	limitSetSize    = 65535
+	limitSetTimeout = time.Minute
+	// comment of limit rules, counts packets dropped by limits of rule
+	limitCommentSuffix = "/limit"
+)
+
+// liveState of kernel ruleset which render depends on
+type liveState struct {
+	sets []string
+	nats []natState
+}
+
+// natState existence of docker nat chains and jumps to netip chains
+type natState struct {
+	table   nftTable
+	exists  bool
+	jumpPre bool
+	jumpOut bool
+	sets    []string
+}
+
+func (f *Firewall) liveState() liveState {
+	sets, _ := f.nft.Sets(f.tableInet)
+	return liveState{sets: sets, nats: f.natStates()}
+}
+
+// natStates of ip and ip6 nat tables, docker creates ip6 nat with ipv6 enabled
+func (f *Firewall) natStates() []natState {
+	states := make([]natState, 0, len(f.tablesNat))
+	for _, t := range f.tablesNat {
+		states = append(states, natState{
+			table:   t,
+			exists:  f.nft.ChainExists(t, "PREROUTING"),
+			jumpPre: len(f.jumps(t, "PREROUTING", f.table)) > 0,
+			jumpOut: len(f.jumps(t, "OUTPUT", f.chainOutput)) > 0,
+		})
+		if states[len(states)-1].exists {
+			states[len(states)-1].sets, _ = f.nft.Sets(t)
+		}
+	}
+	return states
+}
+
+// jumps handles of rules in chain jumping to target chain
+func (f *Firewall) jumps(t nftTable, chain, target string) []uint64 {
+	rules, err := f.nft.Rules(t, chain)
+	if err != nil {
+		return nil
+	}
+	var handles []uint64
+	for _, r := range rules {
+		if r.Jump == target {
+			handles = append(handles, r.Handle)
+		}
+	}
+	return handles
+}
+
+// Refresh applies rules with trusted interfaces, nil keeps current ones, wildcard by suffix: "br-*",
+// and default policy of outbound traffic, empty keeps current,
+// with confirm window (or FIREWALL_CONFIRM seconds)
+// previous ruleset restores when changes are not confirmed in time.
+// Returns hostnames of applied rules which are not resolved yet, their sets are filled by watcher
+func (f *Firewall) Refresh(errs *stepErrors, rules []FirewallRules, trusted []string, egress string,
+	confirm time.Duration) []string {
 	log.Println("[firewall] refreshing rules")
 
-	f.shell("nft add table inet " + f.table)
-	f.shell("nft add chain inet " + f.table + " input '{ type filter hook input priority 0; policy drop ; }'")
-	f.shell("nft flush chain inet " + f.table + " input")
-	f.shell("nft add rule inet " + f.table + " input iif lo accept")
-	f.shell("nft add rule inet " + f.table + " input iifname docker0 accept")
-	f.shell("nft add rule inet " + f.table + " input ct state related,established accept")
-	f.shell("nft add rule inet " + f.table + " input ct state invalid counter drop")
+	invalid := 0
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			invalid++
+			log.Printf("[firewall] invalid rule #%d: %s", i, err)
+			errs.fail("invalid rule #%d: %s", i, err)
+		}
+	}
+	if trusted != nil {
+		var err error
+		if trusted, err = parseIfnames(trusted); err != nil {
+			invalid++
+			log.Println("[firewall] invalid trusted interfaces:", err)
+			errs.fail("trusted interfaces: %s", err)
+		}
+	}
+	egress, err := parseEgressPolicy(egress)
+	if err != nil {
+		invalid++
+		log.Println("[firewall] invalid egress policy:", err)
+		errs.fail("egress policy: %s", err)
+	}
+	if invalid > 0 {
+		log.Println("[firewall] refresh rejected, ruleset stays as before, invalid rules:", invalid)
+		return nil
+	}
+
+	if confirm == 0 {
+		confirm = f.confirmWindow
+	}
 
-	// nat filter
-	f.shell("nft add chain ip nat " + f.table)
-	f.shell("nft flush chain ip nat " + f.table)
-	f.shell("nft add rule ip nat " + f.table + " iifname docker0 counter return")
-	existsPre := f.shellOk("nft list chain ip nat PREROUTING | grep -i 'jump " + f.table + "'")
-	if !existsPre {
-		f.shell("nft insert rule ip nat PREROUTING fib daddr type local counter jump " + f.table)
+	if keys := geoKeys(rules); len(keys) > 0 {
+		if err := f.geoLoad(geoCountries(keys)); err != nil {
+			log.Println("[firewall] refresh rejected, ruleset stays as before:", err)
+			errs.fail("%s", err)
+			return nil
+		}
+	}
+
+	// resolve before lock, rules with hostnames are applied with addresses known at the moment,
+	// the rest is resolved by watcher
+	hosts := fqdnHosts(rules)
+	ctx, cancel := context.WithTimeout(context.Background(), fqdnRefreshTimeout)
+	f.fqdnResolve(ctx, hosts, time.Now())
+	cancel()
+	var unresolved []string
+	for _, host := range hosts {
+		if len(f.fqdnElements(host, "ip"))+len(f.fqdnElements(host, "ip6")) == 0 {
+			log.Printf("[firewall] source %s is not resolved yet", host)
+			unresolved = append(unresolved, host)
+		}
 	}
 
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+
+	if trusted == nil {
+		trusted = f.trusted
+	}
+	if egress == "" {
+		egress = f.egressPolicy
+	}
+	if err := f.apply(rules, trusted, egress, confirm); err != nil {
+		errs.fail("%s", err)
+		return nil
+	}
+	f.countersStart()
+	f.driftStart()
+	f.fqdnStart()
+	f.dropsStart()
+	if len(geoKeys(rules)) > 0 {
+		f.geoStart()
+	}
+	if scheduled(rules) {
+		f.scheduleStart()
+		for _, fs := range scheduleExpired(rules, time.Now()) {
+			f.scheduleEvent(fs)
+		}
+	}
+	return unresolved
+}
+
+// apply renders and commits rules with trusted interfaces and egress policy, remembers them
+// as desired state for reconciling, must be called with applyMu held
+func (f *Firewall) apply(rules []FirewallRules, trusted []string, egress string, confirm time.Duration) error {
+	var snapshot []NftSnapshot
+	if confirm > 0 {
+		var err error
+		if snapshot, err = f.snapshot(); err != nil {
+			log.Println("[firewall] snapshot err:", err)
+			return fmt.Errorf("snapshot ruleset: %w", err)
+		}
+	}
+
+	live := f.liveState()
+	for _, nat := range live.nats {
+		if !nat.exists {
+			log.Printf("[firewall] notice: chain %s PREROUTING not exists, skip nat rules", nat.table)
+		}
+	}
+
+	now := time.Now()
+	active, states := f.scheduleRules(rules, now)
+	version := f.geoVersion()
+	// render reads the new ones, previous stay when ruleset is rejected
+	prev := &confirmPending{snapshot: snapshot, desired: f.desired, schedule: f.scheduleState,
+		trusted: f.trusted, egressPolicy: f.egressPolicy}
+	f.trusted, f.egressPolicy = trusted, egress
+	tx := f.nft.Begin()
+	f.render(tx, active, live, now)
+	if err := tx.Commit(); err != nil {
+		f.trusted, f.egressPolicy = prev.trusted, prev.egressPolicy
+		log.Println("[firewall] apply ruleset err:", err)
+		logger.Debug("[firewall] rejected ruleset:\n" + tx.String())
+		return fmt.Errorf("apply ruleset: %w", err)
+	}
+	f.geoRendered(version, append([]nftTable{f.tableInet}, f.tablesNat...)...)
+
+	if confirm > 0 {
+		f.confirmWait(prev, confirm)
+	}
+	f.desired = rules
+	f.scheduleState = states
+	f.baseline = f.observe()
+	return nil
+}
+
+// render queues the whole netip ruleset into one transaction, rules are active at the moment
+// with their index in configured list
+func (f *Firewall) render(tx NftTx, rules []FirewallRules, live liveState, now time.Time) {
+	input := "input"
+	counter := stmtCounter{}
+
+	tx.AddTable(f.tableInet)
+	tx.AddChain(f.tableInet, nftChain{Name: input, Type: "filter", Hook: "input", Policy: "drop"})
+	tx.FlushChain(f.tableInet, input)
+	tx.AddRule(f.tableInet, input, ruleOf(matchIfname{Name: "lo"}, stmtVerdict{Kind: "accept"}))
+	for _, inf := range f.trusted {
+		tx.AddRule(f.tableInet, input, ruleOf(matchIfname{Name: inf}, stmtVerdict{Kind: "accept"}))
+	}
+	tx.AddRule(f.tableInet, input, ruleOf(matchCtState{States: []string{"established", "related"}},
+		stmtVerdict{Kind: "accept"}))
+	tx.AddRule(f.tableInet, input, ruleOf(matchCtState{States: []string{"invalid"}}, counter,
+		stmtVerdict{Kind: "drop"}))
+
+	keep := map[string]bool{}
+	hosts := fqdnHosts(rules)
+	f.renderFqdn(tx, f.tableInet, hosts, []string{"ip", "ip6"}, keep)
+	f.renderGeo(tx, f.tableInet, geoKeys(rules), []string{"ip", "ip6"}, keep)
+	f.renderExpire(tx, f.tableInet, rules, []string{"ip", "ip6"}, now, keep)
+
 	// filter rules
 	for _, e := range rules {
-		protocol := strings.ToLower(e.Protocol)
-		target := strings.ToLower(e.Target)
-
-		if protocol == "icmp" {
-			source := ""
-			if e.Source != "" {
-				source = f.verIp(e.Source) + " saddr " + e.Source
-			}
-			f.shell("nft add rule inet " + f.table + " input " + source +
-				" meta l4proto { icmp, ipv6-icmp } counter accept")
-			f.shell("nft add rule ip nat " + f.table + " " + source +
-				" meta l4proto { icmp, ipv6-icmp } counter return")
+		if e.Direction == "out" {
 			continue
 		}
+		families := f.ruleFamilies(e)
+		f.renderLimits(tx, f.tableInet, input, e, families, keep)
+
+		target := e.Target
+		if e.Protocol == "icmp" {
+			target = "accept"
+		}
+		for _, family := range f.matchFamilies(e, families) {
+			tx.AddRule(f.tableInet, input, ruleOf(append(f.ruleMatch(e, family),
+				counter, stmtVerdict{Kind: target})...).commented(e.Id))
+		}
+	}
+
+	// packets left for policy drop
+	if f.dropGroup > 0 {
+		tx.AddRule(f.tableInet, input, f.dropRule(input))
+	}
+
+	f.dropStale(tx, f.tableInet, live.sets, keep)
 
-		var (
-			proto  = ""
-			source = ""
-			ports  = ""
-		)
+	f.renderEgress(tx, rules)
 
-		if protocol != "" {
-			proto = "meta l4proto " + protocol
-		} else if e.Ports != "" {
-			proto = "meta l4proto {tcp, udp}"
-			protocol = "th"
+	for _, nat := range live.nats {
+		if nat.exists {
+			f.renderNat(tx, rules, nat, now)
 		}
+	}
+}
 
-		if e.Source != "" {
-			source = f.verIp(e.Source) + " saddr " + e.Source
+// ruleFamilies families of rule, both for rule without addresses
+func (f *Firewall) ruleFamilies(e FirewallRules) []string {
+	if family := f.ruleFamily(e); family != "" {
+		return []string{family}
+	}
+	return []string{"ip", "ip6"}
+}
+
+// matchFamilies rule with hostname or countries is queued per family of sets,
+// other rules match by addresses of their own family
+func (f *Firewall) matchFamilies(e FirewallRules, families []string) []string {
+	if isHostname(e.Source) || e.Countries != "" {
+		return families
+	}
+	return []string{""}
+}
+
+// renderLimits queues meters of rule limits with drop rules before the rule itself,
+// established packets are accepted before, so only new connections are metered,
+// the sets are per rule and family: limit-rate4-0, named by index of rule in configured list,
+// so switch of scheduled rule does not reset meters of others
+func (f *Firewall) renderLimits(tx NftTx, t nftTable, chain string, e FirewallRules,
+	families []string, keep map[string]bool) {
+	limited := ""
+	if e.Id != "" {
+		limited = e.Id + limitCommentSuffix
+	}
+	for _, family := range families {
+		addrType, suffix := "ipv4_addr", "4"
+		if family == "ip6" {
+			addrType, suffix = "ipv6_addr", "6"
+		}
+		meter := func(kind string, timeout time.Duration) string {
+			name := fmt.Sprintf("%s%s%s-%d", limitSetPrefix, kind, suffix, e.index)
+			tx.AddSet(t, nftSet{Name: name, Type: addrType, Dynamic: true, Timeout: timeout, Size: limitSetSize})
+			keep[name] = true
+			return name
+		}
+
+		if e.RateLimit > 0 {
+			set := meter("rate", limitSetTimeout)
+			tx.AddRule(t, chain, ruleOf(append(f.ruleMatch(e, family), matchCtState{States: []string{"new"}},
+				stmtMeter{Set: set, Family: family, Over: e.RateLimit, Burst: e.RateBurst},
+				stmtCounter{}, stmtVerdict{Kind: "drop"})...).commented(limited))
+		}
+		if e.SynLimit > 0 {
+			set := meter("syn", limitSetTimeout)
+			tx.AddRule(t, chain, ruleOf(append(f.ruleMatch(e, family), matchTcpSyn{},
+				stmtMeter{Set: set, Family: family, Over: e.SynLimit},
+				stmtCounter{}, stmtVerdict{Kind: "drop"})...).commented(limited))
 		}
+		if e.ConnLimit > 0 {
+			set := meter("conn", 0)
+			tx.AddRule(t, chain, ruleOf(append(f.ruleMatch(e, family), matchCtState{States: []string{"new"}},
+				stmtMeter{Set: set, Family: family, Conn: true, Over: e.ConnLimit},
+				stmtCounter{}, stmtVerdict{Kind: "drop"})...).commented(limited))
+		}
+	}
+}
+
+// ownedSet set of rules: limits, hostnames, countries or expiring sources
+func ownedSet(set string) bool {
+	return strings.HasPrefix(set, limitSetPrefix) || strings.HasPrefix(set, fqdnSetPrefix) ||
+		strings.HasPrefix(set, geoSetPrefix) || strings.HasPrefix(set, expireSetPrefix)
+}
+
+// dropStale removes sets of rules which are gone, after flush of chains
+func (f *Firewall) dropStale(tx NftTx, t nftTable, sets []string, keep map[string]bool) {
+	for _, set := range sets {
+		if ownedSet(set) && !keep[set] {
+			tx.DelSet(t, set)
+		}
+	}
+}
+
+// ruleMatch matches of rule: protocol, source and ports,
+// family selects set of hostname or countries
+func (f *Firewall) ruleMatch(e FirewallRules, family string) []nftExpr {
+	var addrs []nftExpr
+	if e.expireSet != "" {
+		addrs = append(addrs, matchAddr{Family: f.verIp(e.Source), Set: e.expireSet})
+	} else if e.Countries != "" {
+		addrs = append(addrs, matchAddr{Family: family, Set: geoSet(e.Countries, family)})
+	} else if isHostname(e.Source) {
+		addrs = append(addrs, matchAddr{Family: family, Set: fqdnSet(e.Source, family)})
+	} else if e.Source != "" {
+		prefix, _ := parsePrefix(e.Source)
+		addrs = append(addrs, matchAddr{Family: f.verIp(e.Source), Prefixes: []netip.Prefix{prefix}})
+	}
+	if e.Destination != "" {
+		prefix, _ := parsePrefix(e.Destination)
+		addrs = append(addrs, matchAddr{Family: f.verIp(e.Destination), Dst: true, Prefixes: []netip.Prefix{prefix}})
+	}
 
-		if e.Ports != "" {
-			ports = protocol + " dport { " + e.Ports + " }"
+	if e.Protocol == "icmp" {
+		return append(addrs, matchL4proto{Protos: []string{"icmp", "ipv6-icmp"}})
+	}
+
+	// validation keeps only one of them by direction
+	dports := e.Ports + e.DestinationPorts
+
+	var match []nftExpr
+	protocol := e.Protocol
+	if protocol != "" {
+		match = append(match, matchL4proto{Protos: []string{protocol}})
+	} else if dports != "" {
+		match = append(match, matchL4proto{Protos: []string{"tcp", "udp"}})
+		protocol = "th"
+	}
+	match = append(match, addrs...)
+	if dports != "" {
+		ports, _ := portRanges(dports)
+		match = append(match, matchPort{Proto: protocol, Dst: true, Ports: ports})
+	}
+	return match
+}
+
+// renderEgress outbound rules of host (output) and containers (forward from trusted interfaces)
+// in egress chain, which ends with the egress policy
+func (f *Firewall) renderEgress(tx NftTx, rules []FirewallRules) {
+	egress := "egress"
+	jump := stmtVerdict{Kind: "jump", Chain: egress}
+	established := matchCtState{States: []string{"established", "related"}}
+
+	tx.AddChain(f.tableInet, nftChain{Name: egress})
+	tx.FlushChain(f.tableInet, egress)
+	for _, e := range rules {
+		if e.Direction != "out" {
+			continue
 		}
+		target := e.Target
+		if e.Protocol == "icmp" {
+			target = "accept"
+		}
+		for _, family := range f.matchFamilies(e, f.ruleFamilies(e)) {
+			tx.AddRule(f.tableInet, egress, ruleOf(append(f.ruleMatch(e, family),
+				stmtCounter{}, stmtVerdict{Kind: target})...).commented(e.Id))
+		}
+	}
+	if f.egressPolicy == "drop" {
+		tx.AddRule(f.tableInet, egress, ruleOf(stmtCounter{}, stmtVerdict{Kind: "drop"}))
+	}
+
+	// hook chains accept by policy, drop is only in egress chain
+	tx.AddChain(f.tableInet, nftChain{Name: "output", Type: "filter", Hook: "output", Policy: "accept"})
+	tx.FlushChain(f.tableInet, "output")
+	tx.AddRule(f.tableInet, "output", ruleOf(matchIfname{Out: true, Name: "lo"}, stmtVerdict{Kind: "accept"}))
+	tx.AddRule(f.tableInet, "output", ruleOf(established, stmtVerdict{Kind: "accept"}))
+	tx.AddRule(f.tableInet, "output", ruleOf(jump))
+
+	tx.AddChain(f.tableInet, nftChain{Name: "forward", Type: "filter", Hook: "forward", Policy: "accept"})
+	tx.FlushChain(f.tableInet, "forward")
+	tx.AddRule(f.tableInet, "forward", ruleOf(established, stmtVerdict{Kind: "accept"}))
+	for _, inf := range f.trusted {
+		tx.AddRule(f.tableInet, "forward", ruleOf(matchIfname{Name: inf}, jump))
+	}
+}
 
-		f.shell(fmt.Sprintf(
-			"nft add rule inet %s input %s %s %s counter %s",
-			f.table, proto, source, ports, target))
+// renderNat nat filter for containers ports control, in ip or ip6 nat table
+func (f *Firewall) renderNat(tx NftTx, rules []FirewallRules, nat natState, now time.Time) {
+	t := nat.table
+	natChain := f.table
+	counter := stmtCounter{}
+
+	tx.AddChain(t, nftChain{Name: natChain})
+	tx.FlushChain(t, natChain)
+	for _, inf := range f.trusted {
+		tx.AddRule(t, natChain, ruleOf(matchIfname{Name: inf}, counter, stmtVerdict{Kind: "return"}))
+	}
+	if !nat.jumpPre {
+		tx.InsertRule(t, "PREROUTING", ruleOf(matchFibLocal{}, counter,
+			stmtVerdict{Kind: "jump", Chain: f.table}))
+	}
+
+	keep := map[string]bool{}
+	f.renderFqdn(tx, t, fqdnHosts(rules), []string{t.Family}, keep)
+	f.renderGeo(tx, t, geoKeys(rules), []string{t.Family}, keep)
+	f.renderExpire(tx, t, rules, []string{t.Family}, now, keep)
+	for _, e := range rules {
+		// nat table of family can't match sources of other family
+		if e.Direction == "out" {
+			continue
+		}
+		if family := f.ruleFamily(e); family != "" && family != t.Family {
+			continue
+		}
+		f.renderLimits(tx, t, natChain, e, []string{t.Family}, keep)
 
-		// for containers ports control
 		natTarget := "return"
-		if target == "drop" {
+		if e.Protocol != "icmp" && e.Target == "drop" {
 			natTarget = "drop"
 		}
-		f.shell(fmt.Sprintf(
-			"nft add rule ip nat %s %s %s %s counter %s",
-			f.table, proto, source, ports, natTarget))
+		tx.AddRule(t, natChain, ruleOf(append(f.ruleMatch(e, t.Family), counter,
+			stmtVerdict{Kind: natTarget})...).commented(e.Id))
 	}
 
-	f.shell("nft add rule ip nat " + f.table + " counter drop")
+	if f.dropGroup > 0 {
+		tx.AddRule(t, natChain, f.dropRule("nat"))
+	}
+	tx.AddRule(t, natChain, ruleOf(counter, stmtVerdict{Kind: "drop"}))
+	f.dropStale(tx, t, nat.sets, keep)
 
 	// host nat output, internal requests for spn and n2n ports
-	f.shell("nft add chain ip nat " + f.chainOutput)
-	f.shell("nft flush chain ip nat " + f.chainOutput)
-
-	existsOut := f.shellOk("nft list chain ip nat OUTPUT | grep -i 'jump " + f.chainOutput + "'")
-	if !existsOut {
-		f.shell("nft insert rule ip nat OUTPUT ip daddr != 127.0.0.0/8 fib daddr type local counter jump " + f.chainOutput)
+	tx.AddChain(t, nftChain{Name: f.chainOutput})
+	tx.FlushChain(t, f.chainOutput)
+	if !nat.jumpOut {
+		loopback := netip.MustParsePrefix("127.0.0.0/8")
+		if t.Family == "ip6" {
+			loopback = netip.MustParsePrefix("::1/128")
+		}
+		tx.InsertRule(t, "OUTPUT", ruleOf(
+			matchAddr{Family: t.Family, Dst: true, Neg: true, Prefixes: []netip.Prefix{loopback}},
+			matchFibLocal{}, counter, stmtVerdict{Kind: "jump", Chain: f.chainOutput}))
 	}
 	for _, e := range rules {
-		if !e.NatOutput || e.Source == "" || e.Ports == "" {
+		if !e.NatOutput || e.Direction == "out" || e.Source == "" || e.Ports == "" || f.verIp(e.Source) != t.Family {
 			continue
 		}
-		f.shell("nft insert rule ip nat " + f.table + "-output ip saddr " +
-			e.Source + " tcp dport { " + e.Ports + " } redirect")
+		prefix, _ := parsePrefix(e.Source)
+		ports, _ := portRanges(e.Ports)
+		tx.AddRule(t, f.chainOutput, ruleOf(
+			matchL4proto{Protos: []string{"tcp"}},
+			matchAddr{Family: t.Family, Prefixes: []netip.Prefix{prefix}},
+			matchPort{Proto: "tcp", Dst: true, Ports: ports},
+			stmtRedirect{}))
 	}
 }
 
-func (f *Firewall) Disable() {
-	if !f.shellOk("nft add table inet" + f.table) {
+func (f *Firewall) Disable(errs *stepErrors) {
+	f.applyMu.Lock()
+	defer f.applyMu.Unlock()
+
+	tx := f.nft.Begin()
+	changes := 0
+	if f.nft.TableExists(f.tableInet) {
+		tx.DelTable(f.tableInet)
+		changes++
+	}
+
+	// rm nat prerouting and nat output of ip and ip6, even without own table
+	for _, t := range f.tablesNat {
+		for hook, chain := range map[string]string{"PREROUTING": f.table, "OUTPUT": f.chainOutput} {
+			for _, handle := range f.jumps(t, hook, chain) {
+				tx.DelRule(t, hook, handle)
+				changes++
+			}
+			if f.nft.ChainExists(t, chain) {
+				tx.FlushChain(t, chain)
+				tx.DelChain(t, chain)
+				changes++
+			}
+		}
+		sets, _ := f.nft.Sets(t)
+		for _, set := range sets {
+			if ownedSet(set) {
+				tx.DelSet(t, set)
+				changes++
+			}
+		}
+	}
+
+	// nothing to reconcile after disabling
+	f.desired = nil
+	f.baseline = nil
+
+	if changes == 0 {
 		return
 	}
 	log.Println("[firewall] disabling")
+	f.confirmStop()
 
-	f.shell("nft delete table inet " + f.table)
-
-	// rm nat prerouting
-	rmPre := f.shell("nft -a list chain ip nat PREROUTING 2> /dev/null | grep -i 'jump " + f.table + "' | head -n 1")
-	if rmPre != "" {
-		spl := strings.Split(rmPre, " # handle ")
-		if len(spl) > 1 {
-			f.shell("nft delete rule ip nat PREROUTING handle " + spl[1])
-		}
+	if err := tx.Commit(); err != nil {
+		log.Println("[firewall] disable err:", err)
+		errs.fail("disable: %s", err)
 	}
-	f.shell("nft flush chain ip nat " + f.table + " 2> /dev/null")
-	f.shell("nft delete chain ip nat " + f.table)
+}
 
-	// rm nat output
-	rmOut := f.shell("nft -a list chain ip nat OUTPUT 2> /dev/null | grep -i 'jump " + f.chainOutput + "' | head -n 1")
-	if rmOut != "" {
-		spl := strings.Split(rmOut, " # handle ")
-		if len(spl) > 1 {
-			f.shell("nft delete rule ip nat OUTPUT handle " + spl[1])
-		}
+func (f *Firewall) SetChanEvent(event chan<- any) {
+	f.chanEvent = event
+}
+
+func (f *Firewall) event(e any) {
+	if f.chanEvent != nil {
+		f.chanEvent <- e
 	}
-	f.shell("nft flush chain ip nat " + f.chainOutput + " 2> /dev/null")
-	f.shell("nft delete chain ip nat " + f.chainOutput)
 }
 
 func (f *Firewall) SetChanBHCounter(counter chan<- *collector.BlackholeCounter) {
 	f.blackHoleCounter = counter
 }
 
-func (f *Firewall) BlackHoleEnable() {
-	if f.blackHole {
+func (f *Firewall) BlackHoleEnable(errs *stepErrors) {
+	if !f.blackHole.CompareAndSwap(false, true) {
 		return
 	}
-	f.blackHole = true
 
-	exists := f.shellOk("nft list table inet " + f.tableBlackhole)
-	if !exists {
+	if !f.nft.TableExists(f.tableBH) {
 		log.Println("[blackhole] initialing")
 
-		init := []string{
-			"nft add table inet " + f.tableBlackhole,
-			"nft add chain inet " + f.tableBlackhole +
-				" input '{ type filter hook input priority -200; policy accept ; }'",
-			"nft add chain inet " + f.tableBlackhole +
-				" forward '{ type filter hook forward priority -200; policy accept ; }'",
-			"nft add set inet " + f.tableBlackhole + " IPv4 '{ type ipv4_addr; flags interval; }'",
-			"nft add set inet " + f.tableBlackhole + " IPv6 '{ type ipv6_addr; flags interval; }'",
-			"nft add rule inet " + f.tableBlackhole + " input ip saddr @IPv4 counter drop",
-			"nft add rule inet " + f.tableBlackhole + " input ip6 saddr @IPv6 counter drop",
-			"nft add rule inet " + f.tableBlackhole + " forward ip saddr @IPv4 counter drop",
-			"nft add rule inet " + f.tableBlackhole + " forward ip6 saddr @IPv6 counter drop",
+		tx := f.nft.Begin()
+		tx.AddTable(f.tableBH)
+		for _, hook := range []string{"input", "forward"} {
+			tx.AddChain(f.tableBH, nftChain{Name: hook, Type: "filter", Hook: hook, Priority: -200, Policy: "accept"})
 		}
-		for _, i := range init {
-			f.shell(i)
+		f.bhRenderSets(tx, nil)
+		if err := tx.Commit(); err != nil {
+			log.Println("[blackhole] init err:", err)
+			errs.fail("blackhole init: %s", err)
 		}
+	} else if set, err := f.nft.Set(f.tableBH, "IPv4"); err == nil && (!set.Timeouts || !set.Counters) {
+		f.bhUpgrade(errs)
 	}
 
 	go f.bhStatsCollect()
 }
 
-func (f *Firewall) BlackHoleExec(act, ip string) {
-	if !f.blackHole {
-		return
+// bhRenderSets queues sets of addresses with their drop rules, elements carry timeouts and counters
+func (f *Firewall) bhRenderSets(tx NftTx, elements map[string][]nftElement) {
+	tx.AddSet(f.tableBH, nftSet{Name: "IPv4", Type: "ipv4_addr", Interval: true, Timeouts: true, Counters: true})
+	tx.AddSet(f.tableBH, nftSet{Name: "IPv6", Type: "ipv6_addr", Interval: true, Timeouts: true, Counters: true})
+	for set, list := range elements {
+		if len(list) > 0 {
+			tx.AddElements(f.tableBH, set, list)
+		}
+	}
+	for _, hook := range []string{"input", "forward"} {
+		tx.AddRule(f.tableBH, hook, ruleOf(matchAddr{Family: "ip", Set: "IPv4"},
+			stmtCounter{}, stmtVerdict{Kind: "drop"}))
+		tx.AddRule(f.tableBH, hook, ruleOf(matchAddr{Family: "ip6", Set: "IPv6"},
+			stmtCounter{}, stmtVerdict{Kind: "drop"}))
 	}
+}
 
-	set := "IPv4"
-	if f.verIp(ip) == "ip6" {
-		set = "IPv6"
+// bhUpgrade recreates sets of table made before timeouts and counters, with their elements in one transaction
+func (f *Firewall) bhUpgrade(errs *stepErrors) {
+	log.Println("[blackhole] upgrading sets for timeouts and counters")
+	elements := map[string][]nftElement{}
+	for _, set := range []string{"IPv4", "IPv6"} {
+		list, err := f.nft.Elements(f.tableBH, set)
+		if err != nil {
+			errs.fail("blackhole upgrade: %s", err)
+			return
+		}
+		elements[set] = list
 	}
-	if act != "add" {
-		act = "delete"
+
+	tx := f.nft.Begin()
+	for _, hook := range []string{"input", "forward"} {
+		rules, _ := f.nft.Rules(f.tableBH, hook)
+		for _, r := range rules {
+			if r.Set == "IPv4" || r.Set == "IPv6" {
+				tx.DelRule(f.tableBH, hook, r.Handle)
+			}
+		}
 	}
-	ok := f.shellOk(fmt.Sprintf("nft %s element inet %s %s '{ %s }'", act, f.tableBlackhole, set, ip))
-	if !ok {
-		return
+	tx.DelSet(f.tableBH, "IPv4")
+	tx.DelSet(f.tableBH, "IPv6")
+	f.bhRenderSets(tx, elements)
+	if err := tx.Commit(); err != nil {
+		log.Println("[blackhole] upgrade err:", err)
+		errs.fail("blackhole upgrade: %s", err)
+	}
+}
+
+// BlackHoleExec queues addition or deletion of address, queue is applied by worker in batches,
+// added one with timeout is removed by kernel in time. Returns true when change is queued,
+// then result of command is sent by worker after its batch is applied
+func (f *Firewall) BlackHoleExec(errs *stepErrors, cmd bhCommand, act, ip string, timeout time.Duration) bool {
+	if !f.blackHole.Load() {
+		errs.fail("blackhole is not enabled")
+		return false
+	}
+	if timeout < 0 || timeout > bhTimeoutMax {
+		errs.fail("blackhole timeout %s is out of range", timeout)
+		return false
+	}
+
+	prefix, err := parsePrefix(ip)
+	if err != nil {
+		log.Printf("[blackhole] invalid ip %q: %s", ip, err)
+		errs.fail("invalid ip %q: %s", ip, err)
+		return false
 	}
-	if act == "add" {
-		if _, ok := f.blackHoleExists[ip]; !ok {
-			f.blackHoleExists[ip] = struct{}{}
-			f.blackHoleQuantity++
+	f.bhQueueOnce.Do(func() {
+		go f.bhQueueWorker()
+	})
+	f.bhQueue.push(bhChange{prefix: prefix, timeout: timeout, del: act != "add"}, cmd, time.Now())
+	return true
+}
+
+// bhChange addition or deletion of blackhole entry
+type bhChange struct {
+	prefix  netip.Prefix
+	timeout time.Duration
+	del     bool
+}
+
+// bhCommit applies changes to entries and their aggregation in sets in one transaction,
+// must be called with bhMu held, deletion of unknown entry is skipped, added one replaces known,
+// caller saves state after its changes
+func (f *Firewall) bhCommit(changes []bhChange, now time.Time) error {
+	f.bhPrune(now)
+	exists := maps.Clone(f.blackHoleExists)
+	for _, c := range changes {
+		if c.del {
+			delete(exists, c.prefix)
+			continue
 		}
+		var expires time.Time
+		if c.timeout > 0 {
+			expires = now.Add(c.timeout)
+		}
+		exists[c.prefix] = expires
 	}
-	if act == "delete" {
-		if _, ok := f.blackHoleExists[ip]; ok {
-			delete(f.blackHoleExists, ip)
-			f.blackHoleQuantity--
+	effective := bhAggregate(exists)
+	dels, adds := bhElementsDiff(f.bhEffective, effective, now)
+
+	if len(adds)+len(dels) > 0 {
+		tx := f.nft.Begin()
+		for set, list := range dels {
+			tx.DelElements(f.tableBH, set, list)
+		}
+		for set, list := range adds {
+			tx.AddElements(f.tableBH, set, list)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	f.blackHoleExists, f.bhEffective = exists, effective
+	return nil
+}
+
+// bhPrune forgets entries and elements expired in kernel, must be called with bhMu held
+func (f *Firewall) bhPrune(now time.Time) {
+	for _, m := range []map[netip.Prefix]time.Time{f.blackHoleExists, f.bhEffective} {
+		for p, expires := range m {
+			if !expires.IsZero() && !now.Before(expires) {
+				delete(m, p)
+			}
 		}
 	}
 }
@@ -265,58 +885,69 @@ func (f *Firewall) BlackHoleExec(act, ip string) {
 func (f *Firewall) BlackHoleRestore() {
 	log.Println("[blackhole] restoring db from nft")
 
-	for _, v := range []int{4, 6} {
-		set := f.shell(fmt.Sprintf("nft -j list set inet %s IPv%d", f.tableBlackhole, v))
-
-		var nft struct {
-			NFTables []struct {
-				Set struct {
-					Elem []interface{} `json:"elem"`
-				} `json:"set"`
-			} `json:"nftables"`
-		}
-
-		err := json.Unmarshal([]byte(set), &nft)
+	now := time.Now()
+	live := map[netip.Prefix]time.Time{}
+	for _, set := range []string{"IPv4", "IPv6"} {
+		elements, err := f.nft.Elements(f.tableBH, set)
 		if err != nil {
 			continue
 		}
-
-		for _, n := range nft.NFTables {
-			if len(n.Set.Elem) == 0 {
-				continue
-			}
-			for _, i := range n.Set.Elem {
-				if ip, ok := i.(string); ok {
-					f.blackHoleQuantity++
-					f.blackHoleExists[ip] = struct{}{}
-				} else if rn, ok := i.(map[string]any); ok {
-					if ip, ok := rn["prefix"].(map[string]any); ok {
-						f.blackHoleQuantity++
-						f.blackHoleExists[fmt.Sprintf("%s/%0.f", ip["addr"], ip["len"])] = struct{}{}
-					}
-				}
+		for _, e := range elements {
+			// remaining time of entry with timeout
+			var expires time.Time
+			if e.Timeout > 0 {
+				expires = now.Add(e.Expires)
 			}
+			live[e.Prefix] = expires
 		}
 	}
+	f.bhMu.Lock()
+	f.bhRestoreEntries(live, now)
+	f.bhMu.Unlock()
+	sets, _ := f.nft.Sets(f.tableBH)
+	f.feedsRestore(sets)
+	countries := bhCountriesOf(sets)
+	f.applyMu.Lock()
+	f.bhCountries = countries
+	f.applyMu.Unlock()
+	if countries != "" {
+		f.geoStart()
+	}
 }
 
-func (f *Firewall) BlackHoleDisable() {
-	if !f.blackHole {
+func (f *Firewall) BlackHoleDisable(errs *stepErrors) {
+	if !f.blackHole.CompareAndSwap(true, false) {
 		return
 	}
-	f.blackHole = false
-	f.BlackHoleDestroy()
+	f.BlackHoleDestroy(errs)
 }
 
-func (f *Firewall) BlackHoleDestroy() {
+func (f *Firewall) BlackHoleDestroy(errs *stepErrors) {
 	f.bhStatsStopper <- true
-	f.blackHoleQuantity = 0
-	f.blackHoleExists = map[string]struct{}{}
-
-	exists := f.shellOk("nft list table inet " + f.tableBlackhole)
-	if exists {
+	f.bhMu.Lock()
+	f.blackHoleExists = map[netip.Prefix]time.Time{}
+	f.bhEffective = map[netip.Prefix]time.Time{}
+	f.bhVersion = 0
+	f.bhRemoveState()
+	dropped := bhResults(f.bhQueue.take(math.MaxInt), nil, errors.New("blackhole is destroyed"))
+	f.bhMu.Unlock()
+	// destroy is also called by loop consuming events
+	go f.bhReport(dropped)
+	f.applyMu.Lock()
+	f.bhCountries = ""
+	f.applyMu.Unlock()
+	f.feedsMu.Lock()
+	f.feeds = map[string]*feedState{}
+	f.feedsMu.Unlock()
+
+	if f.nft.TableExists(f.tableBH) {
 		log.Println("[blackhole] destroying")
-		f.shell("nft delete table inet " + f.tableBlackhole)
+		tx := f.nft.Begin()
+		tx.DelTable(f.tableBH)
+		if err := tx.Commit(); err != nil {
+			log.Println("[blackhole] destroy err:", err)
+			errs.fail("blackhole destroy: %s", err)
+		}
 	}
 }
 
@@ -324,36 +955,54 @@ func (f *Firewall) bhStatsCollect() {
 	f.bhStatsTicker = time.NewTicker(time.Second / 100)
 	defer f.bhStatsTicker.Stop()
 	f.bhStatsStopper = make(chan bool, 1)
+	top := time.NewTicker(bhTopInterval)
+	defer top.Stop()
+	topFrom := time.Now()
+	topPrev := map[netip.Prefix]nftElement{}
 	for {
 		select {
+		case now := <-top.C:
+			topPrev = f.bhTopReport(topPrev, topFrom, now)
+			topFrom = now
 		case <-f.bhStatsTicker.C:
 			f.bhStatsTicker.Reset(30 * time.Second)
 
-			ifl := f.shell("nft list chain inet "+f.tableBlackhole+" input") +
-				f.shell("nft list chain inet "+f.tableBlackhole+" forward")
-
+			f.bhMu.Lock()
+			f.bhPrune(time.Now())
 			bhc := &collector.BlackholeCounter{
-				QuantityRules: f.blackHoleQuantity,
+				QuantityRules:     len(f.blackHoleExists),
+				QuantityEffective: len(f.bhEffective),
 			}
-			for _, m := range f.bhStatsReg.FindAllStringSubmatch(ifl, -1) {
-				if len(m) < 3 {
-					continue
-				}
-				packets, err := strconv.Atoi(m[2])
-				if err != nil {
-					packets = 0
-				}
-				bytes, err := strconv.Atoi(m[3])
+			f.bhMu.Unlock()
+			f.bhQueue.stats(bhc)
+			bhc.Feeds = map[string]collector.BlackholeFeedCounter{}
+			for name, prefixes := range f.feedsPrefixes() {
+				bhc.Feeds[name] = collector.BlackholeFeedCounter{Prefixes: prefixes}
+			}
+			for _, chain := range []string{"input", "forward"} {
+				rules, err := f.nft.Rules(f.tableBH, chain)
 				if err != nil {
-					bytes = 0
-				}
-				if m[1] == "IPv4" {
-					bhc.IPv4.Packets += packets
-					bhc.IPv4.Bytes += bytes
+					continue
 				}
-				if m[1] == "IPv6" {
-					bhc.IPv6.Packets += packets
-					bhc.IPv6.Bytes += bytes
+				for _, r := range rules {
+					if r.Set == "IPv4" {
+						bhc.IPv4.Packets += int(r.Packets)
+						bhc.IPv4.Bytes += int(r.Bytes)
+					}
+					if r.Set == "IPv6" {
+						bhc.IPv6.Packets += int(r.Packets)
+						bhc.IPv6.Bytes += int(r.Bytes)
+					}
+					if strings.HasPrefix(r.Set, geoSetPrefix) {
+						bhc.Countries.Packets += int(r.Packets)
+						bhc.Countries.Bytes += int(r.Bytes)
+					}
+					if name, ok := feedOfSet(r.Set); ok {
+						feed := bhc.Feeds[name]
+						feed.Packets += int(r.Packets)
+						feed.Bytes += int(r.Bytes)
+						bhc.Feeds[name] = feed
+					}
 				}
 			}
 
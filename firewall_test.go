@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"github.com/google/nftables/expr"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkScript checks lines in journal of compiled transaction, lines of rules
+// have to be compiled to expressions, returns journal for other checks
+func checkScript(t *testing.T, tx NftTx, lines ...string) string {
+	t.Helper()
+	if err := tx.(*nftNetlinkTx).err; err != nil {
+		t.Fatal("compile:", err)
+	}
+	script := tx.String()
+	for _, line := range lines {
+		if !strings.Contains(script, line+"\n") {
+			t.Fatalf("missing line %q in script:\n%s", line, script)
+		}
+		for _, l := range strings.Split(line, "\n") {
+			if strings.HasPrefix(l, "add rule ") || strings.HasPrefix(l, "insert rule ") {
+				ruleExprs(t, tx, l)
+			}
+		}
+	}
+	return script
+}
+
+// ruleExprs compiled expressions of rule line
+func ruleExprs(t *testing.T, tx NftTx, line string) []expr.Any {
+	t.Helper()
+	exprs := tx.(*nftNetlinkTx).compiled[line]
+	if len(exprs) == 0 {
+		t.Fatalf("rule %q is not compiled", line)
+	}
+	return exprs
+}
+
+// hasExpr expression of type E matching fn is in rule
+func hasExpr[E expr.Any](exprs []expr.Any, fn func(E) bool) bool {
+	return slices.ContainsFunc(exprs, func(e expr.Any) bool {
+		ex, ok := e.(E)
+		return ok && fn(ex)
+	})
+}
+
+func TestFirewallRender(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 17, 23, 10, 20, 0, time.UTC)
+	natLive := liveState{nats: []natState{{table: nftTable{Family: "ip", Name: "nat"}, exists: true, jumpPre: true}}}
+	for _, c := range []struct {
+		name  string
+		setup func(t *testing.T, f *Firewall)
+		rules []FirewallRules
+		live  liveState
+		lines []string
+		check func(t *testing.T, tx NftTx, script string)
+	}{
+		{
+			name: "rules",
+			setup: func(t *testing.T, f *Firewall) {
+				f.trusted, _ = parseIfnames([]string{"docker0", " br-*", "docker0"})
+			},
+			rules: []FirewallRules{
+				{Protocol: "tcp", Source: "1.2.3.4", Ports: "22", Target: "accept"},
+				{Source: "2001:db8::/32", Ports: "80, 443", Target: "drop"},
+				{Protocol: "icmp", Target: "accept"},
+				{Source: "10.0.0.0/8", Ports: "53", Target: "accept", NatOutput: true},
+				{Id: "ssh", Protocol: "tcp", Source: "10.0.0.0/8", Ports: "22", Target: "accept",
+					RateLimit: 10, RateBurst: 20, SynLimit: 5, ConnLimit: 3},
+			},
+			live: liveState{
+				sets: []string{"limit-rate4-4", "limit-rate4-9", "IPv4"},
+				nats: []natState{
+					{table: nftTable{Family: "ip", Name: "nat"}, exists: true, jumpPre: true},
+					{table: nftTable{Family: "ip6", Name: "nat"}, exists: true},
+				},
+			},
+			lines: []string{
+				"flush chain inet netip input",
+				"add rule inet netip input meta l4proto tcp ip saddr 1.2.3.4 tcp dport 22 counter accept",
+				"add rule ip nat netip meta l4proto tcp ip saddr 1.2.3.4 tcp dport 22 counter return",
+				"add rule inet netip input meta l4proto { tcp, udp } ip6 saddr 2001:db8::/32 th dport { 80, 443 } counter drop",
+				"add rule inet netip input meta l4proto { icmp, ipv6-icmp } counter accept",
+				"add rule ip nat netip counter drop",
+				"insert rule ip nat OUTPUT ip daddr != 127.0.0.0/8 fib daddr type local counter jump netip-output",
+				"add rule ip nat netip-output meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 53 redirect",
+				"add rule inet netip input iifname \"br-*\" accept",
+				"add rule ip nat netip iifname \"br-*\" counter return",
+				"add rule ip6 nat netip iifname \"docker0\" counter return",
+				"add rule ip6 nat netip meta l4proto { tcp, udp } ip6 saddr 2001:db8::/32 th dport { 80, 443 } counter drop",
+				"add rule ip6 nat netip meta l4proto { icmp, ipv6-icmp } counter return",
+				"insert rule ip6 nat PREROUTING fib daddr type local counter jump netip",
+				"insert rule ip6 nat OUTPUT ip6 daddr != ::1 fib daddr type local counter jump netip-output",
+				"add set inet netip limit-rate4-4 { type ipv4_addr; size 65535; flags dynamic,timeout; timeout 1m; }",
+				"add set inet netip limit-conn4-4 { type ipv4_addr; size 65535; flags dynamic; }",
+				"add rule inet netip input meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 ct state new " +
+					"update @limit-rate4-4 { ip saddr limit rate over 10/second burst 20 packets } counter drop comment \"ssh/limit\"",
+				"add rule inet netip input meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 tcp flags & (syn | ack) == syn " +
+					"update @limit-syn4-4 { ip saddr limit rate over 5/second } counter drop comment \"ssh/limit\"",
+				"add rule inet netip input meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 ct state new " +
+					"add @limit-conn4-4 { ip saddr ct count over 3 } counter drop comment \"ssh/limit\"\n" +
+					"add rule inet netip input meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 counter accept comment \"ssh\"",
+				"add set ip nat limit-rate4-4 { type ipv4_addr; size 65535; flags dynamic,timeout; timeout 1m; }",
+				"add rule ip nat netip meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 ct state new " +
+					"add @limit-conn4-4 { ip saddr ct count over 3 } counter drop comment \"ssh/limit\"",
+				"add rule ip nat netip meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 counter return comment \"ssh\"",
+				"delete set inet netip limit-rate4-9",
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				exprs := ruleExprs(t, tx, "add rule inet netip input meta l4proto tcp ip saddr 10.0.0.0/8 tcp dport 22 ct state new "+
+					"add @limit-conn4-4 { ip saddr ct count over 3 } counter drop comment \"ssh/limit\"")
+				if !hasExpr(exprs, func(e *expr.Dynset) bool {
+					return e.SetName == "limit-conn4-4" && hasExpr(e.Exprs, func(c *expr.Connlimit) bool { return c.Count == 3 })
+				}) {
+					t.Fatal("wrong conn limit expressions:", exprs)
+				}
+
+				// packets of established connections are accepted before meters, so their sessions are not limited
+				established := strings.Index(script, "add rule inet netip input ct state established,related accept\n")
+				if established < 0 {
+					t.Fatal("no established accept in script:\n" + script)
+				}
+				for _, line := range strings.Split(script, "\n") {
+					if !strings.Contains(line, " @limit-") {
+						continue
+					}
+					if !strings.Contains(line, " ct state new ") && !strings.Contains(line, " tcp flags & (syn | ack) == syn ") {
+						t.Fatal("limit meters packets of established connections:", line)
+					}
+					if strings.HasPrefix(line, "add rule inet netip input ") && strings.Index(script, line) < established {
+						t.Fatal("limit before established accept:", line)
+					}
+				}
+				if strings.Contains(script, "ip nat netip meta l4proto { tcp, udp } ip6 saddr") {
+					t.Fatal("ipv6 source in ip nat chain")
+				}
+				if strings.Contains(script, "delete set inet netip limit-rate4-4\n") ||
+					strings.Contains(script, "delete set inet netip IPv4\n") {
+					t.Fatal("set in use is deleted")
+				}
+				if strings.Contains(script, "ip6 nat netip meta l4proto tcp ip saddr") {
+					t.Fatal("ipv4 source in ip6 nat chain")
+				}
+				if strings.Contains(script, "ip nat PREROUTING fib daddr type local counter jump netip\n") {
+					t.Fatal("jump to prerouting already exists")
+				}
+			},
+		},
+		{
+			name: "no nat table",
+			live: liveState{nats: []natState{{table: nftTable{Family: "ip", Name: "nat"}}}},
+			check: func(t *testing.T, tx NftTx, script string) {
+				if strings.Contains(script, " nat ") {
+					t.Fatal("nat rules without nat table:\n" + script)
+				}
+			},
+		},
+		{
+			name: "egress",
+			setup: func(t *testing.T, f *Firewall) {
+				f.trusted = []string{"docker0"}
+				f.egressPolicy = "drop"
+			},
+			rules: []FirewallRules{
+				{Id: "pool", Direction: "out", Protocol: "tcp", Destination: "203.0.113.0/24", DestinationPorts: "3333", Target: "drop"},
+				{Direction: "out", Destination: "2001:db8::/32", Target: "reject"},
+				{Direction: "out", Protocol: "udp", DestinationPorts: "53", Target: "accept"},
+				{Protocol: "tcp", Ports: "22", Target: "accept"},
+			},
+			live: natLive,
+			lines: []string{
+				"add chain inet netip output { type filter hook output priority 0; policy accept; }",
+				"add chain inet netip forward { type filter hook forward priority 0; policy accept; }",
+				"add rule inet netip output oifname \"lo\" accept",
+				"add rule inet netip output jump egress",
+				"add rule inet netip forward iifname \"docker0\" jump egress",
+				"add rule inet netip egress meta l4proto tcp ip daddr 203.0.113.0/24 tcp dport 3333 counter drop comment \"pool\"",
+				"add rule inet netip egress ip6 daddr 2001:db8::/32 counter reject",
+				"add rule inet netip egress meta l4proto udp udp dport 53 counter accept",
+				"add rule inet netip egress counter drop",
+				"add rule inet netip input meta l4proto tcp tcp dport 22 counter accept",
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				exprs := ruleExprs(t, tx, "add rule inet netip forward iifname \"docker0\" jump egress")
+				if !hasExpr(exprs, func(e *expr.Verdict) bool { return e.Kind == expr.VerdictJump && e.Chain == "egress" }) {
+					t.Fatal("rule does not jump to egress:", exprs)
+				}
+				if !hasExpr(ruleExprs(t, tx, "add rule inet netip egress ip6 daddr 2001:db8::/32 counter reject"),
+					func(e *expr.Reject) bool { return true }) {
+					t.Fatal("rule has no reject")
+				}
+				if strings.Contains(script, "input meta l4proto udp udp dport 53") ||
+					strings.Contains(script, "ip nat netip meta l4proto udp udp dport 53") {
+					t.Fatal("outbound rule in input chains")
+				}
+			},
+		},
+		{
+			name: "egress accept",
+			setup: func(t *testing.T, f *Firewall) {
+				f.egressPolicy = "accept"
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				if strings.Contains(script, "egress counter drop") {
+					t.Fatal("drop with accept egress policy")
+				}
+			},
+		},
+		{
+			name: "fqdn",
+			setup: func(t *testing.T, f *Firewall) {
+				f.resolve = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+					return []netip.Addr{netip.MustParseAddr("192.0.2.20"), netip.MustParseAddr("192.0.2.10"),
+						netip.MustParseAddr("2001:db8::10")}, time.Second, nil
+				}
+				f.fqdnResolve(context.Background(), []string{"office.example.com"}, now)
+			},
+			rules: []FirewallRules{
+				{Id: "ssh", Protocol: "tcp", Source: "office.example.com", Ports: "22", Target: "accept", RateLimit: 5},
+			},
+			live: liveState{sets: []string{"fqdn4-old.example.com"}, nats: natLive.nats},
+			lines: []string{
+				"add set inet netip fqdn4-office.example.com { type ipv4_addr; flags interval; }",
+				"add element inet netip fqdn4-office.example.com { 192.0.2.10, 192.0.2.20 }",
+				"add element inet netip fqdn6-office.example.com { 2001:db8::10 }",
+				"add rule inet netip input meta l4proto tcp ip saddr @fqdn4-office.example.com tcp dport 22 counter accept comment \"ssh\"",
+				"add rule inet netip input meta l4proto tcp ip6 saddr @fqdn6-office.example.com tcp dport 22 counter accept comment \"ssh\"",
+				"add rule inet netip input meta l4proto tcp ip6 saddr @fqdn6-office.example.com tcp dport 22 ct state new " +
+					"update @limit-rate6-0 { ip6 saddr limit rate over 5/second } counter drop comment \"ssh/limit\"",
+				"add set ip nat fqdn4-office.example.com { type ipv4_addr; flags interval; }",
+				"add rule ip nat netip meta l4proto tcp ip saddr @fqdn4-office.example.com tcp dport 22 counter return comment \"ssh\"",
+				"delete set inet netip fqdn4-old.example.com",
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				exprs := ruleExprs(t, tx, "add rule inet netip input meta l4proto tcp ip6 saddr @fqdn6-office.example.com tcp dport 22 ct state new "+
+					"update @limit-rate6-0 { ip6 saddr limit rate over 5/second } counter drop comment \"ssh/limit\"")
+				if !hasExpr(exprs, func(e *expr.Lookup) bool { return e.SetName == "fqdn6-office.example.com" }) ||
+					!hasExpr(exprs, func(e *expr.Dynset) bool { return e.SetName == "limit-rate6-0" }) {
+					t.Fatal("wrong expressions of limited hostname rule:", exprs)
+				}
+				if strings.Contains(script, "ip nat fqdn6-") {
+					t.Fatal("ipv6 set in ip nat table")
+				}
+			},
+		},
+		{
+			name: "geo",
+			setup: func(t *testing.T, f *Firewall) {
+				f.geoPath = filepath.Join(t.TempDir(), "country.mmdb")
+				geoTestDB(t, f.geoPath, map[string]string{"192.0.2.0/24": "DE", "198.51.100.0/25": "NL", "203.0.113.0/24": "US"})
+				if err := f.geoLoad([]string{"DE", "NL"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			rules: []FirewallRules{
+				{Id: "web", Protocol: "tcp", Countries: "DE,NL", Ports: "443", Target: "accept"},
+			},
+			live: liveState{sets: []string{"geo4-US"}, nats: natLive.nats},
+			lines: []string{
+				"add set inet netip geo4-DE-NL { type ipv4_addr; flags interval; }",
+				"add element inet netip geo4-DE-NL { 192.0.2.0/24, 198.51.100.0/25 }",
+				"add rule inet netip input meta l4proto tcp ip saddr @geo4-DE-NL tcp dport 443 counter accept comment \"web\"",
+				"add rule inet netip input meta l4proto tcp ip6 saddr @geo6-DE-NL tcp dport 443 counter accept comment \"web\"",
+				"add element ip nat geo4-DE-NL { 192.0.2.0/24, 198.51.100.0/25 }",
+				"add rule ip nat netip meta l4proto tcp ip saddr @geo4-DE-NL tcp dport 443 counter return comment \"web\"",
+				"delete set inet netip geo4-US",
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				exprs := ruleExprs(t, tx, "add rule ip nat netip meta l4proto tcp ip saddr @geo4-DE-NL tcp dport 443 counter return comment \"web\"")
+				if !hasExpr(exprs, func(e *expr.Lookup) bool { return e.SetName == "geo4-DE-NL" }) {
+					t.Fatal("rule does not look up country set:", exprs)
+				}
+			},
+		},
+		{
+			name: "schedule",
+			rules: []FirewallRules{
+				{Id: "contractor", Protocol: "tcp", Source: "203.0.113.7", Ports: "5432", Target: "accept",
+					ExpiresAt: now.Add(4 * time.Hour)},
+				{Id: "night", Source: "2001:db8::/32", Target: "accept", Schedule: "0 22 * * *", ScheduleFor: "8h"},
+				{Id: "day", Source: "198.51.100.0/24", Target: "accept", Schedule: "0 8 * * 1-5", ScheduleFor: "10h"},
+			},
+			live: liveState{sets: []string{"expire4-7"}, nats: natLive.nats},
+			lines: []string{
+				"add set inet netip expire4-0 { type ipv4_addr; flags interval,timeout; }",
+				"add element inet netip expire4-0 { 203.0.113.7 timeout 4h }",
+				"add element inet netip expire6-1 { 2001:db8::/32 timeout 6h49m40s }",
+				"add rule inet netip input meta l4proto tcp ip saddr @expire4-0 tcp dport 5432 counter accept comment \"contractor\"",
+				"add rule inet netip input ip6 saddr @expire6-1 counter accept comment \"night\"",
+				"add rule ip nat netip meta l4proto tcp ip saddr @expire4-0 tcp dport 5432 counter return comment \"contractor\"",
+				"delete set inet netip expire4-7",
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				exprs := ruleExprs(t, tx, "add rule ip nat netip meta l4proto tcp ip saddr @expire4-0 tcp dport 5432 counter return comment \"contractor\"")
+				if !hasExpr(exprs, func(e *expr.Lookup) bool { return e.SetName == "expire4-0" }) {
+					t.Fatal("rule does not look up expire set:", exprs)
+				}
+				if strings.Contains(script, "add element ip nat expire6-1") || strings.Contains(script, "\"day\"") {
+					t.Fatal("ipv6 expire set in ip nat table or inactive rule is rendered:\n" + script)
+				}
+			},
+		},
+		{
+			name: "drop log",
+			setup: func(t *testing.T, f *Firewall) {
+				f.dropGroup, f.dropRate = 5, 20
+			},
+			rules: []FirewallRules{{Protocol: "tcp", Ports: "22", Target: "accept"}},
+			live:  natLive,
+			lines: []string{
+				"add rule inet netip input meta l4proto tcp tcp dport 22 counter accept\n" +
+					"add rule inet netip input limit rate 20/second log prefix \"input\" group 5 snaplen 64",
+				"add rule ip nat netip limit rate 20/second log prefix \"nat\" group 5 snaplen 64\n" +
+					"add rule ip nat netip counter drop",
+			},
+			check: func(t *testing.T, tx NftTx, script string) {
+				exprs := ruleExprs(t, tx, "add rule ip nat netip limit rate 20/second log prefix \"nat\" group 5 snaplen 64")
+				if !hasExpr(exprs, func(e *expr.Limit) bool { return e.Rate == 20 }) ||
+					!hasExpr(exprs, func(e *expr.Log) bool { return e.Group == 5 && string(e.Data) == "nat" }) {
+					t.Fatal("wrong drop log expressions:", exprs)
+				}
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := NewFirewall()
+			if c.setup != nil {
+				c.setup(t, f)
+			}
+			rules, _ := f.scheduleRules(c.rules, now)
+			tx := f.nft.Begin()
+			f.render(tx, rules, c.live, now)
+			script := checkScript(t, tx, c.lines...)
+			if c.check != nil {
+				c.check(t, tx, script)
+			}
+		})
+	}
+}
+
+func TestFirewallRulesValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := FirewallRules{Protocol: "TCP", Source: " 10.1.2.3/8", Ports: "22, 8000-8080 ", Target: "Accept"}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if valid.Protocol != "tcp" || valid.Target != "accept" ||
+		valid.Source != "10.0.0.0/8" || valid.Ports != "22, 8000-8080" {
+		t.Fatalf("not normalized: %+v", valid)
+	}
+
+	// interval set of ports rejects overlaps
+	for ports, want := range map[string]string{
+		"80,80":                "80",
+		"8000-8080,8080":       "8000-8080",
+		"443, 80, 81, 82-90":   "80-90, 443",
+		"1000-2000, 1500-2500": "1000-2500",
+		"65535, 65534":         "65534-65535",
+	} {
+		r := FirewallRules{Protocol: "tcp", Ports: ports, Target: "accept"}
+		if err := r.validate(); err != nil || r.Ports != want {
+			t.Fatalf("wrong ports of %q: %q %v", ports, r.Ports, err)
+		}
+	}
+
+	host := FirewallRules{Source: " Office.Example.com. ", Target: "accept"}
+	if err := host.validate(); err != nil || host.Source != "office.example.com" {
+		t.Fatal("wrong hostname:", host.Source, err)
+	}
+
+	single := FirewallRules{Source: "2001:db8::1/128", Target: "drop"}
+	if err := single.validate(); err != nil || single.Source != "2001:db8::1" {
+		t.Fatal("wrong single ip:", single.Source, err)
+	}
+
+	for _, r := range []FirewallRules{
+		{Protocol: "tcp; reboot", Target: "accept"},
+		{Protocol: "tcp", Target: "accept; nft flush ruleset"},
+		{Protocol: "tcp", Target: ""},
+		{Source: "1.2.3.4' ; reboot '", Target: "accept"},
+		{Source: "exa mple.com", Target: "accept"},
+		{Source: "-example.com", Target: "accept"},
+		{Source: "office.example.com", Protocol: "tcp", Ports: "22", Target: "accept", NatOutput: true},
+		{Source: "1.2.3.4/33", Target: "accept"},
+		{Source: "fe80::1%eth0", Target: "accept"},
+		{Ports: "22 }; drop", Target: "accept"},
+		{Ports: "0", Target: "accept"},
+		{Ports: "65536", Target: "accept"},
+		{Ports: "90-80", Target: "accept"},
+		{Ports: "+22", Target: "accept"},
+		{Protocol: "icmp", Ports: "22", Target: "accept"},
+		{Protocol: "tcp", Target: "drop", RateLimit: 10},
+		{Protocol: "udp", Target: "accept", SynLimit: 10},
+		{Protocol: "tcp", Target: "accept", RateBurst: 10},
+		{Protocol: "tcp", Target: "accept", ConnLimit: -1},
+		{Id: "ssh\" drop", Target: "accept"},
+		{Direction: "up", Target: "accept"},
+		{Countries: "DEU", Target: "accept"},
+		{Countries: "DE", Source: "1.2.3.4", Target: "accept"},
+		{Countries: "DE", Protocol: "tcp", Ports: "22", Target: "accept", NatOutput: true},
+		{Direction: "out", Ports: "22", Target: "drop"},
+		{DestinationPorts: "22", Target: "drop"},
+		{Direction: "out", Destination: "10.0.0.0/33", Target: "drop"},
+		{Direction: "out", Source: "10.0.0.1", Destination: "2001:db8::/32", Target: "drop"},
+		{Direction: "out", Protocol: "tcp", Target: "accept", RateLimit: 10},
+		{Direction: "out", Source: "10.0.0.1", Target: "accept", NatOutput: true},
+	} {
+		if err := r.validate(); err == nil {
+			t.Fatalf("invalid rule passed: %+v", r)
+		}
+	}
+
+	if _, err := parseIfnames([]string{"*"}); err == nil {
+		t.Fatal("wildcard for all interfaces passed")
+	}
+	if _, err := parseIfnames([]string{"br-*x"}); err == nil {
+		t.Fatal("wildcard in the middle passed")
+	}
+	if _, err := parseIfnames([]string{"very-long-interface"}); err == nil {
+		t.Fatal("too long interface passed")
+	}
+}
+
+// fakeNft returns rules of chains, other methods are not used
+type fakeNft struct {
+	Nft
+	rules map[string][]nftRuleInfo
+}
+
+func (n *fakeNft) Rules(t nftTable, chain string) ([]nftRuleInfo, error) {
+	return n.rules[t.String()+" "+chain], nil
+}
+
+func TestFirewallRefreshRejected(t *testing.T) {
+	t.Parallel()
+
+	// rejected refresh does not reach nft and keeps trusted interfaces and egress policy
+	f := NewFirewall()
+	f.nft = &fakeNft{}
+	for _, r := range []struct {
+		rules   []FirewallRules
+		trusted []string
+		egress  string
+	}{
+		{[]FirewallRules{{Protocol: "tcp", Target: "allow"}}, []string{"eth9"}, "drop"},
+		{[]FirewallRules{{Protocol: "tcp", Target: "accept"}}, []string{"eth9", "br-*-x"}, "drop"},
+		{[]FirewallRules{{Protocol: "tcp", Target: "accept"}}, []string{"eth9"}, "reject"},
+	} {
+		steps := &stepErrors{}
+		f.Refresh(steps, r.rules, r.trusted, r.egress, 0)
+		if steps.Errors() == nil || !slices.Equal(f.trusted, []string{"docker0"}) || f.egressPolicy != "accept" {
+			t.Fatalf("refresh is not rejected: %+v %v %s", r, f.trusted, f.egressPolicy)
+		}
+	}
+}
+
+func TestFirewallCounters(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	f.nft = &fakeNft{rules: map[string][]nftRuleInfo{
+		"inet netip input": {
+			{Packets: 100, Bytes: 1000},
+			{Comment: "ssh/limit", Packets: 7, Bytes: 70},
+			{Comment: "ssh", Packets: 10, Bytes: 600},
+			{Comment: "web", Packets: 1, Bytes: 60},
+		},
+		"ip nat netip":  {{Comment: "ssh", Packets: 2, Bytes: 120}},
+		"ip6 nat netip": {{Comment: "web", Packets: 3, Bytes: 180}},
+	}}
+
+	counters := f.counters()
+	if len(counters) != 2 {
+		t.Fatalf("counters: %+v", counters)
+	}
+	if c := *counters[0]; c != (FirewallCounter{Id: "ssh", Packets: 12, Bytes: 720, Limited: 7}) {
+		t.Fatalf("ssh counter: %+v", c)
+	}
+	if c := *counters[1]; c != (FirewallCounter{Id: "web", Packets: 4, Bytes: 240}) {
+		t.Fatalf("web counter: %+v", c)
+	}
+}
+
+func TestFirewallDriftChanges(t *testing.T) {
+	t.Parallel()
+
+	expected := map[string]int{
+		"chain inet netip input":          1,
+		"rules inet netip input":          9,
+		"chain ip nat PREROUTING":         1,
+		"jump ip nat PREROUTING netip":    1,
+		"chain ip6 nat PREROUTING":        0,
+		"jump ip nat OUTPUT netip-output": 1,
+	}
+	if changes := driftChanges(expected, expected); len(changes) != 0 {
+		t.Fatal("drift without changes:", changes)
+	}
+
+	live := map[string]int{
+		"chain inet netip input":           1,
+		"rules inet netip input":           9,
+		"chain ip nat PREROUTING":          1,
+		"jump ip nat PREROUTING netip":     0,
+		"chain ip6 nat PREROUTING":         1,
+		"jump ip nat OUTPUT netip-output":  1,
+		"jump ip6 nat OUTPUT netip-output": 0,
+	}
+	changes := driftChanges(expected, live)
+	want := []string{
+		"chain ip6 nat PREROUTING: 1, expected 0",
+		"jump ip nat PREROUTING netip: 0, expected 1",
+	}
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("changes %q, want %q", changes, want)
+	}
+}
+
+func TestFirewallBlackHoleTimeout(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	tx := f.nft.Begin()
+	f.bhRenderSets(tx, map[string][]nftElement{
+		"IPv4": {{Prefix: netip.MustParsePrefix("203.0.113.9/32"), Timeout: time.Hour}},
+	})
+	checkScript(t, tx,
+		"add set inet netip-blackhole IPv4 { type ipv4_addr; flags interval,timeout; counter; }",
+		"add element inet netip-blackhole IPv4 { 203.0.113.9 timeout 1h }",
+	)
+
+	now := time.Now()
+	f.blackHoleExists = map[netip.Prefix]time.Time{
+		netip.MustParsePrefix("192.0.2.1/32"):  {},
+		netip.MustParsePrefix("192.0.2.2/32"):  now.Add(-time.Second),
+		netip.MustParsePrefix("2001:db8::/32"): now.Add(time.Minute),
+	}
+	f.bhPrune(now)
+	if _, ok := f.blackHoleExists[netip.MustParsePrefix("192.0.2.2/32")]; ok || len(f.blackHoleExists) != 2 {
+		t.Fatal("expired entry is not pruned:", f.blackHoleExists)
+	}
+}
+
+func TestFirewallConfirm(t *testing.T) {
+	t.Parallel()
+
+	f := NewFirewall()
+	steps := &stepErrors{}
+	if f.Confirm(steps); steps.Errors() == nil {
+		t.Fatal("confirm without pending changes passed")
+	}
+	f.confirmWait(&confirmPending{}, time.Hour)
+	if f.Confirm(steps); steps.Errors() != nil || f.confirmPending() {
+		t.Fatal("pending changes are not confirmed")
+	}
+
+	// background step without command drops its errors
+	f.Confirm(nil)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 type ConnectResponse struct {
@@ -35,27 +36,44 @@ func main() {
 
 	col := collector.New()
 
+	events := make(chan any, 16)
+
 	fw := NewFirewall()
+	fw.SetChanEvent(events)
 	fw.SetChanBHCounter(col.ChanBHCounter)
+	fw.SetChanSynproxyCounter(col.ChanSynproxyCounter)
+	// connection is restored, so applied firewall did not lock out nodes-handler
+	conn.OnHandshake(fw.ConfirmHandshake)
 	if conn.Response().Blackhole {
-		fw.BlackHoleEnable()
+		fw.BlackHoleEnable(nil)
 		fw.BlackHoleRestore()
 	} else {
-		fw.BlackHoleDestroy()
+		fw.BlackHoleDestroy(nil)
 	}
+	fw.SynproxyRestore()
 
 	// live from nodes-handler
 	go func() {
 		for p := range conn.chanLive {
 			var res struct {
+				Id          string                 `json:"id"`
 				Command     string                 `json:"command"`
 				Rules       []FirewallRules        `json:"rules"`
+				Trusted     []string               `json:"trustedInterfaces"`
+				Egress      string                 `json:"egressPolicy"`
+				Confirm     int                    `json:"confirm"`
 				IP          string                 `json:"ip"`
+				Ports       string                 `json:"ports"`
+				Timeout     int                    `json:"timeout"` // seconds of blackhole entry, 0 is permanent
+				Sync        *BlackholeSync         `json:"blackholeSync"`
+				Feed        *BlackholeFeed         `json:"blackholeFeed"`
+				Countries   string                 `json:"countries"`
 				Wireguards  map[int]WireguardsData `json:"wireguards"`
 				WireguardId int                    `json:"wireguardId"`
 				Proxies     map[int]ProxiesData    `json:"proxies"`
 				ProxyId     int                    `json:"proxyId"`
 				SpnDns      *SpnDnsBundle          `json:"spnDns"`
+				Forwards    []PortForwardsData     `json:"portForwards"`
 				PingIPs     map[string]string      `json:"pingIPs"`
 			}
 			err := json.Unmarshal(p, &res)
@@ -64,40 +82,126 @@ func main() {
 				continue
 			}
 
+			start := time.Now()
+			var errs []string
+			var result any
+			// errors of firewall steps of this command only, background ones are logged
+			steps := &stepErrors{}
+
 			switch res.Command {
 			case "services-destroy":
+				conn.Send(commandResultEvent(NewCommandResult(res.Id, res.Command, start, nil)))
 				destroy <- struct{}{}
 				return
 
 			case "firewall-refresh":
-				fw.Refresh(res.Rules)
+				unresolved := fw.Refresh(steps, res.Rules, res.Trusted, res.Egress, time.Duration(res.Confirm)*time.Second)
+				errs = steps.Errors()
+				refresh := map[string]any{}
+				if geo := fw.GeoPrefixes(); geo != nil {
+					refresh["geoPrefixes"] = geo
+				}
+				// applied, sets of hostnames are filled once they are resolved
+				if len(unresolved) > 0 {
+					refresh["unresolved"] = unresolved
+				}
+				if len(refresh) > 0 {
+					result = refresh
+				}
+			case "firewall-confirm":
+				fw.Confirm(steps)
+				errs = steps.Errors()
 			case "firewall-disable":
-				fw.Disable()
+				fw.Disable(steps)
+				errs = steps.Errors()
 			case "blackhole-enable":
-				fw.BlackHoleEnable()
+				fw.BlackHoleEnable(steps)
+				errs = steps.Errors()
 			case "blackhole-disable":
-				fw.BlackHoleDisable()
+				fw.BlackHoleDisable(steps)
+				errs = steps.Errors()
+			// result of queued change is sent by worker after its batch is applied
 			case "blackhole-add":
-				fw.BlackHoleExec("add", res.IP)
+				cmd := bhCommand{id: res.Id, command: res.Command, start: start}
+				if fw.BlackHoleExec(steps, cmd, "add", res.IP, time.Duration(res.Timeout)*time.Second) {
+					continue
+				}
+				errs = steps.Errors()
 			case "blackhole-del":
-				fw.BlackHoleExec("del", res.IP)
+				cmd := bhCommand{id: res.Id, command: res.Command, start: start}
+				if fw.BlackHoleExec(steps, cmd, "del", res.IP, 0) {
+					continue
+				}
+				errs = steps.Errors()
+			case "blackhole-sync":
+				if sr := fw.BlackHoleSync(steps, res.Sync); sr != nil {
+					result = map[string]any{"blackholeSync": sr}
+				}
+				errs = steps.Errors()
+			case "blackhole-feed-enable":
+				prefixes, skipped := fw.BlackHoleFeedEnable(steps, res.Feed)
+				errs = steps.Errors()
+				if errs == nil {
+					result = map[string]any{"prefixes": prefixes, "skipped": skipped}
+				}
+			case "blackhole-feed-disable":
+				if res.Feed != nil {
+					fw.BlackHoleFeedDisable(steps, res.Feed.Name)
+				}
+				errs = steps.Errors()
+			case "blackhole-countries":
+				fw.BlackHoleCountries(steps, res.Countries)
+				errs = steps.Errors()
+				if geo := fw.GeoPrefixes(); geo != nil {
+					result = map[string]any{"geoPrefixes": geo}
+				}
+
+			case "synproxy-enable":
+				fw.SynproxyEnable(steps, res.Ports)
+				errs = steps.Errors()
+			case "synproxy-disable":
+				fw.SynproxyDisable(steps)
+				errs = steps.Errors()
 
 			case "wireguard-refresh":
-				NewWireguard().Refresh(res.Wireguards)
+				wg := NewWireguard()
+				wg.Refresh(res.Wireguards)
+				errs = wg.Errors()
 			case "wireguard-destroy":
-				NewWireguard().Destroy(res.WireguardId)
+				wg := NewWireguard()
+				wg.Destroy(res.WireguardId)
+				errs = wg.Errors()
 			case "wireguard-shared-refresh", "wireguard-n2n-refresh":
-				NewWireguard().NodeClientRefresh(res.Wireguards)
+				wg := NewWireguard()
+				wg.NodeClientRefresh(res.Wireguards)
+				errs = wg.Errors()
 
 			case "proxy-refresh":
-				NewProxies().Refresh(res.Proxies)
+				pr := NewProxies()
+				pr.Refresh(res.Proxies)
+				errs = pr.Errors()
 			case "proxy-destroy":
-				NewProxies().Destroy(res.ProxyId)
+				pr := NewProxies()
+				pr.Destroy(res.ProxyId)
+				errs = pr.Errors()
+
+			case "portforward-refresh":
+				pf := NewPortForwards()
+				pf.Refresh(res.Forwards)
+				errs = pf.Errors()
+			case "portforward-destroy":
+				pf := NewPortForwards()
+				pf.Destroy()
+				errs = pf.Errors()
 
 			case "spn-dns-refresh":
-				NewSpnDns().Refresh(res.SpnDns)
+				sd := NewSpnDns()
+				sd.Refresh(res.SpnDns)
+				errs = sd.Errors()
 			case "spn-dns-destroy":
-				NewSpnDns().Destroy()
+				sd := NewSpnDns()
+				sd.Destroy()
+				errs = sd.Errors()
 
 			case "ping-ips-refresh":
 				log.Println("[ping] refreshing pool")
@@ -105,7 +209,14 @@ func main() {
 				for toIP, fromIP := range res.PingIPs {
 					collector.PingPool.Store(toIP, fromIP)
 				}
+
+			default:
+				errs = []string{"unknown command"}
 			}
+
+			cr := NewCommandResult(res.Id, res.Command, start, errs)
+			cr.Result = result
+			conn.Send(commandResultEvent(cr))
 		}
 	}()
 
@@ -114,75 +225,90 @@ func main() {
 	// writer to nodes-handler
 	for {
 		select {
+		// chan-sender events of subsystems
+		case ev := <-events:
+			conn.Send(ev)
+
 		// chan-sender stats network
 		case cn, ok := <-col.ChanNetwork:
 			if !ok {
 				continue
 			}
-			conn.chanSend <- struct {
-				Event          string                    `json:"event"`
-				CollectNetwork *collector.CollectNetwork `json:"collectNetwork"`
-			}{
+			conn.Send(&networkEvent{
 				Event:          "collect-network",
 				CollectNetwork: cn,
-			}
+			})
 
 		// chan-sender stats blackhole counters
 		case bhc, ok := <-col.ChanBHCounter:
 			if !ok {
 				continue
 			}
-			conn.chanSend <- struct {
+			conn.Send(&struct {
 				Event            string                      `json:"event"`
 				BlackholeCounter *collector.BlackholeCounter `json:"blackholeCounter"`
 			}{
 				Event:            "blackhole-counter",
 				BlackholeCounter: bhc,
+			})
+
+		// chan-sender stats synproxy counters
+		case spc, ok := <-col.ChanSynproxyCounter:
+			if !ok {
+				continue
 			}
+			conn.Send(&struct {
+				Event           string                     `json:"event"`
+				SynproxyCounter *collector.SynproxyCounter `json:"synproxyCounter"`
+			}{
+				Event:           "synproxy-counter",
+				SynproxyCounter: spc,
+			})
 
 		// chan-sender stats wireguard
 		case wgs, ok := <-col.ChanWgStats:
 			if !ok {
 				continue
 			}
-			conn.chanSend <- struct {
+			conn.Send(&struct {
 				Event          string                    `json:"event"`
 				WireguardStats *collector.WireguardStats `json:"wireguardStats"`
 			}{
 				Event:          "wireguard-stats",
 				WireguardStats: wgs,
-			}
+			})
 
 		// chan-sender net-sysctl
 		case nsc, ok := <-col.ChanNetSysctl:
 			if !ok {
 				continue
 			}
-			conn.chanSend <- &struct {
+			conn.Send(&struct {
 				Event     string            `json:"event"`
 				NetSysctl map[string]string `json:"netSysctl"`
 			}{
 				Event:     "net-sysctl",
 				NetSysctl: nsc,
-			}
+			})
 
 		// chan-sender ping rtt
 		case prt, ok := <-col.ChanPingRTT:
 			if !ok {
 				continue
 			}
-			conn.chanSend <- &struct {
+			conn.Send(&struct {
 				Event     string                `json:"event"`
 				PingStats []collector.PingStats `json:"pingStats"`
 			}{
 				Event:     "ping-stats",
 				PingStats: prt,
-			}
+			})
 
 		// handler destroy
 		case <-destroy:
-			fw.BlackHoleDisable()
-			fw.Disable()
+			fw.BlackHoleDisable(nil)
+			fw.SynproxyDisable(nil)
+			fw.Disable(nil)
 			log.Println("[component] service destroyed")
 			log.Println("------")
 			log.Println("below remains to execution manually:")
@@ -194,8 +320,19 @@ func main() {
 		// handler terminate
 		case <-terminate:
 			log.Println("[component] terminating...")
+			fw.BlackHoleSaveState()
 			conn.close()
 			os.Exit(0)
 		}
 	}
 }
+
+func commandResultEvent(cr *CommandResult) any {
+	return &struct {
+		Event         string         `json:"event"`
+		CommandResult *CommandResult `json:"commandResult"`
+	}{
+		Event:         "command-result",
+		CommandResult: cr,
+	}
+}
@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var (
+	nftFamilies = map[string]nftables.TableFamily{
+		"inet": nftables.TableFamilyINet,
+		"ip":   nftables.TableFamilyIPv4,
+		"ip6":  nftables.TableFamilyIPv6,
+	}
+	nftHooks = map[string]*nftables.ChainHook{
+		"prerouting":  nftables.ChainHookPrerouting,
+		"input":       nftables.ChainHookInput,
+		"forward":     nftables.ChainHookForward,
+		"output":      nftables.ChainHookOutput,
+		"postrouting": nftables.ChainHookPostrouting,
+	}
+	nftProtos = map[string]byte{
+		"icmp":      unix.IPPROTO_ICMP,
+		"tcp":       unix.IPPROTO_TCP,
+		"udp":       unix.IPPROTO_UDP,
+		"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	}
+	nftNfprotos = map[string]byte{
+		"ip":  unix.NFPROTO_IPV4,
+		"ip6": unix.NFPROTO_IPV6,
+	}
+	nftCtStates = map[string]uint32{
+		"invalid":     1,
+		"established": 2,
+		"related":     4,
+		"new":         8,
+		"untracked":   64,
+	}
+)
+
+const (
+	// nftCtStatusDnat IPS_DST_NAT bit of ct status
+	nftCtStatusDnat = 1 << 5
+	// nftElementsChunk elements per netlink message, nested attributes are limited by 64k
+	nftElementsChunk = 256
+	// nftJournalElements elements of one operation shown in journal
+	nftJournalElements = 32
+	// nftBatchBuffer socket buffers of transaction, batch is sent by one sendmsg
+	// and big sets do not fit default ones
+	nftBatchBuffer = 8 << 20
+	// NFTA_SET_EXPR and NFTA_SET_EXPRESSIONS, not in x/sys
+	nftaSetExpr        = 0x11
+	nftaSetExpressions = 0x12
+)
+
+// nftNetlink talks with nf_tables by netlink, without nft binary
+type nftNetlink struct{}
+
+func NewNftNetlink() Nft {
+	return &nftNetlink{}
+}
+
+func (n *nftNetlink) table(t nftTable) *nftables.Table {
+	return &nftables.Table{Name: t.Name, Family: nftFamilies[t.Family]}
+}
+
+func (n *nftNetlink) TableExists(t nftTable) bool {
+	_, err := (&nftables.Conn{}).ListTableOfFamily(t.Name, nftFamilies[t.Family])
+	return err == nil
+}
+
+func (n *nftNetlink) ChainExists(t nftTable, chain string) bool {
+	_, err := (&nftables.Conn{}).ListChain(n.table(t), chain)
+	return err == nil
+}
+
+func (n *nftNetlink) Rules(t nftTable, chain string) ([]nftRuleInfo, error) {
+	table := n.table(t)
+	rules, err := (&nftables.Conn{}).GetRules(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]nftRuleInfo, 0, len(rules))
+	for _, r := range rules {
+		info := nftRuleInfo{Handle: r.Handle}
+		info.Comment, _ = userdata.GetString(r.UserData, userdata.TypeComment)
+		mark := false
+		for _, e := range r.Exprs {
+			switch e := e.(type) {
+			case *expr.Verdict:
+				if e.Kind == expr.VerdictJump || e.Kind == expr.VerdictGoto {
+					info.Jump = e.Chain
+				}
+			case *expr.Counter:
+				info.Packets = e.Packets
+				info.Bytes = e.Bytes
+			case *expr.Lookup:
+				info.Set = e.SetName
+			case *expr.Meta:
+				mark = e.Key == expr.MetaKeyMARK && !e.SourceRegister
+			case *expr.Cmp:
+				if mark && len(e.Data) == 4 {
+					info.Mark = binaryutil.NativeEndian.Uint32(e.Data)
+				}
+				mark = false
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (n *nftNetlink) Sets(t nftTable) ([]string, error) {
+	sets, err := (&nftables.Conn{}).GetSets(n.table(t))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(sets))
+	for _, s := range sets {
+		if !s.Anonymous {
+			names = append(names, s.Name)
+		}
+	}
+	return names, nil
+}
+
+func (n *nftNetlink) Set(t nftTable, name string) (nftSet, error) {
+	set, err := (&nftables.Conn{}).GetSetByName(n.table(t), name)
+	if err != nil {
+		return nftSet{}, err
+	}
+	return nftSet{
+		Name:     set.Name,
+		Type:     set.KeyType.Name,
+		Interval: set.Interval,
+		Dynamic:  set.Dynamic,
+		Timeouts: set.HasTimeout,
+		Timeout:  set.Timeout,
+		Counters: n.setHasExpr(t, name),
+	}, nil
+}
+
+// setHasExpr set has expression of elements like counter, nftables does not decode it
+func (n *nftNetlink) setHasExpr(t nftTable, name string) bool {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: append([]byte(t.Name), 0)},
+		{Type: unix.NFTA_SET_NAME, Data: append([]byte(name), 0)},
+	})
+	if err != nil {
+		return false
+	}
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETSET),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append([]byte{byte(nftFamilies[t.Family]), unix.NFNETLINK_V0, 0, 0}, attrs...),
+	})
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		if len(m.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			continue
+		}
+		for ad.Next() {
+			if ad.Type() == nftaSetExpr || ad.Type() == nftaSetExpressions {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n *nftNetlink) Elements(t nftTable, name string) ([]nftElement, error) {
+	c := &nftables.Conn{}
+	set, err := c.GetSetByName(n.table(t), name)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.GetSetElements(set)
+	if err != nil {
+		return nil, err
+	}
+	return nftElementsOf(set.Interval, list), nil
+}
+
+// nftElementsOf converts keys of set to prefixes, interval set keeps
+// range as start key and end key (last address + 1) flagged IntervalEnd
+func nftElementsOf(interval bool, list []nftables.SetElement) []nftElement {
+	if !interval {
+		elements := make([]nftElement, 0, len(list))
+		for _, e := range list {
+			if a, ok := netip.AddrFromSlice(e.Key); ok {
+				element := nftElement{Prefix: netip.PrefixFrom(a, a.BitLen()), Timeout: e.Timeout, Expires: e.Expires}
+				if e.Counter != nil {
+					element.Packets, element.Bytes = e.Counter.Packets, e.Counter.Bytes
+				}
+				elements = append(elements, element)
+			}
+		}
+		return elements
+	}
+
+	slices.SortFunc(list, func(a, b nftables.SetElement) int {
+		if c := strings.Compare(string(a.Key), string(b.Key)); c != 0 {
+			return c
+		}
+		// adjacent ranges: end of previous goes first
+		if a.IntervalEnd == b.IntervalEnd {
+			return 0
+		}
+		if a.IntervalEnd {
+			return -1
+		}
+		return 1
+	})
+
+	var (
+		elements []nftElement
+		start    netip.Addr
+		key      nftables.SetElement
+	)
+	// timeout and counter are of start key, counter of range goes to its first prefix
+	rangeOf := func(start, last netip.Addr) {
+		for i, p := range rangePrefixes(start, last) {
+			element := nftElement{Prefix: p, Timeout: key.Timeout, Expires: key.Expires}
+			if i == 0 && key.Counter != nil {
+				element.Packets, element.Bytes = key.Counter.Packets, key.Counter.Bytes
+			}
+			elements = append(elements, element)
+		}
+	}
+	for _, e := range list {
+		a, ok := netip.AddrFromSlice(e.Key)
+		if !ok {
+			continue
+		}
+		if !e.IntervalEnd {
+			start, key = a, e
+			continue
+		}
+		if !start.IsValid() {
+			continue
+		}
+		rangeOf(start, a.Prev())
+		start = netip.Addr{}
+	}
+	// range up to the last address has no end key
+	if start.IsValid() {
+		rangeOf(start, prefixLast(netip.PrefixFrom(start, 0)))
+	}
+	return elements
+}
+
+// nftSnapshot rules with their anonymous sets, and for the whole table chains and named sets
+type nftSnapshot struct {
+	table  *nftables.Table
+	whole  bool
+	exists bool
+	chains []*nftables.Chain
+	sets   []*nftables.Set
+	elems  map[string][]nftables.SetElement
+	rules  map[string][]*nftables.Rule
+}
+
+func (s *nftSnapshot) String() string {
+	fam := "inet"
+	for k, v := range nftFamilies {
+		if v == s.table.Family {
+			fam = k
+		}
+	}
+	if !s.whole {
+		names := make([]string, 0, len(s.rules))
+		for c := range s.rules {
+			names = append(names, c)
+		}
+		slices.Sort(names)
+		return fmt.Sprintf("snapshot %s %s chains %s", fam, s.table.Name, strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("snapshot %s %s, exists: %t", fam, s.table.Name, s.exists)
+}
+
+func (n *nftNetlink) Snapshot(t nftTable, chains ...string) (NftSnapshot, error) {
+	c := &nftables.Conn{}
+	s := &nftSnapshot{
+		table: n.table(t),
+		whole: len(chains) == 0,
+		elems: map[string][]nftables.SetElement{},
+		rules: map[string][]*nftables.Rule{},
+	}
+
+	if _, err := c.ListTableOfFamily(t.Name, s.table.Family); err != nil {
+		if s.whole {
+			return s, nil
+		}
+		return nil, err
+	}
+	s.exists = true
+
+	if s.whole {
+		list, err := c.ListChainsOfTableFamily(s.table.Family)
+		if err != nil {
+			return nil, err
+		}
+		for _, ch := range list {
+			if ch.Table.Name == t.Name {
+				s.chains = append(s.chains, ch)
+				chains = append(chains, ch.Name)
+			}
+		}
+	}
+
+	for _, name := range chains {
+		if _, err := c.ListChain(s.table, name); err != nil {
+			// chain absent, restores as empty
+			s.rules[name] = nil
+			continue
+		}
+		rules, err := c.GetRules(s.table, &nftables.Chain{Name: name, Table: s.table})
+		if err != nil {
+			return nil, err
+		}
+		s.rules[name] = rules
+	}
+
+	// sets are needed only by saved rules, except of the whole table
+	used := map[string]bool{}
+	for _, rules := range s.rules {
+		for _, r := range rules {
+			for _, e := range r.Exprs {
+				switch e := e.(type) {
+				case *expr.Lookup:
+					used[e.SetName] = true
+				case *expr.Dynset:
+					used[e.SetName] = true
+				}
+			}
+		}
+	}
+	sets, err := c.GetSets(s.table)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		if !used[set.Name] && (set.Anonymous || !s.whole) {
+			continue
+		}
+		list, err := c.GetSetElements(set)
+		if err != nil {
+			return nil, err
+		}
+		s.sets = append(s.sets, set)
+		s.elems[set.Name] = list
+	}
+
+	return s, nil
+}
+
+func (n *nftNetlink) Begin() NftTx {
+	return &nftNetlinkTx{
+		nftNetlink: n,
+		conn:       nftBatchConn(),
+		sets:       map[nftTable]map[string]*nftables.Set{},
+	}
+}
+
+// nftBatchConn conn with forced socket buffers, limits of sysctl are bypassed by CAP_NET_ADMIN
+func nftBatchConn() *nftables.Conn {
+	conn, err := nftables.New(nftables.WithSockOptions(func(c *netlink.Conn) error {
+		raw, err := c.SyscallConn()
+		if err != nil {
+			return nil
+		}
+		_ = raw.Control(func(fd uintptr) {
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, nftBatchBuffer)
+			_ = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, nftBatchBuffer)
+		})
+		return nil
+	}))
+	if err != nil {
+		return &nftables.Conn{}
+	}
+	return conn
+}
+
+// nftNetlinkTx queues messages into one netlink batch, the kernel applies it atomically
+type nftNetlinkTx struct {
+	*nftNetlink
+	conn    *nftables.Conn
+	sets    map[nftTable]map[string]*nftables.Set
+	journal []string
+	// compiled expressions of rules by their journal line
+	compiled map[string][]expr.Any
+	err      error
+}
+
+func (tx *nftNetlinkTx) log(format string, a ...any) {
+	tx.journal = append(tx.journal, fmt.Sprintf(format, a...))
+}
+
+func (tx *nftNetlinkTx) setErr(err error) {
+	if err != nil && tx.err == nil {
+		tx.err = err
+	}
+}
+
+func (tx *nftNetlinkTx) chain(t nftTable, name string) *nftables.Chain {
+	return &nftables.Chain{Name: name, Table: tx.table(t)}
+}
+
+func (tx *nftNetlinkTx) set(t nftTable, name string) *nftables.Set {
+	if s, ok := tx.sets[t][name]; ok {
+		return s
+	}
+	return &nftables.Set{Name: name, Table: tx.table(t)}
+}
+
+func (tx *nftNetlinkTx) AddTable(t nftTable) {
+	tx.log("add table %s", t)
+	tx.conn.AddTable(tx.table(t))
+}
+
+func (tx *nftNetlinkTx) DelTable(t nftTable) {
+	tx.log("delete table %s", t)
+	tx.conn.DelTable(tx.table(t))
+}
+
+func (tx *nftNetlinkTx) AddChain(t nftTable, c nftChain) {
+	tx.log("add chain %s %s", t, c)
+	chain := tx.chain(t, c.Name)
+	if c.Hook != "" {
+		hook, ok := nftHooks[c.Hook]
+		if !ok {
+			tx.setErr(fmt.Errorf("unknown hook %q", c.Hook))
+			return
+		}
+		policy := nftables.ChainPolicyAccept
+		if c.Policy == "drop" {
+			policy = nftables.ChainPolicyDrop
+		}
+		chain.Type = nftables.ChainType(c.Type)
+		chain.Hooknum = hook
+		chain.Priority = nftables.ChainPriorityRef(nftables.ChainPriority(c.Priority))
+		chain.Policy = &policy
+	}
+	tx.conn.AddChain(chain)
+}
+
+func (tx *nftNetlinkTx) FlushChain(t nftTable, chain string) {
+	tx.log("flush chain %s %s", t, chain)
+	tx.conn.FlushChain(tx.chain(t, chain))
+}
+
+func (tx *nftNetlinkTx) DelChain(t nftTable, chain string) {
+	tx.log("delete chain %s %s", t, chain)
+	tx.conn.DelChain(tx.chain(t, chain))
+}
+
+func (tx *nftNetlinkTx) AddSet(t nftTable, s nftSet) {
+	tx.log("add set %s %s", t, s)
+	set := &nftables.Set{
+		Table:      tx.table(t),
+		Name:       s.Name,
+		Interval:   s.Interval,
+		Dynamic:    s.Dynamic,
+		HasTimeout: s.Timeout > 0 || s.Timeouts,
+		Timeout:    s.Timeout,
+		Size:       s.Size,
+		Counter:    s.Counters,
+		KeyType:    nftables.TypeIPAddr,
+	}
+	if s.Type == "ipv6_addr" {
+		set.KeyType = nftables.TypeIP6Addr
+	}
+	tx.setErr(tx.conn.AddSet(set, nil))
+	if tx.sets[t] == nil {
+		tx.sets[t] = map[string]*nftables.Set{}
+	}
+	tx.sets[t][s.Name] = set
+}
+
+func (tx *nftNetlinkTx) DelSet(t nftTable, set string) {
+	tx.log("delete set %s %s", t, set)
+	tx.conn.DelSet(tx.set(t, set))
+}
+
+func (tx *nftNetlinkTx) FlushSet(t nftTable, set string) {
+	tx.log("flush set %s %s", t, set)
+	tx.conn.FlushSet(tx.set(t, set))
+}
+
+func (tx *nftNetlinkTx) AddElements(t nftTable, set string, elements []nftElement) {
+	if len(elements) == 0 {
+		return
+	}
+	tx.log("add element %s %s { %s }", t, set, nftJoin(elements))
+	s := tx.set(t, set)
+	if !s.HasTimeout && slices.ContainsFunc(elements, func(e nftElement) bool { return e.Timeout > 0 }) {
+		// set of other transaction, timeouts are sent only for sets with the flag
+		ts := *s
+		ts.HasTimeout = true
+		s = &ts
+	}
+	for chunk := range slices.Chunk(elements, nftElementsChunk) {
+		tx.setErr(tx.conn.SetAddElements(s, nftSetElements(chunk)))
+	}
+}
+
+func (tx *nftNetlinkTx) DelElements(t nftTable, set string, elements []nftElement) {
+	if len(elements) == 0 {
+		return
+	}
+	tx.log("delete element %s %s { %s }", t, set, nftJoin(elements))
+	for chunk := range slices.Chunk(elements, nftElementsChunk) {
+		tx.setErr(tx.conn.SetDeleteElements(tx.set(t, set), nftSetElements(chunk)))
+	}
+}
+
+func (tx *nftNetlinkTx) AddRule(t nftTable, chain string, r nftRule) {
+	tx.log("add rule %s %s %s", t, chain, r)
+	exprs, err := tx.compileRule(t, r)
+	if err != nil {
+		return
+	}
+	tx.conn.AddRule(&nftables.Rule{Table: tx.table(t), Chain: tx.chain(t, chain), Exprs: exprs, UserData: nftComment(r)})
+}
+
+func (tx *nftNetlinkTx) InsertRule(t nftTable, chain string, r nftRule) {
+	tx.log("insert rule %s %s %s", t, chain, r)
+	exprs, err := tx.compileRule(t, r)
+	if err != nil {
+		return
+	}
+	tx.conn.InsertRule(&nftables.Rule{Table: tx.table(t), Chain: tx.chain(t, chain), Exprs: exprs, UserData: nftComment(r)})
+}
+
+func (tx *nftNetlinkTx) DelRule(t nftTable, chain string, handle uint64) {
+	tx.log("delete rule %s %s handle %d", t, chain, handle)
+	tx.setErr(tx.conn.DelRule(&nftables.Rule{Table: tx.table(t), Chain: tx.chain(t, chain), Handle: handle}))
+}
+
+func (tx *nftNetlinkTx) Restore(snapshot NftSnapshot) {
+	s, ok := snapshot.(*nftSnapshot)
+	if !ok {
+		tx.setErr(errors.New("foreign snapshot"))
+		return
+	}
+	tx.log("restore %s", s)
+	table := s.table
+
+	if s.whole {
+		// add before delete, the table could not exist
+		tx.conn.AddTable(table)
+		tx.conn.DelTable(table)
+		if !s.exists {
+			return
+		}
+		tx.conn.AddTable(table)
+		for _, ch := range s.chains {
+			c := *ch
+			c.Table = table
+			tx.conn.AddChain(&c)
+		}
+	} else {
+		// foreign chains keep jumps to them, so only flush
+		for name := range s.rules {
+			ch := &nftables.Chain{Name: name, Table: table}
+			tx.conn.AddChain(ch)
+			tx.conn.FlushChain(ch)
+		}
+	}
+
+	renamed := map[string]*nftables.Set{}
+	for _, set := range s.sets {
+		ns := *set
+		ns.Table = table
+		ns.ID = 0
+		elems := s.elems[set.Name]
+		if set.Dynamic {
+			// filled by rules again
+			elems = nil
+		}
+		if set.Anonymous {
+			tx.setErr(tx.conn.AddSet(&ns, elems))
+		} else {
+			tx.setErr(tx.conn.AddSet(&ns, nil))
+			for chunk := range slices.Chunk(nftRestoreElements(elems), nftElementsChunk*2) {
+				tx.setErr(tx.conn.SetAddElements(&ns, chunk))
+			}
+		}
+		renamed[set.Name] = &ns
+	}
+
+	for name, rules := range s.rules {
+		ch := &nftables.Chain{Name: name, Table: table}
+		for _, r := range rules {
+			exprs := make([]expr.Any, len(r.Exprs))
+			for i, e := range r.Exprs {
+				if l, ok := e.(*expr.Lookup); ok {
+					if ns, ok := renamed[l.SetName]; ok {
+						nl := *l
+						nl.SetName = ns.Name
+						nl.SetID = ns.ID
+						e = &nl
+					}
+				}
+				exprs[i] = e
+			}
+			tx.conn.AddRule(&nftables.Rule{Table: table, Chain: ch, Exprs: exprs, UserData: r.UserData})
+		}
+	}
+}
+
+func (tx *nftNetlinkTx) Commit() error {
+	if tx.err != nil {
+		return tx.err
+	}
+	if len(tx.journal) == 0 {
+		return nil
+	}
+	return tx.conn.Flush()
+}
+
+func (tx *nftNetlinkTx) String() string {
+	return strings.Join(tx.journal, "\n") + "\n"
+}
+
+// anonymous constant set for the rule, exists only with the rule
+func (tx *nftNetlinkTx) anonymous(t nftTable, key nftables.SetDatatype, interval bool, list []nftables.SetElement) (*nftables.Set, error) {
+	set := &nftables.Set{
+		Table:     tx.table(t),
+		Anonymous: true,
+		Constant:  true,
+		Interval:  interval,
+		KeyType:   key,
+	}
+	if err := tx.conn.AddSet(set, list); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// compileRule compiles rule of last journal line and keeps its expressions
+func (tx *nftNetlinkTx) compileRule(t nftTable, r nftRule) ([]expr.Any, error) {
+	exprs, err := tx.compile(t, r)
+	if err != nil {
+		tx.setErr(fmt.Errorf("rule %q: %w", r, err))
+		return nil, err
+	}
+	if tx.compiled == nil {
+		tx.compiled = map[string][]expr.Any{}
+	}
+	tx.compiled[tx.journal[len(tx.journal)-1]] = exprs
+	return exprs, nil
+}
+
+func (tx *nftNetlinkTx) compile(t nftTable, r nftRule) ([]expr.Any, error) {
+	var exprs []expr.Any
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case matchIfname:
+			key := expr.MetaKeyIIFNAME
+			if e.Out {
+				key = expr.MetaKeyOIFNAME
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: key, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfname(e.Name)})
+		case matchCtState:
+			var bits uint32
+			for _, st := range e.States {
+				b, ok := nftCtStates[st]
+				if !ok {
+					return nil, fmt.Errorf("unknown ct state %q", st)
+				}
+				bits |= b
+			}
+			exprs = append(exprs,
+				&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+					Mask: binaryutil.NativeEndian.PutUint32(bits), Xor: make([]byte, 4)},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)})
+		case matchL4proto:
+			protos := make([]byte, 0, len(e.Protos))
+			for _, p := range e.Protos {
+				b, ok := nftProtos[p]
+				if !ok {
+					return nil, fmt.Errorf("unknown protocol %q", p)
+				}
+				protos = append(protos, b)
+			}
+			exprs = append(exprs, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1})
+			if len(protos) == 1 {
+				exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: protos})
+				continue
+			}
+			list := make([]nftables.SetElement, len(protos))
+			for i, b := range protos {
+				list[i] = nftables.SetElement{Key: []byte{b}}
+			}
+			set, err := tx.anonymous(t, nftables.TypeInetProto, false, list)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID})
+		case matchAddr:
+			ex, err := tx.compileAddr(t, e)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, ex...)
+		case matchPort:
+			ex, err := tx.compilePort(t, e)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, ex...)
+		case matchNfproto:
+			proto, ok := nftNfprotos[e.Family]
+			if !ok {
+				return nil, fmt.Errorf("unknown family %q", e.Family)
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}})
+		case matchFibLocal:
+			exprs = append(exprs,
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)})
+		case matchTcpSyn:
+			exprs = append(exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0x12}, Xor: []byte{0}},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x02}})
+		case stmtMeter:
+			ex, err := tx.compileMeter(t, e)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, ex...)
+		case matchMark:
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(e.Mark)})
+		case stmtCounter:
+			exprs = append(exprs, &expr.Counter{})
+		case stmtMarkSet:
+			exprs = append(exprs,
+				&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(e.Mark)},
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1})
+		case stmtVerdict:
+			v, err := tx.compileVerdict(t, e)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, v)
+		case stmtLimit:
+			if e.Rate <= 0 {
+				return nil, errors.New("limit rate must be positive")
+			}
+			exprs = append(exprs, &expr.Limit{Type: expr.LimitTypePkts, Rate: uint64(e.Rate),
+				Unit: expr.LimitTimeSecond, Burst: uint32(e.Rate)})
+		case stmtLog:
+			exprs = append(exprs, &expr.Log{
+				Key:     1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_SNAPLEN,
+				Group:   e.Group,
+				Data:    []byte(e.Prefix),
+				Snaplen: e.Snaplen,
+			})
+		case stmtNotrack:
+			exprs = append(exprs, &expr.Notrack{})
+		case stmtSynproxy:
+			exprs = append(exprs, &expr.SynProxy{Mss: e.Mss, Wscale: e.Wscale, Timestamp: true, SackPerm: true,
+				MssValueSet: true, WscaleValueSet: true})
+		case stmtRedirect:
+			exprs = append(exprs, &expr.Redir{})
+		case stmtMasquerade:
+			exprs = append(exprs, &expr.Masq{})
+		case matchCtDnat:
+			exprs = append(exprs,
+				&expr.Ct{Key: expr.CtKeySTATUS, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+					Mask: binaryutil.NativeEndian.PutUint32(nftCtStatusDnat), Xor: make([]byte, 4)},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)})
+		case stmtDnat:
+			ex, err := tx.compileDnat(t, e)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, ex...)
+		default:
+			return nil, fmt.Errorf("unsupported expression %T", e)
+		}
+	}
+	return exprs, nil
+}
+
+// addrLoad loads source or destination address into register 1
+func (tx *nftNetlinkTx) addrLoad(t nftTable, family string, dst bool) []expr.Any {
+	var (
+		exprs  []expr.Any
+		offset uint32 = 12
+		size   uint32 = 4
+		proto  byte   = unix.NFPROTO_IPV4
+	)
+	if family == "ip6" {
+		offset, size, proto = 8, 16, unix.NFPROTO_IPV6
+	}
+	if dst {
+		offset += size
+	}
+
+	// inet table sees both families, address needs dependency on family
+	if t.Family == "inet" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}})
+	}
+	return append(exprs, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          size,
+	})
+}
+
+func (tx *nftNetlinkTx) compileDnat(t nftTable, d stmtDnat) ([]expr.Any, error) {
+	var proto byte = unix.NFPROTO_IPV4
+	if d.Family == "ip6" {
+		proto = unix.NFPROTO_IPV6
+	}
+	if !d.Addr.IsValid() || d.Addr.Is4() != (proto == unix.NFPROTO_IPV4) {
+		return nil, fmt.Errorf("dnat address %q of family %s", d.Addr, d.Family)
+	}
+
+	var exprs []expr.Any
+	// nat in inet table works per family of packet
+	if t.Family == "inet" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}})
+	}
+	nat := &expr.NAT{Type: expr.NATTypeDestNAT, Family: uint32(proto), RegAddrMin: 1}
+	exprs = append(exprs, &expr.Immediate{Register: 1, Data: d.Addr.AsSlice()})
+	if d.Port > 0 {
+		nat.RegProtoMin = 2
+		nat.Specified = true
+		exprs = append(exprs, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(d.Port)})
+	}
+	return append(exprs, nat), nil
+}
+
+func (tx *nftNetlinkTx) compileMeter(t nftTable, m stmtMeter) ([]expr.Any, error) {
+	if m.Over <= 0 {
+		return nil, errors.New("meter limit must be positive")
+	}
+	set := tx.set(t, m.Set)
+	dynset := &expr.Dynset{SrcRegKey: 1, SetName: set.Name, SetID: set.ID}
+	if m.Conn {
+		dynset.Operation = unix.NFT_DYNSET_OP_ADD
+		dynset.Exprs = []expr.Any{&expr.Connlimit{Count: uint32(m.Over), Flags: expr.NFT_CONNLIMIT_F_INV}}
+	} else {
+		dynset.Operation = unix.NFT_DYNSET_OP_UPDATE
+		dynset.Exprs = []expr.Any{&expr.Limit{Type: expr.LimitTypePkts, Rate: uint64(m.Over),
+			Over: true, Unit: expr.LimitTimeSecond, Burst: uint32(m.Burst)}}
+	}
+	return append(tx.addrLoad(t, m.Family, false), dynset), nil
+}
+
+func (tx *nftNetlinkTx) compileAddr(t nftTable, m matchAddr) ([]expr.Any, error) {
+	var (
+		size uint32 = 4
+		key         = nftables.TypeIPAddr
+	)
+	if m.Family == "ip6" {
+		size, key = 16, nftables.TypeIP6Addr
+	}
+	exprs := tx.addrLoad(t, m.Family, m.Dst)
+
+	if m.Set != "" {
+		set := tx.set(t, m.Set)
+		return append(exprs, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: m.Neg}), nil
+	}
+
+	for _, p := range m.Prefixes {
+		if p.Addr().BitLen() != int(size)*8 {
+			return nil, fmt.Errorf("address %s is not %s", p, m.Family)
+		}
+	}
+
+	op := expr.CmpOpEq
+	if m.Neg {
+		op = expr.CmpOpNeq
+	}
+	if len(m.Prefixes) == 1 {
+		p := m.Prefixes[0]
+		if !p.IsSingleIP() {
+			mask := netip.PrefixFrom(prefixLast(netip.PrefixFrom(p.Addr(), 0)), p.Bits()).Masked().Addr()
+			exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: size,
+				Mask: mask.AsSlice(), Xor: make([]byte, size)})
+		}
+		return append(exprs, &expr.Cmp{Op: op, Register: 1, Data: p.Addr().AsSlice()}), nil
+	}
+
+	elements := make([]nftElement, len(m.Prefixes))
+	for i, p := range m.Prefixes {
+		elements[i] = nftElement{Prefix: p}
+	}
+	set, err := tx.anonymous(t, key, true, nftSetElements(elements))
+	if err != nil {
+		return nil, err
+	}
+	return append(exprs, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: m.Neg}), nil
+}
+
+func (tx *nftNetlinkTx) compilePort(t nftTable, m matchPort) ([]expr.Any, error) {
+	var offset uint32
+	if m.Dst {
+		offset = 2
+	}
+	exprs := []expr.Any{&expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       offset,
+		Len:          2,
+	}}
+
+	if len(m.Ports) == 1 && m.Ports[0].From == m.Ports[0].To {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1,
+			Data: binaryutil.BigEndian.PutUint16(m.Ports[0].From)}), nil
+	}
+
+	list := make([]nftables.SetElement, 0, len(m.Ports)*2)
+	for _, p := range m.Ports {
+		list = append(list, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(p.From)})
+		if p.To < 65535 {
+			list = append(list, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(p.To + 1), IntervalEnd: true})
+		}
+	}
+	set, err := tx.anonymous(t, nftables.TypeInetService, true, list)
+	if err != nil {
+		return nil, err
+	}
+	return append(exprs, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID}), nil
+}
+
+func (tx *nftNetlinkTx) compileVerdict(t nftTable, v stmtVerdict) (expr.Any, error) {
+	switch v.Kind {
+	case "accept":
+		return &expr.Verdict{Kind: expr.VerdictAccept}, nil
+	case "drop":
+		return &expr.Verdict{Kind: expr.VerdictDrop}, nil
+	case "return":
+		return &expr.Verdict{Kind: expr.VerdictReturn}, nil
+	case "jump":
+		return &expr.Verdict{Kind: expr.VerdictJump, Chain: v.Chain}, nil
+	case "reject":
+		// icmpx is only for inet, port unreachable of icmp is 3 and of icmpv6 is 4
+		switch t.Family {
+		case "inet":
+			return &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH}, nil
+		case "ip6":
+			return &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 4}, nil
+		}
+		return &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 3}, nil
+	}
+	return nil, fmt.Errorf("unknown verdict %q", v.Kind)
+}
+
+// nftRestoreElements elements with timeout get the time they had left, expired ones are skipped
+func nftRestoreElements(list []nftables.SetElement) []nftables.SetElement {
+	restored := make([]nftables.SetElement, 0, len(list))
+	for _, e := range list {
+		if e.Timeout > 0 {
+			if e.Expires <= 0 {
+				continue
+			}
+			e.Timeout, e.Expires = e.Expires, 0
+		}
+		restored = append(restored, e)
+	}
+	return restored
+}
+
+// nftSetElements keys of interval set: start and end as last address + 1,
+// timeout is only on start, kernel rejects it on end
+func nftSetElements(elements []nftElement) []nftables.SetElement {
+	list := make([]nftables.SetElement, 0, len(elements)*2)
+	for _, e := range elements {
+		list = append(list, nftables.SetElement{Key: e.Prefix.Addr().AsSlice(), Timeout: e.Timeout})
+		if end := prefixLast(e.Prefix).Next(); end.IsValid() {
+			list = append(list, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return list
+}
+
+func nftComment(r nftRule) []byte {
+	if r.Comment == "" {
+		return nil
+	}
+	return userdata.AppendString(nil, userdata.TypeComment, r.Comment)
+}
+
+// nftIfname interface name as kernel keeps it, wildcard compares only prefix
+func nftIfname(name string) []byte {
+	if prefix, ok := strings.CutSuffix(name, "*"); ok {
+		return []byte(prefix)
+	}
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// nftJoin elements for journal, long lists are cut
+func nftJoin(elements []nftElement) string {
+	list := make([]string, 0, min(len(elements), nftJournalElements)+1)
+	for _, e := range elements[:min(len(elements), nftJournalElements)] {
+		list = append(list, e.String())
+	}
+	if len(elements) > nftJournalElements {
+		list = append(list, fmt.Sprintf("... %d more", len(elements)-nftJournalElements))
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nft backend of nftables, reads return structured data,
+// writes are queued in transaction and applied atomically by Commit
+type Nft interface {
+	TableExists(t nftTable) bool
+	ChainExists(t nftTable, chain string) bool
+	Rules(t nftTable, chain string) ([]nftRuleInfo, error)
+	Sets(t nftTable) ([]string, error)
+	Set(t nftTable, name string) (nftSet, error)
+	Elements(t nftTable, set string) ([]nftElement, error)
+	Snapshot(t nftTable, chains ...string) (NftSnapshot, error)
+	Begin() NftTx
+}
+
+type NftTx interface {
+	AddTable(t nftTable)
+	DelTable(t nftTable)
+	AddChain(t nftTable, c nftChain)
+	FlushChain(t nftTable, chain string)
+	DelChain(t nftTable, chain string)
+	AddSet(t nftTable, s nftSet)
+	DelSet(t nftTable, set string)
+	FlushSet(t nftTable, set string)
+	AddElements(t nftTable, set string, elements []nftElement)
+	DelElements(t nftTable, set string, elements []nftElement)
+	AddRule(t nftTable, chain string, r nftRule)
+	InsertRule(t nftTable, chain string, r nftRule)
+	DelRule(t nftTable, chain string, handle uint64)
+	Restore(s NftSnapshot)
+	Commit() error
+	// String journal of queued operations in nft syntax, for logs
+	String() string
+}
+
+// NftSnapshot saved state of the whole table, or only of chains when they are given
+type NftSnapshot interface {
+	String() string
+}
+
+type nftTable struct {
+	Family string
+	Name   string
+}
+
+func (t nftTable) String() string {
+	return t.Family + " " + t.Name
+}
+
+type nftChain struct {
+	Name     string
+	Type     string
+	Hook     string
+	Priority int
+	Policy   string
+}
+
+func (c nftChain) String() string {
+	if c.Hook == "" {
+		return c.Name
+	}
+	return fmt.Sprintf("%s { type %s hook %s priority %d; policy %s; }",
+		c.Name, c.Type, c.Hook, c.Priority, c.Policy)
+}
+
+// nftSet named set, dynamic is filled by rules (meter),
+// timeouts allows own timeout of elements without default one
+type nftSet struct {
+	Name     string
+	Type     string
+	Interval bool
+	Dynamic  bool
+	Timeouts bool
+	Timeout  time.Duration
+	Size     uint32
+	// Counters of packets per element
+	Counters bool
+}
+
+func (s nftSet) String() string {
+	b := &strings.Builder{}
+	b.WriteString(s.Name + " { type " + s.Type + ";")
+	if s.Size > 0 {
+		_, _ = fmt.Fprintf(b, " size %d;", s.Size)
+	}
+	var flags []string
+	if s.Interval {
+		flags = append(flags, "interval")
+	}
+	if s.Dynamic {
+		flags = append(flags, "dynamic")
+	}
+	if s.Timeout > 0 || s.Timeouts {
+		flags = append(flags, "timeout")
+	}
+	if len(flags) > 0 {
+		b.WriteString(" flags " + strings.Join(flags, ",") + ";")
+	}
+	if s.Timeout > 0 {
+		b.WriteString(" timeout " + nftTimeout(s.Timeout) + ";")
+	}
+	if s.Counters {
+		b.WriteString(" counter;")
+	}
+	b.WriteString(" }")
+	return b.String()
+}
+
+// nftElement prefix, timeout when adding to set with timeouts,
+// expires is left time and counters are of set with counters when reading
+type nftElement struct {
+	Prefix  netip.Prefix
+	Timeout time.Duration
+	Expires time.Duration
+	Packets uint64
+	Bytes   uint64
+}
+
+func (e nftElement) String() string {
+	if e.Timeout > 0 {
+		return prefixString(e.Prefix) + " timeout " + nftTimeout(e.Timeout)
+	}
+	return prefixString(e.Prefix)
+}
+
+// nftRuleInfo rule read from kernel
+type nftRuleInfo struct {
+	Handle  uint64
+	Comment string
+	Packets uint64
+	Bytes   uint64
+	Jump    string
+	Set     string
+	Mark    uint32
+}
+
+type nftRule struct {
+	Exprs   []nftExpr
+	Comment string
+}
+
+func ruleOf(exprs ...nftExpr) nftRule {
+	return nftRule{Exprs: exprs}
+}
+
+// commented rule, the comment is kept by kernel and returns in rule info
+func (r nftRule) commented(comment string) nftRule {
+	r.Comment = comment
+	return r
+}
+
+func (r nftRule) String() string {
+	parts := make([]string, len(r.Exprs), len(r.Exprs)+1)
+	for i, e := range r.Exprs {
+		parts[i] = e.String()
+	}
+	if r.Comment != "" {
+		parts = append(parts, "comment "+strconv.Quote(r.Comment))
+	}
+	return strings.Join(parts, " ")
+}
+
+// nftExpr matches and statements of rules, backend compiles them
+type nftExpr interface {
+	String() string
+}
+
+// matchIfname iifname or oifname, wildcard by suffix "*"
+type matchIfname struct {
+	Out  bool
+	Name string
+}
+
+func (m matchIfname) String() string {
+	if m.Out {
+		return "oifname " + strconv.Quote(m.Name)
+	}
+	return "iifname " + strconv.Quote(m.Name)
+}
+
+type matchCtState struct {
+	States []string
+}
+
+func (m matchCtState) String() string {
+	return "ct state " + strings.Join(m.States, ",")
+}
+
+type matchL4proto struct {
+	Protos []string
+}
+
+func (m matchL4proto) String() string {
+	return "meta l4proto " + nftList(m.Protos)
+}
+
+// matchAddr ip/ip6 saddr/daddr with prefixes or named set
+type matchAddr struct {
+	Family   string
+	Dst      bool
+	Neg      bool
+	Prefixes []netip.Prefix
+	Set      string
+}
+
+func (m matchAddr) String() string {
+	s := m.Family + " saddr "
+	if m.Dst {
+		s = m.Family + " daddr "
+	}
+	if m.Neg {
+		s += "!= "
+	}
+	if m.Set != "" {
+		return s + "@" + m.Set
+	}
+	list := make([]string, len(m.Prefixes))
+	for i, p := range m.Prefixes {
+		list[i] = prefixString(p)
+	}
+	return s + nftList(list)
+}
+
+type nftPortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (p nftPortRange) String() string {
+	if p.From == p.To {
+		return strconv.Itoa(int(p.From))
+	}
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
+
+// matchPort tcp/udp/th sport/dport
+type matchPort struct {
+	Proto string
+	Dst   bool
+	Ports []nftPortRange
+}
+
+func (m matchPort) String() string {
+	s := m.Proto + " sport "
+	if m.Dst {
+		s = m.Proto + " dport "
+	}
+	list := make([]string, len(m.Ports))
+	for i, p := range m.Ports {
+		list[i] = p.String()
+	}
+	return s + nftList(list)
+}
+
+// matchNfproto family of packet in inet table
+type matchNfproto struct {
+	Family string
+}
+
+func (m matchNfproto) String() string {
+	if m.Family == "ip6" {
+		return "meta nfproto ipv6"
+	}
+	return "meta nfproto ipv4"
+}
+
+type matchFibLocal struct{}
+
+func (m matchFibLocal) String() string {
+	return "fib daddr type local"
+}
+
+// matchTcpSyn first packet of tcp handshake
+type matchTcpSyn struct{}
+
+func (m matchTcpSyn) String() string {
+	return "tcp flags & (syn | ack) == syn"
+}
+
+type matchMark struct {
+	Mark uint32
+}
+
+func (m matchMark) String() string {
+	return fmt.Sprintf("mark 0x%08x", m.Mark)
+}
+
+// matchCtDnat connection with translated destination
+type matchCtDnat struct{}
+
+func (m matchCtDnat) String() string {
+	return "ct status dnat"
+}
+
+type stmtCounter struct{}
+
+func (s stmtCounter) String() string {
+	return "counter"
+}
+
+type stmtMarkSet struct {
+	Mark uint32
+}
+
+func (s stmtMarkSet) String() string {
+	return fmt.Sprintf("meta mark set 0x%08x", s.Mark)
+}
+
+// stmtVerdict accept, drop, reject, return, jump
+type stmtVerdict struct {
+	Kind  string
+	Chain string
+}
+
+func (s stmtVerdict) String() string {
+	if s.Chain != "" {
+		return s.Kind + " " + s.Chain
+	}
+	return s.Kind
+}
+
+// stmtMeter updates dynamic set by source address with per-element limit:
+// rate of packets over limit or count of connections over limit (Conn)
+type stmtMeter struct {
+	Set    string
+	Family string
+	Conn   bool
+	Over   int
+	Burst  int
+}
+
+func (s stmtMeter) String() string {
+	if s.Conn {
+		return fmt.Sprintf("add @%s { %s saddr ct count over %d }", s.Set, s.Family, s.Over)
+	}
+	burst := ""
+	if s.Burst > 0 {
+		burst = fmt.Sprintf(" burst %d packets", s.Burst)
+	}
+	return fmt.Sprintf("update @%s { %s saddr limit rate over %d/second%s }", s.Set, s.Family, s.Over, burst)
+}
+
+// stmtLimit matches packets under rate per second
+type stmtLimit struct {
+	Rate int
+}
+
+func (s stmtLimit) String() string {
+	return fmt.Sprintf("limit rate %d/second", s.Rate)
+}
+
+// stmtLog sends packet to nflog group, snaplen bytes of packet are copied
+type stmtLog struct {
+	Group   uint16
+	Prefix  string
+	Snaplen uint32
+}
+
+func (s stmtLog) String() string {
+	return fmt.Sprintf("log prefix %q group %d snaplen %d", s.Prefix, s.Group, s.Snaplen)
+}
+
+// stmtNotrack skips connection tracking of packet
+type stmtNotrack struct{}
+
+func (s stmtNotrack) String() string {
+	return "notrack"
+}
+
+// stmtSynproxy answers syn by syn cookie and opens connection to socket after valid ack,
+// options are announced to clients, rule matches family they are for
+type stmtSynproxy struct {
+	Mss    uint16
+	Wscale uint8
+}
+
+func (s stmtSynproxy) String() string {
+	return fmt.Sprintf("synproxy mss %d wscale %d timestamp sack-perm", s.Mss, s.Wscale)
+}
+
+type stmtRedirect struct{}
+
+func (s stmtRedirect) String() string {
+	return "redirect"
+}
+
+// stmtDnat destination nat to address, port 0 keeps port of packet
+type stmtDnat struct {
+	Family string
+	Addr   netip.Addr
+	Port   uint16
+}
+
+func (s stmtDnat) String() string {
+	to := s.Addr.String()
+	if s.Port > 0 {
+		to = netip.AddrPortFrom(s.Addr, s.Port).String()
+	}
+	return "dnat " + s.Family + " to " + to
+}
+
+type stmtMasquerade struct{}
+
+func (s stmtMasquerade) String() string {
+	return "masquerade"
+}
+
+func nftList(list []string) string {
+	if len(list) == 1 {
+		return list[0]
+	}
+	return "{ " + strings.Join(list, ", ") + " }"
+}
+
+// rangePrefixes splits range of addresses into minimal list of prefixes
+func rangePrefixes(from, to netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for from.IsValid() && from.Compare(to) <= 0 {
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1).Masked()
+			if p.Addr() != from || prefixLast(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		prefixes = append(prefixes, p)
+		last := prefixLast(p)
+		if last == to {
+			break
+		}
+		from = last.Next()
+	}
+	return prefixes
+}
+
+// prefixLast returns the last address of prefix
+func prefixLast(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return last
+}
+
+// nftTimeout formats duration as nft does: 1h2m3s
+func nftTimeout(d time.Duration) string {
+	s := d.Truncate(time.Second).String()
+	s = strings.Replace(s, "m0s", "m", 1)
+	return strings.Replace(s, "h0m", "h", 1)
+}
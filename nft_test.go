@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNftElements(t *testing.T) {
+	t.Parallel()
+
+	var elements []nftElement
+	for _, s := range []string{"0.0.0.0/8", "10.0.0.0/8", "11.0.0.0/8", "192.168.1.7/32", "255.255.255.0/24"} {
+		elements = append(elements, nftElement{Prefix: netip.MustParsePrefix(s)})
+	}
+
+	list := nftSetElements(elements)
+	slices.Reverse(list)
+	got := nftElementsOf(true, list)
+	if !slices.Equal(got, elements) {
+		t.Fatalf("elements %v, want %v", got, elements)
+	}
+
+	ps := rangePrefixes(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.6"))
+	if len(ps) != 4 || ps[0].String() != "10.0.0.1/32" || ps[1].String() != "10.0.0.2/31" ||
+		ps[2].String() != "10.0.0.4/31" || ps[3].String() != "10.0.0.6/32" {
+		t.Fatal("wrong range prefixes:", ps)
+	}
+}
+
+func TestNftElementsChunks(t *testing.T) {
+	t.Parallel()
+
+	var elements []nftElement
+	for i := range 600 {
+		elements = append(elements, nftElement{Prefix: netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 32)})
+	}
+	tx := NewNftNetlink().Begin()
+	tx.AddElements(nftTable{Family: "inet", Name: "netip"}, "geo4-DE", elements)
+	if err := tx.(*nftNetlinkTx).err; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(tx.String(), "10.0.0.31, ... 568 more }\n") {
+		t.Fatal("journal is not cut:", tx.String())
+	}
+}
+
+func TestNftReject(t *testing.T) {
+	t.Parallel()
+
+	for family, want := range map[string]expr.Reject{
+		"inet": {Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH},
+		"ip":   {Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 3},
+		"ip6":  {Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 4},
+	} {
+		tx := NewNftNetlink().Begin()
+		tx.AddRule(nftTable{Family: family, Name: "netip"}, "egress", ruleOf(stmtVerdict{Kind: "reject"}))
+		exprs := ruleExprs(t, tx, "add rule "+family+" netip egress reject")
+		if !hasExpr(exprs, func(e *expr.Reject) bool { return *e == want }) {
+			t.Fatalf("wrong reject of %s: %+v", family, exprs)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"netip-network/collector"
+	"os"
+	"sync"
+)
+
+const (
+	outboxLimit    = 2048
+	outboxRollup   = 60
+	outboxSpoolMax = 64 << 20
+	// outboxBurst events written in a row before writer serves its other duties
+	outboxBurst = 64
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// networkEvent collect-network event, the outbox can coalesce them into rollups
+type networkEvent struct {
+	Event          string                    `json:"event"`
+	CollectNetwork *collector.CollectNetwork `json:"collectNetwork"`
+}
+
+// Outbox keeps events while connection is down and replays them in order,
+// on overflow per-second network samples coalesce into rollups,
+// then the oldest events spill to spool on disk (if enabled) or dropping
+type Outbox struct {
+	mu        sync.Mutex
+	queue     []any
+	retry     []any // not delivered events, older than spool and queue
+	limit     int
+	online    bool
+	notify    chan struct{}
+	spool     string
+	spoolMax  int64
+	spoolSize int64
+	replay    *os.File
+	replayBuf *bufio.Reader
+	replayed  bool
+}
+
+func NewOutbox(limit int, spool string, spoolMax int64) *Outbox {
+	o := &Outbox{
+		limit:    limit,
+		notify:   make(chan struct{}, 1),
+		spool:    spool,
+		spoolMax: spoolMax,
+	}
+	if spool != "" {
+		if fi, err := os.Stat(spool); err == nil {
+			o.spoolSize = fi.Size()
+		}
+		if _, err := os.Stat(o.replayFile()); err == nil {
+			o.replayed = true
+		}
+		if o.spoolSize > 0 || o.replayed {
+			log.Println("[outbox] found spool from previous run")
+		}
+	}
+	return o
+}
+
+func (o *Outbox) replayFile() string {
+	return o.spool + ".replay"
+}
+
+func (o *Outbox) wake() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Online allows or pauses replaying, sets after successful handshake
+func (o *Outbox) Online(online bool) {
+	o.mu.Lock()
+	o.online = online
+	o.mu.Unlock()
+	o.wake()
+}
+
+func (o *Outbox) Push(v any) {
+	o.mu.Lock()
+	o.queue = append(o.queue, v)
+	if len(o.queue) > o.limit {
+		o.overflow()
+	}
+	o.mu.Unlock()
+	o.wake()
+}
+
+// Requeue returns not delivered event, it goes before spool and queue
+func (o *Outbox) Requeue(v any) {
+	o.mu.Lock()
+	o.retry = append([]any{v}, o.retry...)
+	o.mu.Unlock()
+	o.wake()
+}
+
+// Ready signals that events can be taken by Next
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.notify
+}
+
+func (o *Outbox) overflow() {
+	o.coalesce()
+	if len(o.queue) <= o.limit {
+		return
+	}
+
+	half := len(o.queue) / 2
+	if o.spool != "" {
+		err := o.spill(o.queue[:half])
+		if err == nil {
+			o.queue = append([]any{}, o.queue[half:]...)
+			return
+		}
+		log.Println("[outbox] spill err:", err)
+	}
+
+	log.Println("[outbox] notice: overflow, dropped oldest events:", half)
+	o.queue = append([]any{}, o.queue[half:]...)
+}
+
+// coalesce merges adjacent network samples into rollups up to outboxRollup seconds
+func (o *Outbox) coalesce() {
+	queue := make([]any, 0, len(o.queue))
+	var rollup *networkEvent
+	for _, v := range o.queue {
+		ne, ok := v.(*networkEvent)
+		if !ok {
+			rollup = nil
+			queue = append(queue, v)
+			continue
+		}
+		if rollup != nil &&
+			rollup.CollectNetwork.Samples()+ne.CollectNetwork.Samples() <= outboxRollup {
+			rollup.CollectNetwork.Merge(ne.CollectNetwork)
+			continue
+		}
+		cn := *ne.CollectNetwork
+		rollup = &networkEvent{Event: ne.Event, CollectNetwork: &cn}
+		queue = append(queue, rollup)
+	}
+	o.queue = queue
+}
+
+// spill appends events to spool all or nothing, so they are either on disk or kept by caller
+func (o *Outbox) spill(events []any) error {
+	var buf bytes.Buffer
+	for _, v := range events {
+		js, err := json.Marshal(v)
+		if err != nil {
+			log.Println("[outbox] marshal event err:", err)
+			continue
+		}
+		buf.Write(js)
+		buf.WriteByte('\n')
+	}
+	if o.spoolSize+int64(buf.Len()) > o.spoolMax {
+		return errSpoolFull
+	}
+
+	f, err := os.OpenFile(o.spool, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		// cut partly written lines
+		_ = f.Truncate(o.spoolSize)
+		return err
+	}
+	o.spoolSize += int64(buf.Len())
+	return nil
+}
+
+// Next returns the oldest event: first not delivered one, then from spool, then from memory
+func (o *Outbox) Next() (any, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.online {
+		return nil, false
+	}
+	if len(o.retry) > 0 {
+		v := o.retry[0]
+		o.retry = o.retry[1:]
+		return v, true
+	}
+
+	for {
+		if o.replay == nil && (o.replayed || o.spoolSize > 0) {
+			o.openReplay()
+		}
+		if o.replay == nil {
+			return o.nextQueue()
+		}
+
+		line, err := o.replayBuf.ReadBytes('\n')
+		if len(line) > 1 && line[len(line)-1] == '\n' {
+			return json.RawMessage(line[:len(line)-1]), true
+		}
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			log.Println("[outbox] read replay err:", err)
+		}
+		_ = o.replay.Close()
+		_ = os.Remove(o.replayFile())
+		o.replay = nil
+		o.replayBuf = nil
+		o.replayed = false
+	}
+}
+
+// openReplay rotates spool to the replay file, which is older than spool
+func (o *Outbox) openReplay() {
+	if !o.replayed {
+		if err := os.Rename(o.spool, o.replayFile()); err != nil {
+			log.Println("[outbox] rotate spool err:", err)
+		}
+		o.spoolSize = 0
+	}
+	f, err := os.Open(o.replayFile())
+	if err != nil {
+		log.Println("[outbox] open replay err:", err)
+		o.replayed = false
+		return
+	}
+	log.Println("[outbox] replaying spool")
+	o.replay = f
+	o.replayBuf = bufio.NewReader(f)
+	o.replayed = true
+}
+
+func (o *Outbox) nextQueue() (any, bool) {
+	if len(o.queue) == 0 {
+		return nil, false
+	}
+	v := o.queue[0]
+	o.queue[0] = nil
+	o.queue = o.queue[1:]
+	return v, true
+}
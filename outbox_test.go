@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"netip-network/collector"
+	"os"
+	"testing"
+)
+
+func TestOutboxCoalesce(t *testing.T) {
+	t.Parallel()
+
+	o := NewOutbox(100, "", 0)
+	o.Push(&struct{ Event string }{"first"})
+	for i := 0; i < 150; i++ {
+		o.Push(&networkEvent{Event: "collect-network", CollectNetwork: &collector.CollectNetwork{
+			NetworkStats: map[string]collector.NetworkStats{"eth0": {BytesRx: 1}},
+		}})
+	}
+
+	if len(o.queue) > o.limit {
+		t.Fatal("limit exceeded:", len(o.queue))
+	}
+	o.coalesce()
+	if len(o.queue) != 4 {
+		t.Fatal("wrong quantity after coalesce:", len(o.queue))
+	}
+	if _, ok := o.queue[0].(*networkEvent); ok {
+		t.Fatal("order broken")
+	}
+	sum := 0
+	for _, v := range o.queue[1:] {
+		cn := v.(*networkEvent).CollectNetwork
+		if cn.Samples() > outboxRollup {
+			t.Fatal("rollup too large:", cn.Samples())
+		}
+		sum += cn.NetworkStats["eth0"].BytesRx
+	}
+	if sum != 150 {
+		t.Fatal("lost samples:", sum)
+	}
+}
+
+func TestOutboxSpoolReplay(t *testing.T) {
+	t.Parallel()
+
+	o := NewOutbox(4, t.TempDir()+"/outbox", outboxSpoolMax)
+	for i := 0; i < 12; i++ {
+		o.Push(map[string]int{"seq": i})
+	}
+	if o.spoolSize == 0 {
+		t.Fatal("spool is empty")
+	}
+
+	if _, ok := o.Next(); ok {
+		t.Fatal("replayed while offline")
+	}
+	o.Online(true)
+
+	for i := 0; i < 12; i++ {
+		v, ok := o.Next()
+		if !ok {
+			t.Fatal("lost event:", i)
+		}
+		var seq int
+		switch e := v.(type) {
+		case json.RawMessage:
+			var m map[string]int
+			if err := json.Unmarshal(e, &m); err != nil {
+				t.Fatal(err)
+			}
+			seq = m["seq"]
+		case map[string]int:
+			seq = e["seq"]
+		}
+		if seq != i {
+			t.Fatalf("wrong order, expected %d got %d", i, seq)
+		}
+		// new events while replaying are going after
+		if i == 2 {
+			o.Push(map[string]int{"seq": 12})
+		}
+	}
+	if v, ok := o.Next(); !ok || v.(map[string]int)["seq"] != 12 {
+		t.Fatal("lost event pushed while replaying")
+	}
+}
+
+func TestOutboxSpoolFull(t *testing.T) {
+	t.Parallel()
+
+	spool := t.TempDir() + "/outbox"
+	// room for one batch of two events
+	o := NewOutbox(4, spool, 25)
+	for i := 0; i < 5; i++ {
+		o.Push(map[string]int{"seq": i})
+	}
+	data, err := os.ReadFile(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != o.spoolSize || len(data) == 0 {
+		t.Fatalf("spool size %d, tracked %d", len(data), o.spoolSize)
+	}
+
+	// batch above the rest of limit is not written at all
+	for i := 5; i < 12; i++ {
+		o.Push(map[string]int{"seq": i})
+	}
+	after, err := os.ReadFile(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, after) || int64(len(after)) != o.spoolSize {
+		t.Fatalf("full spool changed:\n%s", after)
+	}
+}
+
+func TestOutboxRequeue(t *testing.T) {
+	t.Parallel()
+
+	o := NewOutbox(4, t.TempDir()+"/outbox", outboxSpoolMax)
+	for i := 0; i < 6; i++ {
+		o.Push(map[string]int{"seq": i})
+	}
+	o.Online(true)
+	v, _ := o.Next()
+	o.Requeue(v)
+
+	for i := 0; i < 6; i++ {
+		v, ok := o.Next()
+		if !ok {
+			t.Fatal("lost event:", i)
+		}
+		var m map[string]int
+		switch e := v.(type) {
+		case json.RawMessage:
+			if err := json.Unmarshal(e, &m); err != nil {
+				t.Fatal(err)
+			}
+		case map[string]int:
+			m = e
+		}
+		if m["seq"] != i {
+			t.Fatalf("wrong order, expected %d got %d", i, m["seq"])
+		}
+	}
+}
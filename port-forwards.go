@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+)
+
+type PortForwardsData struct {
+	Id          string   `json:"id"`
+	Protocol    string   `json:"protocol"` // tcp, udp or both when empty
+	Port        int      `json:"port"`
+	Destination string   `json:"destination"`
+	ToPort      int      `json:"toPort"` // 0 keeps port
+	Sources     []string `json:"sources"`
+	// Masquerade snat to node address, for destinations without route back through node
+	Masquerade bool `json:"masquerade"`
+	// Hairpin forwarding for clients of private networks and the node itself
+	Hairpin bool `json:"hairpin"`
+}
+
+type PortForwards struct {
+	nft   Nft
+	table nftTable
+	stepErrors
+}
+
+var pfPrivate = map[string][]netip.Prefix{
+	"ip":  wgPrivate,
+	"ip6": {netip.MustParsePrefix("fc00::/7")},
+}
+
+// pfFilters tables of docker with FORWARD chain, their rules accepting marked traffic are owned by forwards
+var pfFilters = []nftTable{{Family: "ip", Name: "filter"}, {Family: "ip6", Name: "filter"}}
+
+const (
+	pfMark = 0x10f02
+	// pfComment of rules accepting marked traffic in FORWARD of docker, removed with forwards
+	pfComment = "netip-portforward"
+)
+
+func NewPortForwards() *PortForwards {
+	return &PortForwards{
+		nft:   NewNftNetlink(),
+		table: nftTable{Family: "inet", Name: "netip-portforward"},
+	}
+}
+
+func (p *PortForwards) commit(tx NftTx) {
+	if err := tx.Commit(); err != nil {
+		log.Println("[forward] nft err:", err)
+		logger.Debug("[forward] rejected ruleset:\n" + tx.String())
+		p.fail("nft: %s", err)
+	}
+}
+
+// Refresh replaces all port forwards in one transaction, empty list removes them
+func (p *PortForwards) Refresh(list []PortForwardsData) {
+	invalid := 0
+	for i := range list {
+		if err := list[i].validate(); err != nil {
+			log.Printf("[forward] invalid port forward #%d: %s", i, err)
+			p.fail("port forward #%d: %s", i, err)
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		p.fail("port forwards are not applied, fix invalid entries")
+		return
+	}
+	if len(list) == 0 {
+		p.down()
+		return
+	}
+
+	log.Printf("[forward] refreshing %d port forwards", len(list))
+	tx := p.nft.Begin()
+	if p.nft.TableExists(p.table) {
+		tx.DelTable(p.table)
+	}
+	p.render(tx, list)
+	p.commit(tx)
+}
+
+func (p *PortForwards) Destroy() {
+	p.down()
+}
+
+func (p *PortForwards) down() {
+	tx := p.nft.Begin()
+	if p.renderDown(tx) > 0 {
+		log.Println("[forward] down")
+		p.commit(tx)
+	}
+}
+
+// renderDown queues removal of own table and accept rules in FORWARD of docker, returns count of changes
+func (p *PortForwards) renderDown(tx NftTx) int {
+	changes := 0
+	if p.nft.TableExists(p.table) {
+		tx.DelTable(p.table)
+		changes++
+	}
+	for _, filter := range pfFilters {
+		for _, handle := range p.forwardMarked(filter) {
+			tx.DelRule(filter, "FORWARD", handle)
+			changes++
+		}
+	}
+	return changes
+}
+
+func (p *PortForwards) render(tx NftTx, list []PortForwardsData) {
+	tx.AddTable(p.table)
+	// before nat of docker and firewall, translated address is not local for netip chain
+	tx.AddChain(p.table, nftChain{Name: "prerouting", Type: "nat", Hook: "prerouting", Priority: -110, Policy: "accept"})
+	tx.AddChain(p.table, nftChain{Name: "output", Type: "nat", Hook: "output", Priority: -110, Policy: "accept"})
+	tx.AddChain(p.table, nftChain{Name: "postrouting", Type: "nat", Hook: "postrouting", Priority: 100, Policy: "accept"})
+	tx.AddChain(p.table, nftChain{Name: "forward", Type: "filter", Hook: "forward", Priority: -100, Policy: "accept"})
+
+	for _, e := range list {
+		destination, _ := parsePrefix(e.Destination)
+		family := "ip"
+		if destination.Addr().Is6() {
+			family = "ip6"
+		}
+		protos := []string{"tcp", "udp"}
+		if e.Protocol != "" {
+			protos = []string{e.Protocol}
+		}
+		toPort := e.ToPort
+		if toPort == 0 {
+			toPort = e.Port
+		}
+
+		var sources []nftExpr
+		if len(e.Sources) > 0 {
+			prefixes := make([]netip.Prefix, len(e.Sources))
+			for i, s := range e.Sources {
+				prefixes[i], _ = parsePrefix(s)
+			}
+			sources = append(sources, matchAddr{Family: family, Prefixes: prefixes})
+		}
+
+		for _, proto := range protos {
+			dnat := ruleOf(append(append([]nftExpr{matchFibLocal{}}, sources...),
+				matchL4proto{Protos: []string{proto}},
+				matchPort{Proto: proto, Dst: true, Ports: []nftPortRange{{uint16(e.Port), uint16(e.Port)}}},
+				stmtCounter{},
+				stmtDnat{Family: family, Addr: destination.Addr(), Port: uint16(toPort)})...).commented(e.Id)
+			tx.AddRule(p.table, "prerouting", dnat)
+			if e.Hairpin {
+				tx.AddRule(p.table, "output", dnat)
+			}
+
+			forwarded := []nftExpr{
+				matchCtDnat{},
+				matchAddr{Family: family, Dst: true, Prefixes: []netip.Prefix{destination}},
+				matchL4proto{Protos: []string{proto}},
+				matchPort{Proto: proto, Dst: true, Ports: []nftPortRange{{uint16(toPort), uint16(toPort)}}},
+			}
+			tx.AddRule(p.table, "forward", ruleOf(append(forwarded, stmtMarkSet{Mark: pfMark})...))
+			if e.Masquerade {
+				tx.AddRule(p.table, "postrouting", ruleOf(append(forwarded,
+					stmtCounter{}, stmtMasquerade{})...).commented(e.Id))
+			} else if e.Hairpin {
+				tx.AddRule(p.table, "postrouting", ruleOf(append(forwarded,
+					matchAddr{Family: family, Prefixes: pfPrivate[family]},
+					stmtCounter{}, stmtMasquerade{})...).commented(e.Id))
+			}
+		}
+	}
+
+	// docker keeps FORWARD with drop policy
+	for _, filter := range pfFilters {
+		if p.nft.ChainExists(filter, "FORWARD") && len(p.forwardMarked(filter)) == 0 {
+			tx.AddRule(filter, "FORWARD", ruleOf(matchMark{Mark: pfMark},
+				stmtVerdict{Kind: "accept"}).commented(pfComment))
+		}
+	}
+}
+
+// forwardMarked handles of rules accepting marked traffic in FORWARD
+func (p *PortForwards) forwardMarked(filter nftTable) []uint64 {
+	rules, err := p.nft.Rules(filter, "FORWARD")
+	if err != nil {
+		return nil
+	}
+	var handles []uint64
+	for _, r := range rules {
+		if r.Mark == pfMark || r.Comment == pfComment {
+			handles = append(handles, r.Handle)
+		}
+	}
+	return handles
+}
+
+// validate checks and normalizes port forward before it reaches nft
+func (e *PortForwardsData) validate() error {
+	e.Id = strings.TrimSpace(e.Id)
+	if e.Id != "" && !ruleIdReg.MatchString(e.Id) {
+		return fmt.Errorf("id %q is not allowed", e.Id)
+	}
+
+	e.Protocol = strings.ToLower(strings.TrimSpace(e.Protocol))
+	if e.Protocol != "" && e.Protocol != "tcp" && e.Protocol != "udp" {
+		return fmt.Errorf("protocol %q is not allowed", e.Protocol)
+	}
+	if e.Port < 1 || e.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", e.Port)
+	}
+	if e.ToPort < 0 || e.ToPort > 65535 {
+		return fmt.Errorf("toPort %d is out of range", e.ToPort)
+	}
+
+	destination, err := parsePrefix(e.Destination)
+	if err != nil {
+		return fmt.Errorf("destination %q: %w", e.Destination, err)
+	}
+	if !destination.IsSingleIP() {
+		return fmt.Errorf("destination %q is not a single ip", e.Destination)
+	}
+	if a := destination.Addr(); a.IsLoopback() || a.IsUnspecified() || a.IsMulticast() {
+		return fmt.Errorf("destination %q is not routable", e.Destination)
+	}
+	e.Destination = prefixString(destination)
+
+	var sources []string
+	for _, s := range e.Sources {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		source, err := parsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("source %q: %w", s, err)
+		}
+		if source.Addr().Is4() != destination.Addr().Is4() {
+			return errors.New("sources and destination of different ip versions")
+		}
+		sources = append(sources, prefixString(source))
+	}
+	e.Sources = sources
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"strings"
+	"testing"
+)
+
+func TestPortForwardsRender(t *testing.T) {
+	t.Parallel()
+
+	list := []PortForwardsData{
+		{Id: "ssh-peer", Protocol: "TCP", Port: 2222, Destination: "10.30.1.5", ToPort: 22,
+			Sources: []string{"203.0.113.0/24", " "}, Hairpin: true},
+		{Port: 8443, Destination: "2001:db8::5", Masquerade: true},
+	}
+	for i := range list {
+		if err := list[i].validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := NewPortForwards()
+	tx := p.nft.Begin()
+	p.render(tx, list)
+	script := checkScript(t, tx,
+		"add chain inet netip-portforward prerouting { type nat hook prerouting priority -110; policy accept; }",
+		"add rule inet netip-portforward prerouting fib daddr type local ip saddr 203.0.113.0/24 "+
+			"meta l4proto tcp tcp dport 2222 counter dnat ip to 10.30.1.5:22 comment \"ssh-peer\"",
+		"add rule inet netip-portforward output fib daddr type local ip saddr 203.0.113.0/24 "+
+			"meta l4proto tcp tcp dport 2222 counter dnat ip to 10.30.1.5:22 comment \"ssh-peer\"",
+		"add rule inet netip-portforward postrouting ct status dnat ip daddr 10.30.1.5 meta l4proto tcp tcp dport 22 "+
+			"ip saddr { 10.0.0.0/8, 100.64.0.0/10, 172.16.0.0/12, 192.168.0.0/16 } counter masquerade comment \"ssh-peer\"",
+		"add rule inet netip-portforward forward ct status dnat ip daddr 10.30.1.5 meta l4proto tcp tcp dport 22 "+
+			"meta mark set 0x00010f02",
+		"add rule inet netip-portforward prerouting fib daddr type local meta l4proto udp udp dport 8443 "+
+			"counter dnat ip6 to [2001:db8::5]:8443",
+		"add rule inet netip-portforward postrouting ct status dnat ip6 daddr 2001:db8::5 meta l4proto tcp tcp dport 8443 "+
+			"counter masquerade",
+	)
+	exprs := ruleExprs(t, tx, "add rule inet netip-portforward prerouting fib daddr type local ip saddr 203.0.113.0/24 "+
+		"meta l4proto tcp tcp dport 2222 counter dnat ip to 10.30.1.5:22 comment \"ssh-peer\"")
+	if !hasExpr(exprs, func(e *expr.NAT) bool { return e.Type == expr.NATTypeDestNAT && e.Family == unix.NFPROTO_IPV4 }) {
+		t.Fatal("rule has no dnat:", exprs)
+	}
+	exprs = ruleExprs(t, tx, "add rule inet netip-portforward postrouting ct status dnat ip6 daddr 2001:db8::5 meta l4proto tcp tcp dport 8443 "+
+		"counter masquerade")
+	if !hasExpr(exprs, func(e *expr.Masq) bool { return true }) {
+		t.Fatal("rule has no masquerade:", exprs)
+	}
+	if strings.Contains(script, "output fib daddr type local meta l4proto udp udp dport 8443") {
+		t.Fatal("output rule without hairpin")
+	}
+}
+
+// pfNft docker filter tables with own table of forwards
+type pfNft struct {
+	fakeNft
+}
+
+func (n *pfNft) TableExists(t nftTable) bool {
+	return true
+}
+
+func (n *pfNft) Begin() NftTx {
+	return NewNftNetlink().Begin()
+}
+
+func TestPortForwardsDown(t *testing.T) {
+	t.Parallel()
+
+	p := NewPortForwards()
+	p.nft = &pfNft{fakeNft{rules: map[string][]nftRuleInfo{
+		"ip filter FORWARD":  {{Handle: 3}, {Handle: 7, Mark: pfMark, Comment: pfComment}},
+		"ip6 filter FORWARD": {{Handle: 9, Mark: pfMark, Comment: pfComment}},
+	}}}
+	tx := p.nft.Begin()
+	if changes := p.renderDown(tx); changes != 3 {
+		t.Fatal("wrong changes:", changes)
+	}
+	script := tx.String()
+	for _, line := range []string{
+		"delete table inet netip-portforward",
+		"delete rule ip filter FORWARD handle 7",
+		"delete rule ip6 filter FORWARD handle 9",
+	} {
+		if !strings.Contains(script, line+"\n") {
+			t.Fatalf("missing line %q in script:\n%s", line, script)
+		}
+	}
+	if strings.Contains(script, "handle 3\n") {
+		t.Fatal("rule of docker is deleted")
+	}
+}
+
+func TestPortForwardsValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, e := range []PortForwardsData{
+		{Port: 0, Destination: "10.0.0.1"},
+		{Port: 70000, Destination: "10.0.0.1"},
+		{Port: 22, Destination: "10.0.0.1", ToPort: -1},
+		{Port: 22, Protocol: "icmp", Destination: "10.0.0.1"},
+		{Port: 22, Destination: "10.0.0.0/24"},
+		{Port: 22, Destination: "127.0.0.1"},
+		{Port: 22, Destination: "host; reboot"},
+		{Port: 22, Destination: "10.0.0.1", Sources: []string{"2001:db8::/32"}},
+		{Port: 22, Destination: "10.0.0.1", Sources: []string{"1.2.3.4 }"}},
+		{Id: "a b", Port: 22, Destination: "10.0.0.1"},
+	} {
+		if err := e.validate(); err == nil {
+			t.Fatalf("invalid port forward passed: %+v", e)
+		}
+	}
+}
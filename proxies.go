@@ -25,7 +25,9 @@ type ProxiesClient struct {
 	Password string `json:"password"`
 }
 
-type Proxies struct{}
+type Proxies struct {
+	stepErrors
+}
 
 func NewProxies() *Proxies {
 	return &Proxies{}
@@ -40,6 +42,7 @@ func (p *Proxies) shell(command string, errIgnore bool, timeout time.Duration) s
 	out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
 	if err != nil && !errIgnore {
 		log.Println("[proxies] shell err:", err, "command:", command)
+		p.fail("%s: %s: %s", command, err, strings.TrimSpace(string(out)))
 	}
 	return strings.TrimSpace(string(out))
 }
@@ -77,6 +80,7 @@ func (p *Proxies) writeAccounts(pId int, clients []ProxiesClient) {
 	err := os.WriteFile(p.fileAccounts(pId), fillBytes, 0644)
 	if err != nil {
 		log.Println("[proxies] err accounts save conf, id:", pId)
+		p.fail("save accounts id %d: %s", pId, err)
 		return
 	}
 }
@@ -162,6 +166,7 @@ http {
 	err := os.WriteFile(p.fileConf(pId), []byte(conf.String()), 0644)
 	if err != nil {
 		log.Println("[proxies] err save conf, id:", pId)
+		p.fail("save conf id %d: %s", pId, err)
 		return
 	}
 
@@ -181,11 +186,13 @@ func (p *Proxies) refreshHttps(pId int, pd ProxiesData) {
 		err := os.WriteFile(certPath+".key", []byte(pd.CertKey), 0644)
 		if err != nil {
 			log.Println("[proxies] err save cert key, id:", pId)
+			p.fail("save cert key id %d: %s", pId, err)
 			return
 		}
 		err = os.WriteFile(certPath+".pub", []byte(pd.CertPub), 0644)
 		if err != nil {
 			log.Println("[proxies] err save cert pub, id:", pId)
+			p.fail("save cert pub id %d: %s", pId, err)
 			return
 		}
 	}
@@ -261,6 +268,7 @@ http {
 	err := os.WriteFile(p.fileConf(pId), []byte(conf), 0644)
 	if err != nil {
 		log.Println("[proxies] err save conf, id:", pId)
+		p.fail("save conf id %d: %s", pId, err)
 		return
 	}
 
@@ -31,7 +31,9 @@ type SpnDnsRule struct {
 	Host string `json:"host"`
 }
 
-type SpnDns struct{}
+type SpnDns struct {
+	stepErrors
+}
 
 func NewSpnDns() *SpnDns {
 	return &SpnDns{}
@@ -46,6 +48,7 @@ func (d *SpnDns) shell(command string, errIgnore bool, timeout time.Duration) st
 	out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
 	if err != nil && !errIgnore {
 		log.Println("[spn] dns shell err:", err, "command:", command)
+		d.fail("%s: %s: %s", command, err, strings.TrimSpace(string(out)))
 	}
 	return strings.TrimSpace(string(out))
 }
@@ -64,6 +67,7 @@ func (d *SpnDns) down() {
 	err := os.Remove(dnsConfFile)
 	if err != nil && !os.IsNotExist(err) {
 		log.Println("[spn] dns clean conf err:", err)
+		d.fail("clean conf: %s", err)
 	}
 }
 
@@ -83,6 +87,7 @@ func (d *SpnDns) Refresh(bundle *SpnDnsBundle) {
 		err := os.WriteFile(dnsHostsFile, []byte(hosts), 0644)
 		if err != nil {
 			log.Println("[spn] dns save hosts, err:", err)
+			d.fail("save hosts: %s", err)
 			return
 		}
 		preDnsHosts = hosts
@@ -110,6 +115,7 @@ func (d *SpnDns) Refresh(bundle *SpnDnsBundle) {
 	err := os.WriteFile(dnsConfFile, []byte(conf), 0644)
 	if err != nil {
 		log.Println("[spn] dns save conf, err:", err)
+		d.fail("save conf: %s", err)
 		return
 	}
 	d.up()
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/netip"
 	"os"
 	"os/exec"
 	"strings"
@@ -29,10 +30,24 @@ type WireguardPeer struct {
 	AllowedIPs string `json:"allowedIPs"`
 }
 
-type Wireguard struct{}
+type Wireguard struct {
+	nft Nft
+	stepErrors
+}
+
+var wgPrivate = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+}
+
+const wgMark = 0x10f01
 
 func NewWireguard() *Wireguard {
-	return &Wireguard{}
+	return &Wireguard{
+		nft: NewNftNetlink(),
+	}
 }
 
 func (w *Wireguard) shell(command string) string {
@@ -41,6 +56,7 @@ func (w *Wireguard) shell(command string) string {
 	out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
 	if err != nil {
 		log.Println("[wg] shell err:", err, "command:", command)
+		w.fail("%s: %s: %s", command, err, strings.TrimSpace(string(out)))
 	}
 	return strings.TrimSpace(string(out))
 }
@@ -49,46 +65,120 @@ func (w *Wireguard) fileConf(wgId int) string {
 	return fmt.Sprintf("/tmp/netip-wg%d.conf", wgId)
 }
 
+func (w *Wireguard) table(wgId int) nftTable {
+	return nftTable{Family: "inet", Name: fmt.Sprintf("netip-wg%d", wgId)}
+}
+
+func (w *Wireguard) commit(tx NftTx) {
+	if err := tx.Commit(); err != nil {
+		log.Println("[wg] nft err:", err)
+		logger.Debug("[wg] rejected ruleset:\n" + tx.String())
+		w.fail("nft: %s", err)
+	}
+}
+
 func (w *Wireguard) up(wgId int, masquerade, shared bool, network string) {
 	w.shell("wg-quick up " + w.fileConf(wgId))
 
 	if masquerade {
 		inf := fmt.Sprintf("netip-wg%d", wgId)
-		w.shell("nft add table inet " + inf)
-		w.shell("nft add chain inet " + inf + " forward-wg '{ type filter hook forward priority -100; policy accept ; }'")
-		w.shell("nft add rule inet " + inf + " forward-wg iifname " + inf + " counter mark set 0x10f01")
-		w.shell("nft add rule inet " + inf + " forward-wg oifname " + inf + " counter mark set 0x10f01")
-		w.shell("nft add chain inet " + inf + " masquerade-wg '{ type nat hook postrouting priority srcnat; policy accept; }'")
+		table := w.table(wgId)
+		tx := w.nft.Begin()
+		tx.AddTable(table)
+		tx.AddChain(table, nftChain{Name: "forward-wg", Type: "filter", Hook: "forward", Priority: -100, Policy: "accept"})
+		tx.AddRule(table, "forward-wg", ruleOf(matchIfname{Name: inf}, stmtCounter{}, stmtMarkSet{Mark: wgMark}))
+		tx.AddRule(table, "forward-wg", ruleOf(matchIfname{Out: true, Name: inf}, stmtCounter{}, stmtMarkSet{Mark: wgMark}))
+		tx.AddChain(table, nftChain{Name: "masquerade-wg", Type: "nat", Hook: "postrouting", Priority: 100, Policy: "accept"})
 
 		// block access to private addresses for usual wireguard server
 		if !shared {
-			w.shell("nft add rule inet " + inf + " masquerade-wg ip saddr " + network +
-				" ip daddr != '{ 10.0.0.0/8, 100.64.0.0/10, 172.16.0.0/12, 192.168.0.0/16 }' counter masquerade")
-			w.shell("nft add rule inet  " + inf + " masquerade-wg ip saddr " + network +
-				" ip daddr '{ 10.0.0.0/8, 100.64.0.0/10, 172.16.0.0/12, 192.168.0.0/16 }' counter drop")
+			prefix, err := parsePrefix(network)
+			if err != nil {
+				log.Printf("[wg] invalid network %q: %s", network, err)
+				w.fail("invalid network %q: %s", network, err)
+			} else {
+				source := matchAddr{Family: "ip", Prefixes: []netip.Prefix{prefix}}
+				tx.AddRule(table, "masquerade-wg", ruleOf(source,
+					matchAddr{Family: "ip", Dst: true, Neg: true, Prefixes: wgPrivate},
+					stmtCounter{}, stmtMasquerade{}))
+				tx.AddRule(table, "masquerade-wg", ruleOf(source,
+					matchAddr{Family: "ip", Dst: true, Prefixes: wgPrivate},
+					stmtCounter{}, stmtVerdict{Kind: "drop"}))
+			}
 		}
 
-		w.shell("nft list chain ip filter FORWARD | grep 0x00010f01 >/dev/null 2>&1 ||" +
-			" nft add rule ip filter FORWARD mark 0x10f01 accept")
+		// docker keeps FORWARD with drop policy
+		filter := nftTable{Family: "ip", Name: "filter"}
+		if w.nft.ChainExists(filter, "FORWARD") && !w.forwardMarked() {
+			tx.AddRule(filter, "FORWARD",
+				ruleOf(matchMark{Mark: wgMark}, stmtVerdict{Kind: "accept"}))
+		}
+		w.commit(tx)
 	}
 }
 
+// forwardMarked rule accepting marked traffic exists in FORWARD
+func (w *Wireguard) forwardMarked() bool {
+	rules, err := w.nft.Rules(nftTable{Family: "ip", Name: "filter"}, "FORWARD")
+	if err != nil {
+		return false
+	}
+	for _, r := range rules {
+		if r.Mark == wgMark {
+			return true
+		}
+	}
+	return false
+}
+
 // sharedMasquerade flush masquerade-wg and adding access rules
 func (w *Wireguard) sharedMasquerade(wgId int, access map[string][]string) {
-	inf := fmt.Sprintf("netip-wg%d", wgId)
-	w.shell("nft flush chain inet " + inf + " masquerade-wg")
+	table := w.table(wgId)
+	tx := w.nft.Begin()
+	tx.FlushChain(table, "masquerade-wg")
 
 	for address, allowed := range access {
 		if len(allowed) == 0 {
 			continue
 		}
-		w.shell("nft add rule inet " + inf + " masquerade-wg ip saddr " + address +
-			" ip daddr '{ " + strings.Join(allowed, ", ") + " }' counter masquerade")
+		source, err := parsePrefix(address)
+		if err != nil {
+			log.Printf("[wg] invalid peer address %q: %s", address, err)
+			w.fail("invalid peer address %q: %s", address, err)
+			continue
+		}
+		var destinations []netip.Prefix
+		for _, a := range allowed {
+			if strings.TrimSpace(a) == "" {
+				continue
+			}
+			p, err := parsePrefix(a)
+			if err != nil {
+				log.Printf("[wg] invalid allowed ip %q: %s", a, err)
+				w.fail("invalid allowed ip %q: %s", a, err)
+				continue
+			}
+			if p.Addr().Is4() {
+				destinations = append(destinations, p)
+			}
+		}
+		if len(destinations) == 0 {
+			continue
+		}
+		tx.AddRule(table, "masquerade-wg", ruleOf(
+			matchAddr{Family: "ip", Prefixes: []netip.Prefix{source}},
+			matchAddr{Family: "ip", Dst: true, Prefixes: destinations},
+			stmtCounter{}, stmtMasquerade{}))
 	}
+	w.commit(tx)
 }
 
 func (w *Wireguard) down(wgId int) {
-	w.shell(fmt.Sprintf("nft delete table inet netip-wg%d", wgId))
+	if w.nft.TableExists(w.table(wgId)) {
+		tx := w.nft.Begin()
+		tx.DelTable(w.table(wgId))
+		w.commit(tx)
+	}
 
 	w.shell("wg-quick down " + w.fileConf(wgId))
 }
@@ -141,6 +231,7 @@ MTU = %d
 		err := os.WriteFile(w.fileConf(wgId), []byte(conf.String()), 0600)
 		if err != nil {
 			log.Println("[wg] err save conf, wg id:", wgId)
+			w.fail("save conf wg id %d: %s", wgId, err)
 			return
 		}
 
@@ -193,6 +284,7 @@ PersistentKeepalive = 25
 		err := os.WriteFile(w.fileConf(wgId), []byte(conf.String()), 0600)
 		if err != nil {
 			log.Println("[wg] err shared save conf, wg id:", wgId)
+			w.fail("save shared conf wg id %d: %s", wgId, err)
 			return
 		}
 